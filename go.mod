@@ -7,4 +7,5 @@ require (
 	github.com/hashicorp/golang-lru v0.5.4
 	github.com/lestrrat-go/strftime v1.0.2-0.20200511001955-47fd69319961
 	golang.org/x/net v0.0.0-20200520004742-59133d7f0dd7
+	gopkg.in/yaml.v3 v3.0.1
 )
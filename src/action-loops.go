@@ -3,7 +3,11 @@ package main
 import (
 	"bytes"
 	"compress/gzip"
+	"encoding/json"
+	"os"
+	"os/signal"
 	"sync"
+	"syscall"
 	"time"
 )
 
@@ -13,7 +17,6 @@ var (
 			return new(bytes.Buffer)
 		},
 	}
-	gzipWriter *gzip.Writer
 )
 
 func returnToPool(b *bytes.Buffer) {
@@ -37,7 +40,6 @@ func doPostLoop(
 		hc.postData(log, url, headers, chunk)
 		returnToPool(chunk)
 	}
-	return nil
 }
 
 func aggregateChannelLoop(
@@ -51,6 +53,8 @@ func aggregateChannelLoop(
 	chunkTimeStep := uint64(100)
 	newLine := []byte("\n")
 	bufPointer := bufPool.Get().(*bytes.Buffer)
+	// each loop has its own writer, as more than one may run at once
+	var gzipWriter *gzip.Writer
 	if compress {
 		gzipWriter = gzip.NewWriter(bufPointer)
 	}
@@ -114,3 +118,94 @@ func aggregateChannelLoop(
 		}
 	}
 }
+
+// expireLoop actively removes expired entries from the deduplication cache,
+// rather than waiting for their keys to be looked up again.
+func expireLoop(
+	dedup *Deduplicator,
+	interval time.Duration,
+	done chan struct{},
+) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case now := <-ticker.C:
+			dedup.Expire(now)
+		}
+	}
+}
+
+func metricsLogLoop(
+	log *SimpleLogger,
+	metrics *Metrics,
+	interval time.Duration,
+	done chan struct{},
+) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if json, err := json.Marshal(metrics.Snapshot()); err == nil {
+				log.Info.Printf("Metrics => %s\n", json)
+			}
+		}
+	}
+}
+
+// matchMapReloadLoop reloads the match map when its file or URL changes
+// (checked every `interval`, if non-zero), or on SIGHUP if `onSignal` is set
+func matchMapReloadLoop(
+	log *SimpleLogger,
+	metrics *Metrics,
+	source *MatchMapSource,
+	interval time.Duration,
+	onSignal bool,
+	done chan struct{},
+) {
+	var ticks <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		ticks = ticker.C
+	}
+	hup := make(chan os.Signal, 1)
+	if onSignal {
+		signal.Notify(hup, syscall.SIGHUP)
+		defer signal.Stop(hup)
+	}
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticks:
+			reloadMatchMap(log, metrics, source, false)
+		case <-hup:
+			reloadMatchMap(log, metrics, source, true)
+		}
+	}
+}
+
+// reloadMatchMap reloads the match map once, counting failures. A map which
+// loads but cannot be cached is still in use, so its version is reported.
+func reloadMatchMap(log *SimpleLogger, metrics *Metrics, source *MatchMapSource, force bool) {
+	reloaded, cacheErr, err := source.Reload(force)
+	if err != nil {
+		metrics.Inc(METRIC_MATCH_MAP_ERROR)
+		log.Error.Printf("Match map reload failed, keeping current map: %v\n", err)
+		return
+	}
+	if cacheErr != nil {
+		log.Error.Printf("Match map reloaded, but not cached: %v\n", cacheErr)
+	}
+	if reloaded {
+		metrics.Inc(METRIC_MATCH_MAP_RELOAD)
+		metrics.SetInfo(METRIC_MATCH_MAP_VER, source.Version())
+		log.Info.Printf("Match map reloaded: version=%s\n", source.Version())
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ADMIN_PATH_PREFIX = "/api/v1/"
+)
+
+type (
+	// AdminServer serves the admin API for every instance configured with
+	// the same `admin_listen` address, routing requests by instance `Id`:
+	//
+	//	GET    /api/v1/<id>/stats
+	//	GET    /api/v1/<id>/keys?key=<key>
+	//	DELETE /api/v1/<id>/keys?key=<key>
+	//	DELETE /api/v1/<id>/keys?prefix=<prefix>
+	//	POST   /api/v1/<id>/flush
+	//
+	// Removing keys drops any open `summarize` windows, without sending
+	// their summaries.
+	AdminServer struct {
+		lock      sync.RWMutex
+		server    *http.Server
+		instances map[string]*PInstance
+	}
+)
+
+var (
+	adminServers     = make(map[string]*AdminServer)
+	adminServersLock sync.Mutex
+)
+
+// localAddress reports whether a listen address is bound to loopback only
+func localAddress(address string) bool {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return false
+	}
+	if strings.EqualFold(host, "localhost") {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// registerAdminInstance adds an instance to the admin server for its
+// `admin_listen` address, starting the server if needed
+func registerAdminInstance(pi *PInstance) error {
+	address := pi.Config.AdminListen
+	adminServersLock.Lock()
+	defer adminServersLock.Unlock()
+
+	if admin, exists := adminServers[address]; exists {
+		admin.lock.Lock()
+		admin.instances[pi.Config.Id] = pi
+		admin.lock.Unlock()
+		return nil
+	}
+
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	admin := &AdminServer{
+		instances: map[string]*PInstance{pi.Config.Id: pi},
+	}
+	admin.server = &http.Server{
+		Handler:      admin,
+		ReadTimeout:  10 * time.Second,
+		WriteTimeout: 30 * time.Second,
+	}
+	adminServers[address] = admin
+	go func() {
+		if err := admin.server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			pi.Log.Error.Printf("Admin API stopped: %v\n", err)
+		}
+	}()
+	pi.Log.Info.Printf("Admin API listening on %s\n", address)
+	return nil
+}
+
+func closeAdminServers() {
+	adminServersLock.Lock()
+	defer adminServersLock.Unlock()
+	for address, admin := range adminServers {
+		admin.server.Close()
+		delete(adminServers, address)
+	}
+}
+
+func adminReply(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+func adminError(w http.ResponseWriter, status int, format string, a ...interface{}) {
+	adminReply(w, status, map[string]string{"error": fmt.Sprintf(format, a...)})
+}
+
+func (a *AdminServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.URL.Path, ADMIN_PATH_PREFIX) {
+		adminError(w, http.StatusNotFound, "Not found")
+		return
+	}
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, ADMIN_PATH_PREFIX), "/", 2)
+	if len(parts) != 2 {
+		adminError(w, http.StatusNotFound, "Not found")
+		return
+	}
+
+	a.lock.RLock()
+	pi, exists := a.instances[parts[0]]
+	a.lock.RUnlock()
+	if !exists {
+		adminError(w, http.StatusNotFound, "Unknown instance: %s", parts[0])
+		return
+	}
+
+	if token := pi.Config.AdminToken; len(token) > 0 {
+		given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			adminError(w, http.StatusUnauthorized, "Unauthorized")
+			return
+		}
+	}
+
+	switch {
+	case parts[1] == "stats" && r.Method == http.MethodGet:
+		adminReply(w, http.StatusOK, map[string]interface{}{
+			"id":      pi.Config.Id,
+			"backend": pi.Config.DedupBackend,
+			"mode":    pi.Config.DedupMode,
+			"entries": pi.Dedup.Len(),
+			"metrics": pi.Metrics.Snapshot(),
+		})
+
+	case parts[1] == "keys" && r.Method == http.MethodGet:
+		key := r.URL.Query().Get("key")
+		now := time.Now()
+		entry, expires, found := pi.Dedup.Lookup(key, now)
+		if !found {
+			// the key may be held only by other instances
+			sharedExpires, sharedFound, err := pi.Dedup.LookupShared(key, now)
+			if err != nil {
+				adminError(w, http.StatusBadGateway, "Shared deduplication backend failed: %v", err)
+				return
+			}
+			if !sharedFound {
+				adminError(w, http.StatusNotFound, "Key not found: %s", key)
+				return
+			}
+			reply := map[string]interface{}{
+				"key":    key,
+				"shared": true,
+			}
+			if !sharedExpires.IsZero() {
+				reply["expires"] = sharedExpires
+			}
+			adminReply(w, http.StatusOK, reply)
+			return
+		}
+		reply := map[string]interface{}{
+			"key":        key,
+			"first_seen": entry.FirstSeen,
+			"last_seen":  entry.LastSeen,
+			"count":      entry.Count,
+		}
+		if !expires.IsZero() {
+			reply["expires"] = expires
+		}
+		adminReply(w, http.StatusOK, reply)
+
+	case parts[1] == "keys" && r.Method == http.MethodDelete:
+		query := r.URL.Query()
+		var removed int
+		if prefix := query.Get("prefix"); len(prefix) > 0 {
+			removed = pi.Dedup.RemovePrefix(prefix)
+		} else if key := query.Get("key"); len(key) > 0 {
+			removed = pi.Dedup.Remove(key)
+		} else {
+			adminError(w, http.StatusBadRequest, "One of `key` or `prefix` is required")
+			return
+		}
+		pi.Log.Info.Printf("Admin API removed %d keys: %s\n", removed, r.URL.RawQuery)
+		adminReply(w, http.StatusOK, map[string]int{"removed": removed})
+
+	case parts[1] == "flush" && r.Method == http.MethodPost:
+		removed := pi.Dedup.RemovePrefix("")
+		pi.Log.Info.Printf("Admin API flushed %d keys\n", removed)
+		adminReply(w, http.StatusOK, map[string]int{"removed": removed})
+
+	default:
+		adminError(w, http.StatusNotFound, "Not found")
+	}
+}
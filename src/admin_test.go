@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// newTestAdmin serves the admin API for one instance in `summarize` mode,
+// holding a window for each of `keys`
+func newTestAdmin(t *testing.T, token string, keys ...string) (*httptest.Server, *PInstance) {
+	pi := newTestPInstance(t, &Config{Id: "out", AdminToken: token, DedupMode: DEDUP_MODE_SUMMARIZE})
+	d, err := newDeduplicator(
+		DEDUP_MODE_SUMMARIZE,
+		func(onRemoved RemovalCallback) (DedupStore, error) {
+			return newExpiringCache(100, onRemoved)
+		},
+		nil,
+		pi.sendSummary,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pi.Dedup = d
+	now := time.Now()
+	for _, key := range keys {
+		d.Check(&DedupCandidate{Key: key, Record: StringifiedRecordType{"k": key}, Timestamp: now, Seen: now, TTL: time.Hour}, now)
+	}
+	server := httptest.NewServer(&AdminServer{instances: map[string]*PInstance{"out": pi}})
+	t.Cleanup(server.Close)
+	return server, pi
+}
+
+// adminRequest returns the status and decoded body of an admin request
+func adminRequest(t *testing.T, server *httptest.Server, method string, path string, token string) (int, map[string]interface{}) {
+	request, err := http.NewRequest(method, server.URL+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(token) > 0 {
+		request.Header.Set("Authorization", "Bearer "+token)
+	}
+	response, err := server.Client().Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	body := map[string]interface{}{}
+	if err := json.NewDecoder(response.Body).Decode(&body); err != nil {
+		t.Fatalf("%s %s: %v", method, path, err)
+	}
+	return response.StatusCode, body
+}
+
+func TestAdminRemoval(t *testing.T) {
+	server, pi := newTestAdmin(t, "", "a:1", "a:2", "b:1", "c:1")
+	for _, test := range []struct {
+		method  string
+		path    string
+		status  int
+		removed float64
+		left    int
+	}{
+		{http.MethodDelete, "/api/v1/out/keys?key=b:1", http.StatusOK, 1, 3},
+		{http.MethodDelete, "/api/v1/out/keys?key=b:1", http.StatusOK, 0, 3},
+		{http.MethodDelete, "/api/v1/out/keys?prefix=a:", http.StatusOK, 2, 1},
+		{http.MethodDelete, "/api/v1/out/keys", http.StatusBadRequest, 0, 1},
+		{http.MethodPost, "/api/v1/out/flush", http.StatusOK, 1, 0},
+		{http.MethodPost, "/api/v1/out/flush", http.StatusOK, 0, 0},
+	} {
+		status, body := adminRequest(t, server, test.method, test.path, "")
+		if status != test.status {
+			t.Fatalf("%s %s: status %d, want %d (%v)", test.method, test.path, status, test.status, body)
+		}
+		if status == http.StatusOK && body["removed"] != test.removed {
+			t.Fatalf("%s %s: removed %v, want %v", test.method, test.path, body["removed"], test.removed)
+		}
+		if pi.Dedup.Len() != test.left {
+			t.Fatalf("%s %s: %d keys left, want %d", test.method, test.path, pi.Dedup.Len(), test.left)
+		}
+	}
+	// the removed windows were dropped rather than summarized
+	if len(pi.EventJsonChan) != 0 {
+		t.Fatalf("%d summaries sent by admin removals", len(pi.EventJsonChan))
+	}
+
+	// windows open at shutdown are still summarized
+	now := time.Now()
+	pi.Dedup.Check(&DedupCandidate{Key: "d:1", Record: StringifiedRecordType{"k": "d:1"}, Timestamp: now, Seen: now, TTL: time.Hour}, now)
+	pi.Dedup.Flush()
+	if record := queued(t, pi); record["k"] != "d:1" || record[SUMMARY_DUP_COUNT_KEY] != float64(1) {
+		t.Fatalf("summary at shutdown %v", record)
+	}
+}
+
+func TestAdminRequests(t *testing.T) {
+	server, pi := newTestAdmin(t, "secret", "a:1")
+	pi.Dedup.Check(&DedupCandidate{Key: "a:1", Timestamp: time.Now(), Seen: time.Now(), TTL: time.Hour}, time.Now())
+	for _, test := range []struct {
+		method string
+		path   string
+		token  string
+		status int
+		want   map[string]interface{}
+	}{
+		{http.MethodGet, "/api/v1/out/stats", "", http.StatusUnauthorized, map[string]interface{}{"error": "Unauthorized"}},
+		{http.MethodGet, "/api/v1/out/stats", "wrong", http.StatusUnauthorized, nil},
+		{http.MethodGet, "/api/v1/out/stats", "secret", http.StatusOK, map[string]interface{}{"id": "out", "mode": DEDUP_MODE_SUMMARIZE, "entries": float64(1)}},
+		{http.MethodGet, "/api/v1/out/keys?key=a:1", "secret", http.StatusOK, map[string]interface{}{"key": "a:1", "count": float64(2)}},
+		{http.MethodGet, "/api/v1/out/keys?key=a:2", "secret", http.StatusNotFound, map[string]interface{}{"error": "Key not found: a:2"}},
+		{http.MethodGet, "/api/v1/other/stats", "secret", http.StatusNotFound, map[string]interface{}{"error": "Unknown instance: other"}},
+		{http.MethodGet, "/api/v1/out/flush", "secret", http.StatusNotFound, nil},
+		{http.MethodGet, "/other", "secret", http.StatusNotFound, nil},
+	} {
+		status, body := adminRequest(t, server, test.method, test.path, test.token)
+		if status != test.status {
+			t.Errorf("%s %s: status %d, want %d", test.method, test.path, status, test.status)
+		}
+		for k, v := range test.want {
+			if body[k] != v {
+				t.Errorf("%s %s: %s is %v, want %v", test.method, test.path, k, body[k], v)
+			}
+		}
+	}
+	if pi.Dedup.Len() != 1 {
+		t.Fatal("read only requests removed keys")
+	}
+}
+
+func TestLocalAddress(t *testing.T) {
+	for address, want := range map[string]bool{
+		"127.0.0.1:2021": true,
+		"[::1]:2021":     true,
+		"localhost:2021": true,
+		"0.0.0.0:2021":   false,
+		"10.0.0.1:2021":  false,
+		":2021":          false,
+		"127.0.0.1":      false,
+	} {
+		if localAddress(address) != want {
+			t.Errorf("%s: local %v, want %v", address, !want, want)
+		}
+	}
+}
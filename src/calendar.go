@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	DEDUP_WINDOW_ROLLING  = "rolling"
+	DEDUP_WINDOW_CALENDAR = "calendar"
+
+	CALENDAR_BUCKET_HOUR = "hour"
+	CALENDAR_BUCKET_DAY  = "day"
+	CALENDAR_BUCKET_WEEK = "week"
+)
+
+func validCalendarBucket(bucket string) bool {
+	switch bucket {
+	case CALENDAR_BUCKET_HOUR, CALENDAR_BUCKET_DAY, CALENDAR_BUCKET_WEEK:
+		return true
+	}
+	return false
+}
+
+// calendarBucket returns the start and end of the hour, day or week (from
+// Monday) containing `t`, in the given location. Buckets follow the
+// location's daylight saving changes: an hour which repeats is two buckets,
+// and a day may last 23 or 25 hours.
+func calendarBucket(t time.Time, bucket string, loc *time.Location) (time.Time, time.Time, error) {
+	t = t.In(loc)
+	year, month, day := t.Date()
+	switch bucket {
+	case CALENDAR_BUCKET_HOUR:
+		// from the local clock, as time.Date is ambiguous in a repeated hour
+		start := t.Add(-time.Duration(t.Minute())*time.Minute -
+			time.Duration(t.Second())*time.Second -
+			time.Duration(t.Nanosecond()))
+		return start, start.Add(time.Hour), nil
+	case CALENDAR_BUCKET_DAY:
+		return startOfDay(year, month, day, loc),
+			startOfDay(year, month, day+1, loc),
+			nil
+	case CALENDAR_BUCKET_WEEK:
+		sinceMonday := (int(t.Weekday()) + 6) % 7
+		return startOfDay(year, month, day-sinceMonday, loc),
+			startOfDay(year, month, day-sinceMonday+7, loc),
+			nil
+	}
+	return time.Time{}, time.Time{}, fmt.Errorf("Unknown calendar bucket: %s", bucket)
+}
+
+// startOfDay returns when a day (which time.Date normalizes) starts in the
+// given location. That is midnight, unless a daylight saving change skips
+// it, when the day starts at the change.
+func startOfDay(year int, month time.Month, day int, loc *time.Location) time.Time {
+	noon := time.Date(year, month, day, 12, 0, 0, 0, loc)
+	year, month, day = noon.Date()
+	start := time.Date(year, month, day, 0, 0, 0, 0, loc)
+	if start.Day() != day {
+		// time.Date moved the missing midnight back into the day before;
+		// the change is at midnight by the offset in force before it
+		_, offset := start.Zone()
+		start = time.Date(year, month, day, 0, 0, 0, 0, time.FixedZone("", offset)).In(loc)
+	}
+	return start
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func loadTestLocation(t *testing.T, name string) *time.Location {
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		t.Skipf("time zone %s not available: %v", name, err)
+	}
+	return loc
+}
+
+func TestCalendarBucket(t *testing.T) {
+	newYork := loadTestLocation(t, "America/New_York")
+	london := loadTestLocation(t, "Europe/London")
+	// DST starts at midnight in Santiago, so some days start at 01:00
+	santiago := loadTestLocation(t, "America/Santiago")
+
+	at := func(loc *time.Location, value string) time.Time {
+		parsed, err := time.ParseInLocation("2006-01-02 15:04 -0700", value, loc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return parsed
+	}
+	for _, test := range []struct {
+		name   string
+		loc    *time.Location
+		t      string
+		bucket string
+		start  string
+		end    string
+	}{
+		// spring forward: 2024-03-10 02:00 EST becomes 03:00 EDT
+		{"23h day", newYork, "2024-03-10 12:00 -0400", CALENDAR_BUCKET_DAY, "2024-03-10 00:00 -0500", "2024-03-11 00:00 -0400"},
+		{"before the gap", newYork, "2024-03-10 01:59 -0500", CALENDAR_BUCKET_HOUR, "2024-03-10 01:00 -0500", "2024-03-10 03:00 -0400"},
+		{"after the gap", newYork, "2024-03-10 03:00 -0400", CALENDAR_BUCKET_HOUR, "2024-03-10 03:00 -0400", "2024-03-10 04:00 -0400"},
+		// fall back: 2024-11-03 02:00 EDT becomes 01:00 EST, so 01:xx
+		// happens twice
+		{"25h day", newYork, "2024-11-03 12:00 -0500", CALENDAR_BUCKET_DAY, "2024-11-03 00:00 -0400", "2024-11-04 00:00 -0500"},
+		{"first 01:00", newYork, "2024-11-03 01:30 -0400", CALENDAR_BUCKET_HOUR, "2024-11-03 01:00 -0400", "2024-11-03 01:00 -0500"},
+		{"second 01:00", newYork, "2024-11-03 01:30 -0500", CALENDAR_BUCKET_HOUR, "2024-11-03 01:00 -0500", "2024-11-03 02:00 -0500"},
+		// weeks from Monday, spanning a change
+		{"week of spring forward", london, "2024-03-31 23:59 +0100", CALENDAR_BUCKET_WEEK, "2024-03-25 00:00 +0000", "2024-04-01 00:00 +0100"},
+		{"week of fall back", london, "2024-10-21 00:00 +0100", CALENDAR_BUCKET_WEEK, "2024-10-21 00:00 +0100", "2024-10-28 00:00 +0000"},
+		{"Sunday", london, "2024-10-27 01:30 +0000", CALENDAR_BUCKET_WEEK, "2024-10-21 00:00 +0100", "2024-10-28 00:00 +0000"},
+		// midnight does not exist on 2024-09-08 in Santiago
+		{"day without midnight", santiago, "2024-09-08 12:00 -0300", CALENDAR_BUCKET_DAY, "2024-09-08 01:00 -0300", "2024-09-09 00:00 -0300"},
+		{"day before", santiago, "2024-09-07 23:59 -0400", CALENDAR_BUCKET_DAY, "2024-09-07 00:00 -0400", "2024-09-08 01:00 -0300"},
+		{"week without midnight", santiago, "2024-09-08 12:00 -0300", CALENDAR_BUCKET_WEEK, "2024-09-02 00:00 -0400", "2024-09-09 00:00 -0300"},
+		// the bucket is that of the location, whatever the time's own
+		{"UTC time", newYork, "2024-11-04 03:00 +0000", CALENDAR_BUCKET_DAY, "2024-11-03 00:00 -0400", "2024-11-04 00:00 -0500"},
+	} {
+		start, end, err := calendarBucket(at(test.loc, test.t), test.bucket, test.loc)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		wantStart, wantEnd := at(test.loc, test.start), at(test.loc, test.end)
+		if !start.Equal(wantStart) || !end.Equal(wantEnd) {
+			t.Errorf("%s: %s bucket %s - %s, want %s - %s", test.name, test.bucket, start, end, wantStart, wantEnd)
+		}
+		if at(test.loc, test.t).Before(start) || !at(test.loc, test.t).Before(end) {
+			t.Errorf("%s: %s not in its bucket", test.name, test.t)
+		}
+	}
+
+	if _, _, err := calendarBucket(time.Now(), "month", time.UTC); err == nil {
+		t.Fatal("no error for an unknown bucket")
+	}
+}
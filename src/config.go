@@ -3,6 +3,9 @@ package main
 import (
 	"fmt"
 	output "github.com/fluent/fluent-bit-go/output"
+	"regexp"
+	"strings"
+	"time"
 	"unsafe"
 )
 
@@ -12,58 +15,335 @@ const (
 
 type (
 	Config struct {
-		Id                   string
-		LogLevel             string
-		PostUrl              string
-		GzipBody             bool
-		MaxRecords           uint64
-		MatchMapFile         string
-		DeduplicateKeyFields []string
-		DeduplicateSize      int
-		DeduplicateTTL       uint64
-		RemoveFields         []string
-		OutputTimeKey        string
-		OutputTimeFormat     string
-		OutputTimeAsInteger  bool
-		Headers              *map[string]string
+		Id                      string
+		AdminListen             string
+		AdminToken              string `json:"-"`
+		LogLevel                string
+		PostUrl                 string
+		GzipBody                bool
+		MaxRecords              uint64
+		MetricsInterval         uint64
+		MatchMapFile            string
+		MatchMapReloadInterval  uint64
+		MatchMapReloadSignal    bool
+		MatchMapUrl             string
+		MatchMapRefreshInterval uint64
+		MatchMapCacheFile       string
+		MatchMapUnmatched       string
+		MatchMapDefaultFields   map[string]string
+		MatchMapFormat          string
+		MatchMapCsvKeyColumn    string
+		MatchMapCsvValueColumns []string
+		DeduplicateKeyMode      string
+		DeduplicateKeyFields    []string
+		DeduplicateIgnoreFields []string
+		DeduplicateSize         int
+		DeduplicateTTL          uint64
+		MaxRecordAge            uint64
+		MaxFutureSkew           uint64
+		LateRecordPolicy        string
+		DedupMode               string
+		DedupWindow             string
+		DedupCalendarBucket     string
+		DedupCalendarTimezone   string
+		DedupCalendarLocation   *time.Location `json:"-"`
+		DedupMissingKey         string
+		DedupKeyPlaceholder     *string
+		DedupBackend            string
+		ProbabilisticWindows    uint64
+		ProbabilisticMemoryMB   uint64
+		ProbabilisticFPRate     float64
+		RedisAddress            string
+		RedisPassword           string `json:"-"`
+		RedisDB                 uint64
+		RedisKeyPrefix          string
+		RedisTimeoutMs          uint64
+		KeepFields              []string
+		RemoveFields            []string
+		RenameFields            []KeyValue
+		MoveFields              []KeyValue
+		HashFields              []string
+		HashSecret              string `json:"-"`
+		HashLength              int
+		MaskFields              []string
+		RedactFields            []string
+		RedactPattern           string
+		RedactRegexp            *regexp.Regexp `json:"-"`
+		RedactReplacement       string
+		TagKey                  string
+		TimeSourceKey           string
+		TimeSourceFormat        string
+		TimeSourceLayout        string `json:"-"`
+		OutputTimeKey           string
+		OutputTimeFormat        string
+		OutputTimeAsInteger     bool
+		OutputTimeZone          string
+		OutputTimeLocation      *time.Location `json:"-"`
+		OutputTimeFields        []KeyValue
+		OutputOriginalTimeKey   string
+		OutputProcessingTimeKey string
+		OutputSchemaFile        string
+		OutputRejectUrl         string
+		OutputRejectErrorKey    string
+		Headers                 *map[string]string
 	}
 )
 
 func configFromFLB(plugin unsafe.Pointer) (*Config, error) {
-
-	flbCK := func(k string) string {
+	return configFromKeys(func(k string) string {
 		return output.FLBPluginConfigKey(plugin, k)
+	})
+}
+
+// configFromKeys reads and checks the config, where `flbCK` returns the
+// value of a key, or "" if it is unset
+func configFromKeys(flbCK func(k string) string) (*Config, error) {
+
+	admin_listen := strings.TrimSpace(flbCK("admin_listen"))
+	if len(admin_listen) > 0 && !localAddress(admin_listen) {
+		return nil, fmt.Errorf("Invalid `admin_listen` (must be a loopback host:port): %+v", admin_listen)
 	}
 
+	admin_token := flbCK("admin_token")
+
+	deduplicate_ignore_fields := []string{}
+	csvAppend(flbCK("deduplicate_ignore_fields"), &deduplicate_ignore_fields)
+
 	deduplicate_key_fields := []string{}
 	csvAppend(flbCK("deduplicate_key_fields"), &deduplicate_key_fields)
 
+	deduplicate_key_mode := strings.ToLower(strings.TrimSpace(flbCK("deduplicate_key_mode")))
+	switch deduplicate_key_mode {
+	case "":
+		deduplicate_key_mode = DEDUP_KEY_MODE_FIELDS
+	case DEDUP_KEY_MODE_FIELDS, DEDUP_KEY_MODE_CONTENT:
+	default:
+		return nil, fmt.Errorf("Invalid `deduplicate_key_mode`: %+v", deduplicate_key_mode)
+	}
+	if deduplicate_key_mode == DEDUP_KEY_MODE_FIELDS && len(deduplicate_key_fields) == 0 {
+		return nil, fmt.Errorf("Missing `deduplicate_key_fields` (required unless `deduplicate_key_mode` is `%s`)", DEDUP_KEY_MODE_CONTENT)
+	}
+
 	deduplicate_size := int(parseInteger(flbCK("deduplicate_size"), 1024))
 
 	deduplicate_ttl := parseInteger(flbCK("deduplicate_ttl"), 86400*7)
 
+	dedup_backend := strings.ToLower(strings.TrimSpace(flbCK("dedup_backend")))
+	if len(dedup_backend) == 0 {
+		dedup_backend = DEDUP_BACKEND_MEMORY
+	}
+	if !validDedupBackend(dedup_backend) {
+		return nil, fmt.Errorf("Invalid `dedup_backend`: %+v", dedup_backend)
+	}
+
+	dedup_calendar_bucket := strings.ToLower(strings.TrimSpace(flbCK("dedup_calendar_bucket")))
+	if len(dedup_calendar_bucket) == 0 {
+		dedup_calendar_bucket = CALENDAR_BUCKET_DAY
+	}
+	if !validCalendarBucket(dedup_calendar_bucket) {
+		return nil, fmt.Errorf("Invalid `dedup_calendar_bucket`: %+v", dedup_calendar_bucket)
+	}
+
+	dedup_calendar_timezone := strings.TrimSpace(flbCK("dedup_calendar_timezone"))
+	if len(dedup_calendar_timezone) == 0 {
+		dedup_calendar_timezone = "UTC"
+	}
+	dedup_calendar_location, tzErr := time.LoadLocation(dedup_calendar_timezone)
+	if tzErr != nil {
+		return nil, fmt.Errorf("Invalid `dedup_calendar_timezone`: %+v (%v)", dedup_calendar_timezone, tzErr)
+	}
+
+	dedup_missing_key := strings.ToLower(strings.TrimSpace(flbCK("dedup_missing_key")))
+	switch dedup_missing_key {
+	case "":
+		dedup_missing_key = DEDUP_MISSING_KEY_SKIP
+	case DEDUP_MISSING_KEY_SKIP, DEDUP_MISSING_KEY_PASS, DEDUP_MISSING_KEY_PLACEHOLDER:
+	default:
+		return nil, fmt.Errorf("Invalid `dedup_missing_key`: %+v", dedup_missing_key)
+	}
+
+	var dedup_missing_key_placeholder *string
+	if dedup_missing_key == DEDUP_MISSING_KEY_PLACEHOLDER {
+		placeholder := flbCK("dedup_missing_key_placeholder")
+		if len(placeholder) == 0 {
+			// an empty placeholder would make keys with a missing field
+			// collide with those where the field is ""
+			return nil, fmt.Errorf("Missing `dedup_missing_key_placeholder` (required by `dedup_missing_key` `%s`)", DEDUP_MISSING_KEY_PLACEHOLDER)
+		}
+		dedup_missing_key_placeholder = &placeholder
+	}
+
+	dedup_mode := strings.ToLower(strings.TrimSpace(flbCK("dedup_mode")))
+	if len(dedup_mode) == 0 {
+		dedup_mode = DEDUP_MODE_FIRST
+	}
+	if !validDedupMode(dedup_mode) {
+		return nil, fmt.Errorf("Invalid `dedup_mode`: %+v", dedup_mode)
+	}
+
+	dedup_window := strings.ToLower(strings.TrimSpace(flbCK("dedup_window")))
+	switch dedup_window {
+	case "":
+		dedup_window = DEDUP_WINDOW_ROLLING
+	case DEDUP_WINDOW_ROLLING, DEDUP_WINDOW_CALENDAR:
+	default:
+		return nil, fmt.Errorf("Invalid `dedup_window`: %+v", dedup_window)
+	}
+
 	gzip_body := parseBool(flbCK("gzip_body"), true)
 
+	hash_fields := []string{}
+	csvAppend(flbCK("hash_fields"), &hash_fields)
+
+	hash_length := int(parseInteger(flbCK("hash_length"), 0))
+	if hash_length > 64 {
+		return nil, fmt.Errorf("Invalid `hash_length` (at most 64): %+v", hash_length)
+	}
+
+	hash_secret := flbCK("hash_secret")
+	if len(hash_fields) > 0 && len(hash_secret) == 0 {
+		return nil, fmt.Errorf("Missing `hash_secret` (required by `hash_fields`)")
+	}
+
 	id := flbCK("id")
 	if len(id) < 1 {
 		return nil, fmt.Errorf("[%s] Missing `Id` in [OUTPUT] config", PLUGIN_NAME)
 	}
 
+	keep_fields := []string{}
+	csvAppend(flbCK("keep_fields"), &keep_fields)
+
+	late_record_policy := strings.ToLower(strings.TrimSpace(flbCK("late_record_policy")))
+	if len(late_record_policy) == 0 {
+		late_record_policy = LATE_RECORD_DROP
+	}
+	if !validLateRecordPolicy(late_record_policy) {
+		return nil, fmt.Errorf("Invalid `late_record_policy`: %+v", late_record_policy)
+	}
+
 	log := flbCK("log")
 	if len(log) < 4 {
 		log = "info"
 	}
 
+	match_map_cache_file := flbCK("match_map_cache_file")
+
+	match_map_default_fields, mmdfErr := kvCsvParse(flbCK("match_map_default_fields"))
+	if mmdfErr != nil {
+		return nil, fmt.Errorf("Invalid `match_map_default_fields`: %v", mmdfErr)
+	}
+
+	match_map_csv_key_column := strings.TrimSpace(flbCK("match_map_csv_key_column"))
+
+	match_map_csv_value_columns := []string{}
+	csvAppend(flbCK("match_map_csv_value_columns"), &match_map_csv_value_columns)
+
 	match_map_file := flbCK("match_map_file")
 
+	match_map_refresh_interval := parseInteger(flbCK("match_map_refresh_interval"), 300)
+
+	match_map_reload_interval := parseInteger(flbCK("match_map_reload_interval"), 10)
+
+	match_map_reload_signal := parseBool(flbCK("match_map_reload_signal"), false)
+
+	match_map_url := flbCK("match_map_url")
+	if len(match_map_url) > 0 {
+		if !meaningfulUrl(match_map_url) {
+			return nil, fmt.Errorf("Invalid `match_map_url`: %+v", match_map_url)
+		}
+		if len(match_map_file) > 0 {
+			return nil, fmt.Errorf("Only one of `match_map_file` and `match_map_url` may be set")
+		}
+	}
+
+	// the format follows the file or URL extension unless set
+	match_map_format := strings.ToLower(strings.TrimSpace(flbCK("match_map_format")))
+	if len(match_map_format) == 0 {
+		match_map_format = matchMapFormatFor(match_map_file + match_map_url)
+	}
+	if !validMatchMapFormat(match_map_format) {
+		return nil, fmt.Errorf("Invalid `match_map_format`: %+v", match_map_format)
+	}
+
+	// without a match map, records pass through unless otherwise configured
+	match_map_unmatched := strings.ToLower(strings.TrimSpace(flbCK("match_map_unmatched")))
+	switch match_map_unmatched {
+	case "":
+		match_map_unmatched = MATCH_MAP_UNMATCHED_DROP
+		if len(match_map_file) == 0 && len(match_map_url) == 0 {
+			match_map_unmatched = MATCH_MAP_UNMATCHED_PASS
+		}
+	case MATCH_MAP_UNMATCHED_DROP:
+		if len(match_map_file) == 0 && len(match_map_url) == 0 {
+			return nil, fmt.Errorf("`match_map_unmatched` `%s` requires `match_map_file` or `match_map_url`", MATCH_MAP_UNMATCHED_DROP)
+		}
+	case MATCH_MAP_UNMATCHED_PASS:
+	case MATCH_MAP_UNMATCHED_DEFAULT:
+		if len(match_map_default_fields) == 0 {
+			return nil, fmt.Errorf("`match_map_unmatched` `%s` requires `match_map_default_fields`", MATCH_MAP_UNMATCHED_DEFAULT)
+		}
+	default:
+		return nil, fmt.Errorf("Invalid `match_map_unmatched`: %+v", match_map_unmatched)
+	}
+
+	mask_fields := []string{}
+	csvAppend(flbCK("mask_fields"), &mask_fields)
+
+	move_fields, mfErr := kvCsvPairs(flbCK("move_fields"))
+	if mfErr != nil {
+		return nil, fmt.Errorf("Invalid `move_fields`: %v", mfErr)
+	}
+
+	// records older than the dedup TTL could not be deduplicated anyway
+	max_record_age := parseInteger(flbCK("max_record_age"), deduplicate_ttl)
+
+	max_future_skew := parseInteger(flbCK("max_future_skew"), 3600)
+
 	max_records := parseInteger(flbCK("max_records"), 20)
 
+	metrics_interval := parseInteger(flbCK("metrics_interval"), 60)
+
+	output_original_time_key := strings.TrimSpace(flbCK("output_original_time_key"))
+
+	output_processing_time_key := strings.TrimSpace(flbCK("output_processing_time_key"))
+
+	output_reject_error_key := strings.TrimSpace(flbCK("output_reject_error_key"))
+	if len(output_reject_error_key) == 0 {
+		output_reject_error_key = "_schema_error"
+	}
+
+	output_reject_url := flbCK("output_reject_url")
+	if len(output_reject_url) > 0 && !meaningfulUrl(output_reject_url) {
+		return nil, fmt.Errorf("Invalid `output_reject_url`: %+v", output_reject_url)
+	}
+
+	output_schema_file := flbCK("output_schema_file")
+	if len(output_reject_url) > 0 && len(output_schema_file) == 0 {
+		return nil, fmt.Errorf("`output_reject_url` requires `output_schema_file`")
+	}
+
+	// `key:format` pairs, e.g. "time:%Y-%m-%dT%H:%M:%S.%LZ,time_ms:%Q"
+	output_time_fields, otfErr := kvCsvPairs(flbCK("output_time_fields"))
+	if otfErr != nil {
+		return nil, fmt.Errorf("Invalid `output_time_fields`: %v", otfErr)
+	}
+
 	output_time_format := flbCK("output_time_format")
 
 	output_time_integer := parseBool(flbCK("output_time_integer"), false)
 
 	output_time_key := flbCK("output_time_key")
 
+	// the process's local time zone unless set
+	output_time_zone := strings.TrimSpace(flbCK("output_time_zone"))
+	output_time_location := time.Local
+	if len(output_time_zone) > 0 {
+		var tzErr error
+		if output_time_location, tzErr = time.LoadLocation(output_time_zone); tzErr != nil {
+			return nil, fmt.Errorf("Invalid `output_time_zone`: %+v (%v)", output_time_zone, tzErr)
+		}
+	}
+
 	post_headers := &map[string]string{"Content-Type": "application/octets"}
 
 	post_url := flbCK("post_url")
@@ -71,23 +351,159 @@ func configFromFLB(plugin unsafe.Pointer) (*Config, error) {
 		return nil, fmt.Errorf("Invalid `post_url`: %+v", post_url)
 	}
 
+	probabilistic_false_positive_rate := parseFloat(flbCK("probabilistic_false_positive_rate"), 0.001)
+
+	probabilistic_memory_mb := parseInteger(flbCK("probabilistic_memory_mb"), 64)
+
+	probabilistic_windows := parseInteger(flbCK("probabilistic_windows"), 7)
+
+	if dedup_backend == DEDUP_BACKEND_PROBABILISTIC && dedup_mode != DEDUP_MODE_FIRST {
+		return nil, fmt.Errorf("`dedup_backend` `%s` only supports `dedup_mode` `%s`", DEDUP_BACKEND_PROBABILISTIC, DEDUP_MODE_FIRST)
+	}
+
+	redis_address := flbCK("redis_address")
+	if dedup_backend == DEDUP_BACKEND_REDIS && len(redis_address) == 0 {
+		return nil, fmt.Errorf("Missing `redis_address` (required by `dedup_backend` `%s`)", DEDUP_BACKEND_REDIS)
+	}
+
+	redis_db := parseInteger(flbCK("redis_db"), 0)
+
+	redis_key_prefix := flbCK("redis_key_prefix")
+	if len(redis_key_prefix) == 0 {
+		redis_key_prefix = "flb-dedup:"
+	}
+
+	redis_password := flbCK("redis_password")
+
+	redis_timeout_ms := parseInteger(flbCK("redis_timeout_ms"), 500)
+
+	redact_fields := []string{}
+	csvAppend(flbCK("redact_fields"), &redact_fields)
+
+	redact_pattern := flbCK("redact_pattern")
+	if len(redact_fields) > 0 && len(redact_pattern) == 0 {
+		return nil, fmt.Errorf("Missing `redact_pattern` (required by `redact_fields`)")
+	}
+	var redact_regexp *regexp.Regexp
+	if len(redact_pattern) > 0 {
+		var reErr error
+		if redact_regexp, reErr = regexp.Compile(redact_pattern); reErr != nil {
+			return nil, fmt.Errorf("Invalid `redact_pattern`: %+v (%v)", redact_pattern, reErr)
+		}
+	}
+
+	redact_replacement := flbCK("redact_replacement")
+	if len(redact_replacement) == 0 {
+		redact_replacement = "REDACTED"
+	}
+
+	// shared dedup keys hold real values, so are stored as an HMAC, which
+	// without a secret could be reversed by hashing every likely value
+	pseudonymized := len(hash_fields) > 0 || len(mask_fields) > 0 || len(redact_fields) > 0
+	if dedup_backend == DEDUP_BACKEND_REDIS && pseudonymized && len(hash_secret) == 0 {
+		return nil, fmt.Errorf("Missing `hash_secret` (required by `dedup_backend` `%s` with `hash_fields`, `mask_fields` or `redact_fields`)", DEDUP_BACKEND_REDIS)
+	}
+
 	remove_fields := []string{}
 	csvAppend(flbCK("remove_fields"), &remove_fields)
 
+	rename_fields, rfErr := kvCsvPairs(flbCK("rename_fields"))
+	if rfErr != nil {
+		return nil, fmt.Errorf("Invalid `rename_fields`: %v", rfErr)
+	}
+
+	tag_key := strings.TrimSpace(flbCK("tag_key"))
+
+	time_source_key := strings.TrimSpace(flbCK("time_source_key"))
+
+	time_source_format := strings.TrimSpace(flbCK("time_source_format"))
+	if len(time_source_format) == 0 {
+		time_source_format = TIME_SOURCE_RFC3339
+	}
+	time_source_layout, tslErr := timeSourceLayout(time_source_format)
+	if tslErr != nil {
+		return nil, fmt.Errorf("Invalid `time_source_format`: %+v (%v)", time_source_format, tslErr)
+	}
+
 	return &Config{
-		Id:                   id,
-		LogLevel:             log,
-		PostUrl:              post_url,
-		GzipBody:             gzip_body,
-		MaxRecords:           max_records,
-		MatchMapFile:         match_map_file,
-		DeduplicateKeyFields: deduplicate_key_fields,
-		DeduplicateSize:      deduplicate_size,
-		DeduplicateTTL:       deduplicate_ttl,
-		RemoveFields:         remove_fields,
-		OutputTimeKey:        output_time_key,
-		OutputTimeFormat:     output_time_format,
-		OutputTimeAsInteger:  output_time_integer,
-		Headers:              post_headers,
+		Id:                      id,
+		AdminListen:             admin_listen,
+		AdminToken:              admin_token,
+		LogLevel:                log,
+		PostUrl:                 post_url,
+		GzipBody:                gzip_body,
+		MaxRecords:              max_records,
+		MetricsInterval:         metrics_interval,
+		MatchMapFile:            match_map_file,
+		MatchMapReloadInterval:  match_map_reload_interval,
+		MatchMapReloadSignal:    match_map_reload_signal,
+		MatchMapUrl:             match_map_url,
+		MatchMapRefreshInterval: match_map_refresh_interval,
+		MatchMapCacheFile:       match_map_cache_file,
+		MatchMapUnmatched:       match_map_unmatched,
+		MatchMapDefaultFields:   match_map_default_fields,
+		MatchMapFormat:          match_map_format,
+		MatchMapCsvKeyColumn:    match_map_csv_key_column,
+		MatchMapCsvValueColumns: match_map_csv_value_columns,
+		DeduplicateKeyMode:      deduplicate_key_mode,
+		DeduplicateKeyFields:    deduplicate_key_fields,
+		DeduplicateIgnoreFields: deduplicate_ignore_fields,
+		DeduplicateSize:         deduplicate_size,
+		DeduplicateTTL:          deduplicate_ttl,
+		MaxRecordAge:            max_record_age,
+		MaxFutureSkew:           max_future_skew,
+		LateRecordPolicy:        late_record_policy,
+		DedupMode:               dedup_mode,
+		DedupBackend:            dedup_backend,
+		DedupWindow:             dedup_window,
+		DedupCalendarBucket:     dedup_calendar_bucket,
+		DedupCalendarTimezone:   dedup_calendar_timezone,
+		DedupCalendarLocation:   dedup_calendar_location,
+		DedupMissingKey:         dedup_missing_key,
+		DedupKeyPlaceholder:     dedup_missing_key_placeholder,
+		ProbabilisticWindows:    probabilistic_windows,
+		ProbabilisticMemoryMB:   probabilistic_memory_mb,
+		ProbabilisticFPRate:     probabilistic_false_positive_rate,
+		RedisAddress:            redis_address,
+		RedisPassword:           redis_password,
+		RedisDB:                 redis_db,
+		RedisKeyPrefix:          redis_key_prefix,
+		RedisTimeoutMs:          redis_timeout_ms,
+		KeepFields:              keep_fields,
+		RemoveFields:            remove_fields,
+		RenameFields:            rename_fields,
+		MoveFields:              move_fields,
+		HashFields:              hash_fields,
+		HashSecret:              hash_secret,
+		HashLength:              hash_length,
+		MaskFields:              mask_fields,
+		RedactFields:            redact_fields,
+		RedactPattern:           redact_pattern,
+		RedactRegexp:            redact_regexp,
+		RedactReplacement:       redact_replacement,
+		TagKey:                  tag_key,
+		TimeSourceKey:           time_source_key,
+		TimeSourceFormat:        time_source_format,
+		TimeSourceLayout:        time_source_layout,
+		OutputTimeKey:           output_time_key,
+		OutputTimeFormat:        output_time_format,
+		OutputTimeAsInteger:     output_time_integer,
+		OutputTimeZone:          output_time_zone,
+		OutputTimeLocation:      output_time_location,
+		OutputTimeFields:        output_time_fields,
+		OutputOriginalTimeKey:   output_original_time_key,
+		OutputProcessingTimeKey: output_processing_time_key,
+		OutputSchemaFile:        output_schema_file,
+		OutputRejectUrl:         output_reject_url,
+		OutputRejectErrorKey:    output_reject_error_key,
+		Headers:                 post_headers,
 	}, nil
 }
+
+func (conf *Config) matchMapFormat() *MatchMapFormat {
+	return &MatchMapFormat{
+		Format:          conf.MatchMapFormat,
+		CsvKeyColumn:    conf.MatchMapCsvKeyColumn,
+		CsvValueColumns: conf.MatchMapCsvValueColumns,
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// testConfig reads a config from the minimal valid one, with `keys` added
+func testConfig(keys map[string]string) (*Config, error) {
+	all := map[string]string{
+		"id":                     "test",
+		"post_url":               "http://127.0.0.1:9/",
+		"deduplicate_key_fields": "id",
+	}
+	for k, v := range keys {
+		all[k] = v
+	}
+	return configFromKeys(func(k string) string { return all[k] })
+}
+
+// checkConfigErrors checks that each config fails to load with the given
+// error, or loads if none is given
+func checkConfigErrors(t *testing.T, tests []configErrorTest) {
+	for _, test := range tests {
+		_, err := testConfig(test.keys)
+		if len(test.want) == 0 {
+			if err != nil {
+				t.Errorf("%v: %v", test.keys, err)
+			}
+		} else if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%v: got error %v, want %q", test.keys, err, test.want)
+		}
+	}
+}
+
+type configErrorTest struct {
+	keys map[string]string
+	want string
+}
+
+func TestConfigMissingKey(t *testing.T) {
+	checkConfigErrors(t, []configErrorTest{
+		{map[string]string{}, ``},
+		{map[string]string{"dedup_missing_key": "pass"}, ``},
+		{map[string]string{"dedup_missing_key": "drop"}, "Invalid `dedup_missing_key`"},
+		{map[string]string{"dedup_missing_key": "placeholder", "dedup_missing_key_placeholder": "-"}, ``},
+		{map[string]string{"dedup_missing_key": "placeholder"}, "Missing `dedup_missing_key_placeholder`"},
+	})
+
+	conf, _ := testConfig(map[string]string{})
+	if conf.DedupMissingKey != DEDUP_MISSING_KEY_SKIP || conf.DedupKeyPlaceholder != nil {
+		t.Fatalf("default policy %s, placeholder %v", conf.DedupMissingKey, conf.DedupKeyPlaceholder)
+	}
+	conf, _ = testConfig(map[string]string{"dedup_missing_key": "placeholder", "dedup_missing_key_placeholder": " "})
+	if conf.DedupKeyPlaceholder == nil || *conf.DedupKeyPlaceholder != " " {
+		t.Fatalf("placeholder %v", conf.DedupKeyPlaceholder)
+	}
+}
+
+func TestConfigFieldPairs(t *testing.T) {
+	conf, err := testConfig(map[string]string{
+		"rename_fields":      `rcc:a3, "a:b":c`,
+		"output_time_fields": `time:%H:%M:%S,date:"%d %b, %Y"`,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(conf.RenameFields) != 2 || conf.RenameFields[1] != (KeyValue{"a:b", "c"}) {
+		t.Fatalf("rename_fields %v", conf.RenameFields)
+	}
+	if len(conf.OutputTimeFields) != 2 {
+		t.Fatalf("output_time_fields %v", conf.OutputTimeFields)
+	}
+	checkConfigErrors(t, []configErrorTest{
+		{map[string]string{"move_fields": `a:"b`}, "Invalid `move_fields`: Unterminated quote"},
+		{map[string]string{"rename_fields": `a`}, "Invalid `rename_fields`: Expected `key:value`"},
+	})
+}
+
+func TestConfigPseudonymizedRedis(t *testing.T) {
+	redis := map[string]string{"dedup_backend": "redis", "redis_address": "127.0.0.1:6379"}
+	with := func(keys map[string]string) map[string]string {
+		all := map[string]string{}
+		for _, m := range []map[string]string{redis, keys} {
+			for k, v := range m {
+				all[k] = v
+			}
+		}
+		return all
+	}
+	checkConfigErrors(t, []configErrorTest{
+		{redis, ``},
+		{with(map[string]string{"hash_fields": "user"}), "Missing `hash_secret` (required by `hash_fields`)"},
+		{with(map[string]string{"mask_fields": "rip"}), "Missing `hash_secret` (required by `dedup_backend` `redis`"},
+		{with(map[string]string{"redact_fields": "msg", "redact_pattern": "x"}), "Missing `hash_secret` (required by `dedup_backend` `redis`"},
+		{with(map[string]string{"mask_fields": "rip", "hash_secret": "s"}), ``},
+		// only keys shared through redis need the secret
+		{map[string]string{"mask_fields": "rip"}, ``},
+	})
+}
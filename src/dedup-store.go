@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	DEDUP_BACKEND_MEMORY = "memory"
+	DEDUP_BACKEND_REDIS  = "redis"
+
+	DEDUP_BACKEND_PROBABILISTIC = "probabilistic"
+)
+
+type (
+	// DedupStore holds deduplication state for a Deduplicator. Expired and
+	// evicted entries must be reported to the RemovalCallback given to the
+	// store's constructor. Purge only clears local state (e.g. at shutdown),
+	// whereas Remove and RemovePrefix also clear any shared state so that
+	// the removed keys will be sent again.
+	DedupStore interface {
+		Get(key string, now time.Time) (interface{}, bool)
+		Peek(key string, now time.Time) (interface{}, time.Time, bool)
+		Add(key string, value interface{}, expires time.Time) bool
+		Remove(key string) bool
+		RemovePrefix(prefix string) int
+		RemoveExpired(now time.Time) int
+		Purge() int
+		Len() int
+	}
+
+	// SharedDedupStore is implemented by stores which share state with other
+	// Fluent Bit instances. Claim is called once per flush with every key the
+	// local store would send, and returns which of them no other instance
+	// has already sent.
+	SharedDedupStore interface {
+		DedupStore
+		Claim(claims []DedupClaim) []bool
+		PeekShared(key string, now time.Time) (time.Time, bool, error)
+	}
+
+	// DedupClaim is a key to claim for `TTL`. Without a Value, the claim
+	// succeeds if no other instance holds the key. With a Value (a record
+	// hash in `on_change` mode) it succeeds unless the key already holds
+	// that same value, so that a record which changes back is sent again.
+	DedupClaim struct {
+		Key   string
+		Value string
+		TTL   time.Duration
+	}
+)
+
+func validDedupBackend(backend string) bool {
+	switch backend {
+	case DEDUP_BACKEND_MEMORY, DEDUP_BACKEND_REDIS, DEDUP_BACKEND_PROBABILISTIC:
+		return true
+	}
+	return false
+}
+
+func newDedupStore(
+	conf *Config,
+	log *SimpleLogger,
+	metrics *Metrics,
+	onRemoved RemovalCallback,
+) (DedupStore, error) {
+	if conf.DedupBackend == DEDUP_BACKEND_PROBABILISTIC {
+		return newProbabilisticStore(
+			time.Duration(conf.DeduplicateTTL)*time.Second,
+			conf.ProbabilisticWindows,
+			conf.ProbabilisticMemoryMB*1024*1024,
+			conf.ProbabilisticFPRate,
+			metrics,
+		)
+	}
+	local, err := newExpiringCache(conf.DeduplicateSize, onRemoved)
+	if err != nil {
+		return nil, err
+	}
+	switch conf.DedupBackend {
+	case DEDUP_BACKEND_MEMORY:
+		return local, nil
+	case DEDUP_BACKEND_REDIS:
+		// keys hold the real values of fields which are pseudonymized
+		// before sending, so must not reach the backend either (config
+		// requires `hash_secret` for this)
+		var keySecret []byte
+		if len(conf.HashFields) > 0 || len(conf.MaskFields) > 0 || len(conf.RedactFields) > 0 {
+			keySecret = []byte(conf.HashSecret)
+		}
+		return newRedisStore(
+			local,
+			newRespClient(
+				conf.RedisAddress,
+				conf.RedisPassword,
+				conf.RedisDB,
+				time.Duration(conf.RedisTimeoutMs)*time.Millisecond,
+			),
+			fmt.Sprintf("%s%s:", conf.RedisKeyPrefix, conf.Id),
+			keySecret,
+			log,
+			metrics,
+		), nil
+	}
+	return nil, fmt.Errorf("Unknown deduplication backend: %s", conf.DedupBackend)
+}
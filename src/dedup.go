@@ -0,0 +1,377 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DEDUP_MODE_FIRST     = "first"
+	DEDUP_MODE_ON_CHANGE = "on_change"
+	DEDUP_MODE_SUMMARIZE = "summarize"
+
+	DEDUP_KEY_MODE_FIELDS  = "fields"
+	DEDUP_KEY_MODE_CONTENT = "content"
+
+	DEDUP_MISSING_KEY_SKIP        = "skip"
+	DEDUP_MISSING_KEY_PASS        = "pass"
+	DEDUP_MISSING_KEY_PLACEHOLDER = "placeholder"
+
+	MATCH_MAP_DEDUP_PREFIX = "_dedup_"
+	MATCH_MAP_DEDUP_TTL    = "_dedup_ttl"
+	MATCH_MAP_DEDUP_KEYS   = "_dedup_keys"
+	MATCH_MAP_DEDUP_SKIP   = "_dedup_skip"
+)
+
+const (
+	DedupSend DedupDecision = iota
+	DedupResend
+	DedupDuplicate
+	DedupHold
+)
+
+type (
+	DedupDecision int
+
+	DedupEntry struct {
+		FirstSeen time.Time
+		LastSeen  time.Time
+		Hash      string
+		Count     uint64
+		// Record is the first record of a `summarize` window, and Original
+		// its Fluent Bit timestamp
+		Record   StringifiedRecordType
+		Original time.Time
+		// Suppressed is set when another instance claimed the window, so
+		// that only one instance sends its summary
+		Suppressed bool
+	}
+
+	// DedupCandidate is a record to deduplicate: its key, its event and
+	// Fluent Bit timestamps, and how long the key lasts. One which passes
+	// local deduplication is sent unless a shared store reports it as
+	// already sent elsewhere.
+	DedupCandidate struct {
+		Key       string
+		Record    StringifiedRecordType
+		Timestamp time.Time
+		Original  time.Time
+		// Seen is when the key was seen, which its TTL runs from
+		Seen time.Time
+		TTL  time.Duration
+		// Hold is set for a `summarize` window, which is claimed when it
+		// opens rather than sent
+		Hold bool
+	}
+
+	// DedupOverrides are read from reserved `_dedup_*` attributes of a match
+	// map entry, and replace the instance defaults for matching records
+	DedupOverrides struct {
+		TTL       *time.Duration
+		KeyFields []string
+		Skip      bool
+	}
+
+	// Deduplicator applies the configured `dedup_mode` on top of a
+	// DedupStore. All store access goes through it, so that removal
+	// callbacks (which may emit summaries) never race with Check.
+	Deduplicator struct {
+		lock      sync.Mutex
+		mode      string
+		store     DedupStore
+		onRemoved RemovalCallback
+		onSummary func(entry *DedupEntry)
+		// discarding is set while keys are removed through the admin API,
+		// which drops `summarize` windows rather than closing them
+		discarding bool
+	}
+)
+
+func (d DedupDecision) String() string {
+	switch d {
+	case DedupSend:
+		return "send"
+	case DedupResend:
+		return "resend"
+	case DedupDuplicate:
+		return "duplicate"
+	case DedupHold:
+		return "hold"
+	}
+	return "unknown"
+}
+
+func validDedupMode(mode string) bool {
+	switch mode {
+	case DEDUP_MODE_FIRST, DEDUP_MODE_ON_CHANGE, DEDUP_MODE_SUMMARIZE:
+		return true
+	}
+	return false
+}
+
+func newDeduplicator(
+	mode string,
+	newStore func(onRemoved RemovalCallback) (DedupStore, error),
+	onRemoved RemovalCallback,
+	onSummary func(entry *DedupEntry),
+) (*Deduplicator, error) {
+	if !validDedupMode(mode) {
+		return nil, fmt.Errorf("Unknown deduplication mode: %s", mode)
+	}
+	d := &Deduplicator{
+		mode:      mode,
+		onRemoved: onRemoved,
+		onSummary: onSummary,
+	}
+	store, err := newStore(d.removed)
+	if err != nil {
+		return nil, err
+	}
+	d.store = store
+	return d, nil
+}
+
+// removed is called by the store with d.lock held
+func (d *Deduplicator) removed(key string, value interface{}, reason RemovalReason) {
+	if d.onRemoved != nil {
+		d.onRemoved(key, value, reason)
+	}
+	if d.mode == DEDUP_MODE_SUMMARIZE && d.onSummary != nil && !d.discarding {
+		d.onSummary(value.(*DedupEntry))
+	}
+}
+
+// Check records a sighting of a candidate's key, and decides whether its
+// record should be sent now. Keys are remembered for the candidate's TTL
+// from when it was seen. In `summarize` mode nothing is sent now; the first
+// record of each window is held, and passed to onSummary when the window
+// closes. An error (from a record which cannot be hashed) leaves the store
+// unchanged.
+func (d *Deduplicator) Check(candidate *DedupCandidate, now time.Time) (DedupDecision, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	key, timestamp := candidate.Key, candidate.Timestamp
+	expires := candidate.Seen.Add(candidate.TTL)
+
+	switch d.mode {
+	case DEDUP_MODE_ON_CHANGE:
+		hash, err := hashRecord(candidate.Record)
+		if err != nil {
+			return DedupSend, err
+		}
+		existing, found := d.store.Get(key, now)
+		if found && existing.(*DedupEntry).Hash == hash {
+			return DedupDuplicate, nil
+		}
+		d.store.Add(key, &DedupEntry{
+			FirstSeen: timestamp,
+			LastSeen:  timestamp,
+			Hash:      hash,
+			Count:     1,
+		}, expires)
+		if found {
+			return DedupResend, nil
+		}
+		return DedupSend, nil
+
+	case DEDUP_MODE_SUMMARIZE:
+		existing, found := d.store.Get(key, now)
+		if found {
+			entry := existing.(*DedupEntry)
+			entry.Count++
+			if timestamp.After(entry.LastSeen) {
+				entry.LastSeen = timestamp
+			}
+			return DedupDuplicate, nil
+		}
+		d.store.Add(key, &DedupEntry{
+			FirstSeen: timestamp,
+			LastSeen:  timestamp,
+			Original:  candidate.Original,
+			Count:     1,
+			Record:    candidate.Record,
+		}, expires)
+		return DedupHold, nil
+
+	default:
+		if _, found := d.store.Get(key, now); found {
+			return DedupDuplicate, nil
+		}
+		d.store.Add(key, &DedupEntry{
+			FirstSeen: timestamp,
+			LastSeen:  timestamp,
+			Count:     1,
+		}, expires)
+		return DedupSend, nil
+	}
+}
+
+// Expire closes every window which has ended by `now`
+func (d *Deduplicator) Expire(now time.Time) int {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.store.RemoveExpired(now)
+}
+
+// Flush closes every window, e.g. so summaries are sent at shutdown
+func (d *Deduplicator) Flush() int {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.store.Purge()
+}
+
+// Lookup returns the entry and expiry for a key, if it is live
+func (d *Deduplicator) Lookup(key string, now time.Time) (*DedupEntry, time.Time, bool) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	value, expires, found := d.store.Peek(key, now)
+	if !found {
+		return nil, expires, false
+	}
+	return value.(*DedupEntry), expires, true
+}
+
+// LookupShared returns when a key expires in any shared store, for keys
+// which other instances hold but this one does not
+func (d *Deduplicator) LookupShared(key string, now time.Time) (time.Time, bool, error) {
+	shared, isShared := d.store.(SharedDedupStore)
+	if !isShared {
+		return time.Time{}, false, nil
+	}
+	return shared.PeekShared(key, now)
+}
+
+// Suppress marks the open `summarize` window for a key as claimed by
+// another instance, so that no summary is sent for it here
+func (d *Deduplicator) Suppress(key string, now time.Time) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if value, _, found := d.store.Peek(key, now); found {
+		value.(*DedupEntry).Suppressed = true
+	}
+}
+
+// Remove forgets a key, so that its next record is sent. Like RemovePrefix,
+// it drops an open `summarize` window without sending its summary.
+func (d *Deduplicator) Remove(key string) int {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.discarding = true
+	defer func() { d.discarding = false }()
+	if d.store.Remove(key) {
+		return 1
+	}
+	return 0
+}
+
+// RemovePrefix forgets every key starting with `prefix`; an empty prefix
+// forgets every key
+func (d *Deduplicator) RemovePrefix(prefix string) int {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.discarding = true
+	defer func() { d.discarding = false }()
+	return d.store.RemovePrefix(prefix)
+}
+
+func (d *Deduplicator) Len() int {
+	return d.store.Len()
+}
+
+// Claim returns which candidates should be sent. Unless the store is shared
+// with other instances, that is all of them.
+func (d *Deduplicator) Claim(candidates []*DedupCandidate, now time.Time) []bool {
+	shared, isShared := d.store.(SharedDedupStore)
+	if !isShared {
+		claimed := make([]bool, len(candidates))
+		for i := range claimed {
+			claimed[i] = true
+		}
+		return claimed
+	}
+	claims := make([]DedupClaim, len(candidates))
+	for i, candidate := range candidates {
+		claims[i].Key = candidate.Key
+		if d.mode == DEDUP_MODE_ON_CHANGE {
+			// the key holds the last version sent (the record has already
+			// been hashed by Check, so this cannot fail)
+			claims[i].Value, _ = hashRecord(candidate.Record)
+		}
+		claims[i].TTL = candidate.Seen.Add(candidate.TTL).Sub(now)
+	}
+	return shared.Claim(claims)
+}
+
+// dedupOverridesFromMatchMap reads any `_dedup_*` attributes from a match
+// map entry, returning nil if there are none
+func dedupOverridesFromMatchMap(fields map[string]interface{}) (*DedupOverrides, error) {
+	var overrides *DedupOverrides
+	for k, raw := range fields {
+		if !strings.HasPrefix(k, MATCH_MAP_DEDUP_PREFIX) {
+			continue
+		}
+		var v string
+		switch raw.(type) {
+		case map[string]interface{}, []interface{}, nil:
+			return nil, fmt.Errorf("Invalid `%s`: %+v", k, raw)
+		default:
+			v = fmt.Sprint(raw)
+		}
+		if overrides == nil {
+			overrides = &DedupOverrides{}
+		}
+		switch k {
+		case MATCH_MAP_DEDUP_TTL:
+			seconds, err := strconv.ParseUint(strings.TrimSpace(v), 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid `%s`: %+v", k, v)
+			}
+			ttl := time.Duration(seconds) * time.Second
+			overrides.TTL = &ttl
+		case MATCH_MAP_DEDUP_KEYS:
+			csvAppend(v, &overrides.KeyFields)
+			if len(overrides.KeyFields) == 0 {
+				return nil, fmt.Errorf("Invalid `%s`: %+v", k, v)
+			}
+		case MATCH_MAP_DEDUP_SKIP:
+			skip, err := strconv.ParseBool(strings.TrimSpace(v))
+			if err != nil {
+				return nil, fmt.Errorf("Invalid `%s`: %+v", k, v)
+			}
+			overrides.Skip = skip
+		default:
+			return nil, fmt.Errorf("Unknown reserved match map attribute: %s", k)
+		}
+	}
+	return overrides, nil
+}
+
+// dedupTTLOverrideError explains why `_dedup_ttl` cannot apply under a
+// config, or is nil if it can. The probabilistic backend keeps every key
+// for `deduplicate_ttl`, and calendar windows always end with their bucket.
+func dedupTTLOverrideError(conf *Config) error {
+	if conf.DedupBackend == DEDUP_BACKEND_PROBABILISTIC {
+		return fmt.Errorf("`%s` is not supported by `dedup_backend` `%s`", MATCH_MAP_DEDUP_TTL, DEDUP_BACKEND_PROBABILISTIC)
+	}
+	if conf.DedupWindow == DEDUP_WINDOW_CALENDAR {
+		return fmt.Errorf("`%s` is not supported with `dedup_window` `%s`", MATCH_MAP_DEDUP_TTL, DEDUP_WINDOW_CALENDAR)
+	}
+	return nil
+}
+
+// dedupNamespace prefixes keys of records matched by an entry with its own
+// dedup settings. Key values never contain an unescaped "@", so namespaced
+// keys cannot collide with others.
+func dedupNamespace(entry *MatchEntry) string {
+	var str strings.Builder
+	str.WriteString("@")
+	str.WriteString(dedupKeyEscaper.Replace(entry.Field))
+	str.WriteString("=")
+	str.WriteString(dedupKeyEscaper.Replace(entry.Pattern))
+	str.WriteString("@")
+	return str.String()
+}
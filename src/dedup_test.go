@@ -0,0 +1,129 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func newTestDeduplicator(t *testing.T, mode string) *Deduplicator {
+	d, err := newDeduplicator(
+		mode,
+		func(onRemoved RemovalCallback) (DedupStore, error) {
+			return newExpiringCache(100, onRemoved)
+		},
+		nil,
+		nil,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func TestHashRecordUnmarshalable(t *testing.T) {
+	if _, err := hashRecord(StringifiedRecordType{"v": math.NaN()}); err == nil {
+		t.Fatal("hashed a record containing NaN")
+	}
+	if _, err := generateDeduplicationKeyFromRecordContent(StringifiedRecordType{"v": math.Inf(1)}); err == nil {
+		t.Fatal("keyed a record containing +Inf")
+	}
+
+	d := newTestDeduplicator(t, DEDUP_MODE_ON_CHANGE)
+	now := time.Now()
+	for i := 0; i < 2; i++ {
+		if _, err := d.Check(&DedupCandidate{Key: "k", Record: StringifiedRecordType{"v": math.NaN()}, Timestamp: now, Seen: now, TTL: time.Hour}, now); err == nil {
+			t.Fatal("Check accepted a record containing NaN")
+		}
+	}
+	if d.Len() != 0 {
+		t.Fatalf("store has %d entries after failed checks, want 0", d.Len())
+	}
+}
+
+func TestDeduplicatorModes(t *testing.T) {
+	start := time.Now()
+	type step struct {
+		at     time.Duration // after start
+		record string
+		want   DedupDecision
+	}
+	for _, test := range []struct {
+		mode  string
+		steps []step
+	}{
+		{DEDUP_MODE_FIRST, []step{
+			{0, "a", DedupSend},
+			{time.Second, "b", DedupDuplicate},
+			{time.Minute - time.Second, "a", DedupDuplicate},
+			// the window has closed
+			{time.Minute, "a", DedupSend},
+		}},
+		{DEDUP_MODE_ON_CHANGE, []step{
+			{0, "a", DedupSend},
+			{time.Second, "a", DedupDuplicate},
+			{2 * time.Second, "b", DedupResend},
+			{3 * time.Second, "b", DedupDuplicate},
+			{4 * time.Second, "a", DedupResend},
+			// the TTL runs from the last change
+			{time.Minute + 3*time.Second, "a", DedupDuplicate},
+			{time.Minute + 4*time.Second, "a", DedupSend},
+		}},
+		{DEDUP_MODE_SUMMARIZE, []step{
+			{0, "a", DedupHold},
+			{time.Second, "b", DedupDuplicate},
+			{2 * time.Second, "c", DedupDuplicate},
+			{time.Minute, "d", DedupHold},
+		}},
+	} {
+		summaries := []*DedupEntry{}
+		d, err := newDeduplicator(
+			test.mode,
+			func(onRemoved RemovalCallback) (DedupStore, error) {
+				return newExpiringCache(100, onRemoved)
+			},
+			nil,
+			func(entry *DedupEntry) { summaries = append(summaries, entry) },
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, step := range test.steps {
+			now := start.Add(step.at)
+			d.Expire(now)
+			candidate := &DedupCandidate{
+				Key:       "k",
+				Record:    StringifiedRecordType{"v": step.record},
+				Timestamp: now,
+				Original:  now.Add(-time.Millisecond),
+				Seen:      now,
+				TTL:       time.Minute,
+			}
+			if decision, _ := d.Check(candidate, now); decision != step.want {
+				t.Fatalf("%s: step %d: decision %s, want %s", test.mode, i, decision, step.want)
+			}
+		}
+
+		if test.mode != DEDUP_MODE_SUMMARIZE {
+			if len(summaries) != 0 {
+				t.Fatalf("%s: %d summaries", test.mode, len(summaries))
+			}
+			continue
+		}
+		// the first window closed when the second opened, holding the first
+		// record, its times, and how often the key was seen
+		if len(summaries) != 1 {
+			t.Fatalf("%d summaries, want 1", len(summaries))
+		}
+		first := summaries[0]
+		if first.Count != 3 || first.Record["v"] != "a" ||
+			!first.FirstSeen.Equal(start) || !first.LastSeen.Equal(start.Add(2*time.Second)) ||
+			!first.Original.Equal(start.Add(-time.Millisecond)) {
+			t.Fatalf("summary %+v", first)
+		}
+		d.Flush()
+		if len(summaries) != 2 || summaries[1].Count != 1 || summaries[1].Record["v"] != "d" {
+			t.Fatalf("summaries after flush %+v", summaries)
+		}
+	}
+}
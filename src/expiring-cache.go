@@ -0,0 +1,251 @@
+package main
+
+import (
+	"container/heap"
+	simplelru "github.com/hashicorp/golang-lru/simplelru"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	RemovedExpired RemovalReason = iota
+	RemovedEvicted
+	RemovedPurged
+)
+
+type (
+	RemovalReason int
+
+	RemovalCallback func(key string, value interface{}, reason RemovalReason)
+
+	cacheEntry struct {
+		key     string
+		value   interface{}
+		expires time.Time
+		index   int
+	}
+
+	expiryHeap []*cacheEntry
+
+	// ExpiringCache is a size limited LRU cache in which every entry also
+	// carries an expiry time. Expired entries are removed actively (oldest
+	// expiry first), so that capacity is only ever used by live entries.
+	ExpiringCache struct {
+		lock      sync.Mutex
+		lru       *simplelru.LRU
+		expiry    expiryHeap
+		removed   []*cacheEntry
+		reasons   []RemovalReason
+		reason    RemovalReason
+		onRemoved RemovalCallback
+	}
+)
+
+func (h expiryHeap) Len() int           { return len(h) }
+func (h expiryHeap) Less(i, j int) bool { return h[i].expires.Before(h[j].expires) }
+func (h expiryHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *expiryHeap) Push(x interface{}) {
+	entry := x.(*cacheEntry)
+	entry.index = len(*h)
+	*h = append(*h, entry)
+}
+
+func (h *expiryHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	entry := old[n-1]
+	old[n-1] = nil
+	entry.index = -1
+	*h = old[0 : n-1]
+	return entry
+}
+
+func (r RemovalReason) String() string {
+	switch r {
+	case RemovedExpired:
+		return "expired"
+	case RemovedEvicted:
+		return "evicted"
+	case RemovedPurged:
+		return "purged"
+	}
+	return "unknown"
+}
+
+func newExpiringCache(size int, onRemoved RemovalCallback) (*ExpiringCache, error) {
+	c := &ExpiringCache{
+		onRemoved: onRemoved,
+	}
+	lru, err := simplelru.NewLRU(size, c.onEvict)
+	if err != nil {
+		return nil, err
+	}
+	c.lru = lru
+	return c, nil
+}
+
+// onEvict is called by the underlying LRU (with c.lock held) whenever an
+// entry leaves it. Entries already taken off the expiry heap were removed by
+// removeLocked, anything else was pushed out to make room.
+func (c *ExpiringCache) onEvict(_ interface{}, value interface{}) {
+	entry := value.(*cacheEntry)
+	reason := c.reason
+	if entry.index >= 0 {
+		heap.Remove(&c.expiry, entry.index)
+		reason = RemovedEvicted
+	}
+	c.removed = append(c.removed, entry)
+	c.reasons = append(c.reasons, reason)
+}
+
+// notify must be called without c.lock held, so that callbacks may use the cache
+func (c *ExpiringCache) notify(removed []*cacheEntry, reasons []RemovalReason) {
+	if c.onRemoved == nil {
+		return
+	}
+	for i, entry := range removed {
+		c.onRemoved(entry.key, entry.value, reasons[i])
+	}
+}
+
+func (c *ExpiringCache) unlockAndNotify() {
+	removed, reasons := c.removed, c.reasons
+	c.removed, c.reasons = nil, nil
+	c.lock.Unlock()
+	c.notify(removed, reasons)
+}
+
+func (c *ExpiringCache) removeLocked(entry *cacheEntry, reason RemovalReason) {
+	if entry.index >= 0 {
+		heap.Remove(&c.expiry, entry.index)
+	}
+	c.reason = reason
+	c.lru.Remove(entry.key)
+}
+
+func (c *ExpiringCache) expireLocked(now time.Time) int {
+	count := 0
+	for len(c.expiry) > 0 && !c.expiry[0].expires.After(now) {
+		c.removeLocked(c.expiry[0], RemovedExpired)
+		count++
+	}
+	return count
+}
+
+// Get returns the value for a key, provided it has not expired by `now`
+func (c *ExpiringCache) Get(key string, now time.Time) (interface{}, bool) {
+	c.lock.Lock()
+	defer c.unlockAndNotify()
+	value, ok := c.lru.Get(key)
+	if !ok {
+		return nil, false
+	}
+	entry := value.(*cacheEntry)
+	if !entry.expires.After(now) {
+		c.removeLocked(entry, RemovedExpired)
+		return nil, false
+	}
+	return entry.value, true
+}
+
+// Peek returns the value and expiry for a key without updating its recency
+func (c *ExpiringCache) Peek(key string, now time.Time) (interface{}, time.Time, bool) {
+	c.lock.Lock()
+	defer c.unlockAndNotify()
+	value, ok := c.lru.Peek(key)
+	if !ok {
+		return nil, time.Time{}, false
+	}
+	entry := value.(*cacheEntry)
+	if !entry.expires.After(now) {
+		c.removeLocked(entry, RemovedExpired)
+		return nil, time.Time{}, false
+	}
+	return entry.value, entry.expires, true
+}
+
+// Add inserts or replaces a key, returning true if a live entry had to be
+// evicted to make room for it.
+func (c *ExpiringCache) Add(key string, value interface{}, expires time.Time) bool {
+	c.lock.Lock()
+	defer c.unlockAndNotify()
+	c.expireLocked(time.Now())
+	if existing, ok := c.lru.Peek(key); ok {
+		entry := existing.(*cacheEntry)
+		entry.value = value
+		entry.expires = expires
+		heap.Fix(&c.expiry, entry.index)
+		c.lru.Get(key)
+		return false
+	}
+	entry := &cacheEntry{
+		key:     key,
+		value:   value,
+		expires: expires,
+	}
+	heap.Push(&c.expiry, entry)
+	return c.lru.Add(key, entry)
+}
+
+// RemoveExpired drops every entry which has expired by `now`
+func (c *ExpiringCache) RemoveExpired(now time.Time) int {
+	c.lock.Lock()
+	defer c.unlockAndNotify()
+	return c.expireLocked(now)
+}
+
+// Remove deletes a key, regardless of expiry
+func (c *ExpiringCache) Remove(key string) bool {
+	c.lock.Lock()
+	defer c.unlockAndNotify()
+	value, ok := c.lru.Peek(key)
+	if !ok {
+		return false
+	}
+	c.removeLocked(value.(*cacheEntry), RemovedPurged)
+	return true
+}
+
+// RemovePrefix deletes every key starting with `prefix`
+func (c *ExpiringCache) RemovePrefix(prefix string) int {
+	return len(c.removePrefix(prefix))
+}
+
+// removePrefix deletes every key starting with `prefix`, returning them
+func (c *ExpiringCache) removePrefix(prefix string) []string {
+	c.lock.Lock()
+	defer c.unlockAndNotify()
+	removed := []string{}
+	for _, key := range c.lru.Keys() {
+		if strings.HasPrefix(key.(string), prefix) {
+			if value, ok := c.lru.Peek(key); ok {
+				c.removeLocked(value.(*cacheEntry), RemovedPurged)
+				removed = append(removed, key.(string))
+			}
+		}
+	}
+	return removed
+}
+
+// Purge removes every entry, regardless of expiry
+func (c *ExpiringCache) Purge() int {
+	c.lock.Lock()
+	defer c.unlockAndNotify()
+	count := len(c.expiry)
+	for len(c.expiry) > 0 {
+		c.removeLocked(c.expiry[0], RemovedPurged)
+	}
+	return count
+}
+
+func (c *ExpiringCache) Len() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.lru.Len()
+}
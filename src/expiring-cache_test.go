@@ -0,0 +1,137 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+type removal struct {
+	key    string
+	reason RemovalReason
+}
+
+func newTestCache(t *testing.T, size int) (*ExpiringCache, *[]removal) {
+	removed := &[]removal{}
+	c, err := newExpiringCache(size, func(key string, _ interface{}, reason RemovalReason) {
+		*removed = append(*removed, removal{key, reason})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, removed
+}
+
+// checkHeap verifies that every cache entry appears on the expiry heap
+// exactly once, at the index it records
+func checkHeap(t *testing.T, c *ExpiringCache) {
+	t.Helper()
+	if len(c.expiry) != c.lru.Len() {
+		t.Fatalf("heap has %d entries, LRU has %d", len(c.expiry), c.lru.Len())
+	}
+	for i, entry := range c.expiry {
+		if entry.index != i {
+			t.Fatalf("heap entry %s has index %d at position %d", entry.key, entry.index, i)
+		}
+		value, ok := c.lru.Peek(entry.key)
+		if !ok || value.(*cacheEntry) != entry {
+			t.Fatalf("heap entry %s is not the LRU entry", entry.key)
+		}
+	}
+}
+
+func TestExpiringCacheExpiryOrder(t *testing.T) {
+	c, removed := newTestCache(t, 10)
+	base := time.Now().Add(time.Hour)
+	c.Add("c", 3, base.Add(3*time.Second))
+	c.Add("a", 1, base.Add(1*time.Second))
+	c.Add("d", 4, base.Add(4*time.Second))
+	c.Add("b", 2, base.Add(2*time.Second))
+	checkHeap(t, c)
+
+	if n := c.RemoveExpired(base.Add(2 * time.Second)); n != 2 {
+		t.Fatalf("expired %d entries, want 2", n)
+	}
+	want := []removal{{"a", RemovedExpired}, {"b", RemovedExpired}}
+	if len(*removed) != len(want) {
+		t.Fatalf("removed %v, want %v", *removed, want)
+	}
+	for i := range want {
+		if (*removed)[i] != want[i] {
+			t.Fatalf("removed %v, want %v", *removed, want)
+		}
+	}
+	checkHeap(t, c)
+
+	if _, ok := c.Get("c", base.Add(3*time.Second)); ok {
+		t.Fatal("entry returned at its expiry time")
+	}
+	if _, ok := c.Get("d", base.Add(3*time.Second)); !ok {
+		t.Fatal("live entry not returned")
+	}
+	checkHeap(t, c)
+}
+
+func TestExpiringCacheReAdd(t *testing.T) {
+	c, removed := newTestCache(t, 10)
+	base := time.Now().Add(time.Hour)
+	c.Add("a", 1, base.Add(1*time.Second))
+	c.Add("b", 2, base.Add(2*time.Second))
+	c.Add("a", 3, base.Add(5*time.Second))
+	checkHeap(t, c)
+	if len(c.expiry) != 2 {
+		t.Fatalf("heap has %d entries after re-adding, want 2", len(c.expiry))
+	}
+
+	// the earlier expiry of "a" must no longer apply
+	c.RemoveExpired(base.Add(3 * time.Second))
+	if len(*removed) != 1 || (*removed)[0].key != "b" {
+		t.Fatalf("removed %v, want only b", *removed)
+	}
+	value, ok := c.Get("a", base.Add(3*time.Second))
+	if !ok || value.(int) != 3 {
+		t.Fatalf("got %v, %v for re-added key", value, ok)
+	}
+	checkHeap(t, c)
+}
+
+func TestExpiringCacheEviction(t *testing.T) {
+	c, removed := newTestCache(t, 2)
+	base := time.Now().Add(time.Hour)
+	c.Add("a", 1, base.Add(1*time.Second))
+	c.Add("b", 2, base.Add(2*time.Second))
+	// "a" becomes the most recently used, so "b" is evicted
+	c.Get("a", time.Now())
+	if evicted := c.Add("c", 3, base.Add(3*time.Second)); !evicted {
+		t.Fatal("Add did not report an eviction")
+	}
+	if len(*removed) != 1 || (*removed)[0] != (removal{"b", RemovedEvicted}) {
+		t.Fatalf("removed %v, want b evicted", *removed)
+	}
+	checkHeap(t, c)
+
+	// the evicted entry's heap slot must be gone, so expiry only sees live keys
+	if n := c.RemoveExpired(base.Add(2 * time.Second)); n != 1 {
+		t.Fatalf("expired %d entries, want 1", n)
+	}
+	if c.Len() != 1 {
+		t.Fatalf("cache has %d entries, want 1", c.Len())
+	}
+	checkHeap(t, c)
+}
+
+func TestExpiringCacheRemovePrefix(t *testing.T) {
+	c, removed := newTestCache(t, 10)
+	expires := time.Now().Add(time.Hour)
+	for _, key := range []string{"x:1", "x:2", "y:1"} {
+		c.Add(key, nil, expires)
+	}
+	if n := c.RemovePrefix("x:"); n != 2 {
+		t.Fatalf("removed %d entries, want 2", n)
+	}
+	for _, r := range *removed {
+		if r.reason != RemovedPurged {
+			t.Fatalf("removed %v with reason %s", r.key, r.reason)
+		}
+	}
+	checkHeap(t, c)
+}
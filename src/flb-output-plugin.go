@@ -4,7 +4,6 @@ import (
 	"C"
 	"encoding/json"
 	output "github.com/fluent/fluent-bit-go/output"
-	"strings"
 	"sync"
 	"time"
 	"unsafe"
@@ -41,6 +40,13 @@ func FLBPluginInit(plugin unsafe.Pointer) int {
 
 	log := pInstance.Log
 
+	if len(conf.AdminListen) > 0 {
+		if adminErr := registerAdminInstance(pInstance); adminErr != nil {
+			log.Error.Printf("Admin API problem: %v\n", adminErr)
+			return output.FLB_ERROR
+		}
+	}
+
 	if json, jsonErr := json.Marshal(conf); jsonErr == nil {
 		log.Info.Printf("Configuration => %s\n", json)
 	}
@@ -49,7 +55,7 @@ func FLBPluginInit(plugin unsafe.Pointer) int {
 		"Current time in `output_time_format` => %s\n",
 		*formattedTime(
 			pInstance.TimeFormatter,
-			time.Now(),
+			time.Now().In(conf.OutputTimeLocation),
 		).String,
 	)
 
@@ -78,6 +84,76 @@ func FLBPluginInit(plugin unsafe.Pointer) int {
 		)
 	}(pInstance, &wg)
 
+	// rejected records are posted in the same way, to their own URL
+	if pInstance.RejectJsonChan != nil {
+		wg.Add(1)
+		go func(pi *PInstance, wg *sync.WaitGroup) {
+			defer wg.Done()
+			aggregateChannelLoop(
+				pi.Log,
+				2000,
+				pi.Config.MaxRecords,
+				pi.Config.GzipBody,
+				pi.RejectJsonChan,
+				pi.RejectPostChan,
+			)
+		}(pInstance, &wg)
+
+		wg.Add(1)
+		go func(pi *PInstance, wg *sync.WaitGroup) {
+			defer wg.Done()
+			doPostLoop(
+				pi.Log,
+				pi.HttpClient,
+				pi.Config.OutputRejectUrl,
+				pi.Config.Headers,
+				pi.RejectPostChan,
+			)
+		}(pInstance, &wg)
+	}
+
+	pInstance.Housekeeping.Add(1)
+	go func(pi *PInstance) {
+		defer pi.Housekeeping.Done()
+		expireLoop(
+			pi.Dedup,
+			1*time.Second,
+			pi.Done,
+		)
+	}(pInstance)
+
+	matchMapInterval := conf.MatchMapReloadInterval
+	if len(conf.MatchMapUrl) > 0 {
+		matchMapInterval = conf.MatchMapRefreshInterval
+	}
+	if pInstance.MatchMap != nil && (matchMapInterval > 0 || conf.MatchMapReloadSignal) {
+		wg.Add(1)
+		go func(pi *PInstance, wg *sync.WaitGroup) {
+			defer wg.Done()
+			matchMapReloadLoop(
+				pi.Log,
+				pi.Metrics,
+				pi.MatchMap,
+				time.Duration(matchMapInterval)*time.Second,
+				pi.Config.MatchMapReloadSignal,
+				pi.Done,
+			)
+		}(pInstance, &wg)
+	}
+
+	if pInstance.Config.MetricsInterval > 0 {
+		wg.Add(1)
+		go func(pi *PInstance, wg *sync.WaitGroup) {
+			defer wg.Done()
+			metricsLogLoop(
+				pi.Log,
+				pi.Metrics,
+				time.Duration(pi.Config.MetricsInterval)*time.Second,
+				pi.Done,
+			)
+		}(pInstance, &wg)
+	}
+
 	return output.FLB_OK
 }
 
@@ -95,11 +171,14 @@ func FLBPluginFlushCtx(ctx, data unsafe.Pointer, length C.int, tag *C.char) int
 	pi := flbInstances[id]
 	log := pi.Log
 	conf := pi.Config
+	flbTag := C.GoString(tag)
 
-	log.Debug.Printf("Flush called\n")
+	log.Debug.Printf("Flush called: tag=%s\n", flbTag)
 
 	dec := output.NewDecoder(data, int(length))
 
+	candidates := []*DedupCandidate{}
+
 	count := 0
 	for {
 		count++
@@ -109,133 +188,264 @@ func FLBPluginFlushCtx(ctx, data unsafe.Pointer, length C.int, tag *C.char) int
 		}
 
 		timestamp := ts.(output.FLBTime)
-		timestampAsTime := timestamp.Time
 		timeNow := time.Now()
-		recordAge := timeNow.Sub(timestampAsTime)
-
-		// If record timestamp is too old or more than 1h in future, then discard it!
-		if recordAge > time.Duration(conf.DeduplicateTTL)*time.Second ||
-			timestampAsTime.After(timeNow.Add(1*time.Hour)) {
-			log.Error.Printf(
-				"Record too old (or in future): recordIndex=%d, recordAge=%s, timestamp=%s\n",
-				count,
-				recordAge,
-				timestampAsTime,
-			)
-			continue
-		}
 
-		// Simplify incoming event to a string map
+		// Convert incoming event to JSON compatible values
 		var stringified StringifiedRecordType
-		if result, err := stringifyFluentBitRecord(record); err == nil {
+		if result, err := convertFluentBitRecord(record); err == nil {
 			stringified = result
 		} else {
 			log.Error.Printf(
 				"Failed to understand: recordIndex=%d, tag=%s, time=%s, record=%v\n",
 				count,
-				C.GoString(tag),
-				timestampAsTime,
+				flbTag,
+				timestamp.Time,
 				record,
 			)
 			continue
 		}
 
+		// the event time may come from the record itself
+		eventTime := pi.eventTime(stringified, timestamp.Time, count)
+
+		// apply `late_record_policy` to records outside the accepted window
+		timestampAsTime, late, admitted := pi.admitTimestamp(eventTime, timeNow)
+		if !admitted {
+			log.Debug.Printf(
+				"Record too old (or in future): recordIndex=%d, timestamp=%s\n",
+				count,
+				eventTime,
+			)
+			continue
+		}
+
 		// log the stringified record for debugging
 		log.Debug.Printf(
 			"recordIndex=%d, tag=%s, time=%s, record=%v\n",
 			count,
-			C.GoString(tag),
+			flbTag,
 			timestampAsTime,
 			stringified,
 		)
 
-		// check if the record matches the fields in the match map file
-		if ok, matched, additionalFields, _ := matchRecordToMatchMap(
+		// the match map and dedup keys can refer to the tag as `_tag`
+		releaseTag := pi.exposeTag(stringified, flbTag)
+
+		keyFields := conf.DeduplicateKeyFields
+		dedupTTL := time.Duration(conf.DeduplicateTTL) * time.Second
+		var overrides *DedupOverrides
+		var namespace string
+
+		// check if the record matches the fields in the match map (if any)
+		if entry, matchFields, ok := matchRecordToMatchMap(
 			stringified,
-			pi.MatchMap,
+			pi.MatchMap.Current(),
 		); !ok {
-			// the record did not match the match map
+			// the record did not match the match map (if there is one)
+			if pi.MatchMap != nil {
+				pi.Metrics.Inc(METRIC_MATCH_MAP_UNMATCHED)
+			}
+			switch conf.MatchMapUnmatched {
+			case MATCH_MAP_UNMATCHED_PASS:
+				log.Debug.Printf(
+					"Record did not match, passing through: recordIndex=%d\n",
+					count,
+				)
+			case MATCH_MAP_UNMATCHED_DEFAULT:
+				log.Debug.Printf(
+					"Record did not match, adding default fields: recordIndex=%d\n",
+					count,
+				)
+				for k, v := range conf.MatchMapDefaultFields {
+					stringified[k] = v
+				}
+			default:
+				log.Debug.Printf(
+					"Record did not match: recordIndex=%d\n",
+					count,
+				)
+				continue
+			}
+		} else if entry.Drop {
+			// the record matched a rule which discards it
 			log.Debug.Printf(
-				"Record did not match: recordIndex=%d\n",
+				"Record dropped by match map: recordIndex=%d, matched=%s:%s:%s\n",
 				count,
+				entry.Field,
+				entry.Kind,
+				entry.Pattern,
 			)
+			pi.Metrics.Inc(METRIC_MATCH_MAP_DROPPED)
 			continue
 		} else {
 			// the record did match a field in the match map
 			log.Debug.Printf(
-				"recordIndex=%d, matched=%v, additionalFields=%v\n",
+				"recordIndex=%d, matched=%s:%s:%s, additionalFields=%v\n",
 				count,
-				*matched,
-				*additionalFields,
+				entry.Field,
+				entry.Kind,
+				entry.Pattern,
+				matchFields,
 			)
 			// add any additional fields from the match map to the record
-			for k, v := range *additionalFields {
+			for k, v := range matchFields {
 				stringified[k] = v
 			}
+			// apply any per-entry dedup settings
+			if overrides = entry.Overrides; overrides != nil {
+				namespace = dedupNamespace(entry)
+				if overrides.TTL != nil {
+					dedupTTL = *overrides.TTL
+				}
+				if len(overrides.KeyFields) > 0 {
+					keyFields = overrides.KeyFields
+				}
+			}
 		}
 
-		// generate a key for use with the LRU cache
-		lruKey := generateDeduplicationKeyFromRecordValues(
-			conf.DeduplicateKeyFields,
-			stringified,
-		)
+		if overrides != nil && overrides.Skip {
+			log.Debug.Printf(
+				"Sending without deduplication (`%s`): recordIndex=%d\n",
+				MATCH_MAP_DEDUP_SKIP,
+				count,
+			)
+			pi.Metrics.Inc(METRIC_DEDUP_SKIPPED)
+			releaseTag()
+			pi.sendRecord(stringified, timestampAsTime, timestamp.Time)
+			continue
+		}
 
-		// Get any existing record for this key from LRU
-		existingFromLru, foundInLruBool := pi.LRU.Get(lruKey)
-		log.Debug.Printf(
-			"recordIndex=%d, LRU: key=%s, foundInLruBool=%v, value=%v\n",
-			count,
-			lruKey,
-			foundInLruBool,
-			existingFromLru,
-		)
+		if late {
+			log.Debug.Printf(
+				"Sending without deduplication (`%s`): recordIndex=%d, timestamp=%s\n",
+				LATE_RECORD_SEND_WITHOUT_DEDUP,
+				count,
+				timestampAsTime,
+			)
+			releaseTag()
+			pi.sendRecord(stringified, timestampAsTime, timestamp.Time)
+			continue
+		}
 
-		if foundInLruBool {
-			lruRecordTime := existingFromLru.(time.Time)
-			lruRecordAge := timeNow.Sub(lruRecordTime)
-			// If record from LRU is recent, we don't need to process the current record
-			if lruRecordAge < time.Duration(conf.DeduplicateTTL)*time.Second {
-				log.Debug.Printf(
-					"Skipping send as recent in LRU: recordIndex=%d, lruRecordAge=%s\n",
+		// generate a key for use with the deduplication cache
+		var dedupKey string
+		if conf.DeduplicateKeyMode == DEDUP_KEY_MODE_CONTENT && (overrides == nil || len(overrides.KeyFields) == 0) {
+			releaseTag()
+			key, keyErr := generateDeduplicationKeyFromRecordContent(
+				stringified,
+				conf.RemoveFields,
+				conf.DeduplicateIgnoreFields,
+				[]string{conf.TagKey},
+			)
+			if keyErr != nil {
+				log.Error.Printf(
+					"Failed to generate deduplication key: recordIndex=%d, error=%v\n",
 					count,
-					lruRecordAge,
+					keyErr,
 				)
 				continue
 			}
+			dedupKey = key
+		} else if key, keyErr := generateDeduplicationKeyFromRecordValues(
+			keyFields,
+			stringified,
+			conf.DedupKeyPlaceholder,
+		); keyErr == nil {
+			dedupKey = key
+		} else {
+			releaseTag()
+			pi.sendWithoutKey(stringified, timestampAsTime, timestamp.Time, count, keyErr)
+			continue
 		}
 
-		// Add the current record to the LRU
-		if evicted := pi.LRU.Add(lruKey, timestampAsTime); evicted {
-			log.Info.Printf(
-				"LRU evicted old record\n",
+		dedupKey = namespace + dedupKey
+		releaseTag()
+
+		seen := dedupSeenTime(eventTime, timestampAsTime, timeNow, dedupTTL)
+
+		// in calendar mode, the bucket is part of the key and ends the window
+		if conf.DedupWindow == DEDUP_WINDOW_CALENDAR {
+			bucketStart, bucketEnd, _ := calendarBucket(
+				seen,
+				conf.DedupCalendarBucket,
+				conf.DedupCalendarLocation,
 			)
+			if !bucketEnd.After(timeNow) {
+				// the record's bucket has ended, so it is deduplicated in
+				// the bucket of its arrival
+				seen = timeNow
+				bucketStart, bucketEnd, _ = calendarBucket(
+					seen,
+					conf.DedupCalendarBucket,
+					conf.DedupCalendarLocation,
+				)
+			}
+			dedupKey += ":" + dedupKeyEscaper.Replace(bucketStart.Format(time.RFC3339))
+			dedupTTL = bucketEnd.Sub(seen)
 		}
 
-		// remove any undesired fields prior to forwarding
-		for _, removeFieldKey := range conf.RemoveFields {
-			delete(stringified, removeFieldKey)
+		// Check the key against the deduplication cache
+		candidate := &DedupCandidate{
+			Key:       dedupKey,
+			Record:    stringified,
+			Timestamp: timestampAsTime,
+			Original:  timestamp.Time,
+			Seen:      seen,
+			TTL:       dedupTTL,
 		}
-
-		// add any time field to the outgoing record
-		if timeKey := strings.TrimSpace(conf.OutputTimeKey); len(timeKey) > 0 {
-			if timeValue := formattedTime(
-				pi.TimeFormatter,
-				timestampAsTime,
-			); conf.OutputTimeAsInteger {
-				stringified[timeKey] = *timeValue.Int64
-			} else {
-				stringified[timeKey] = *timeValue.String
-			}
+		decision, checkErr := pi.Dedup.Check(candidate, timeNow)
+		if checkErr != nil {
+			log.Error.Printf(
+				"Failed to hash record: recordIndex=%d, error=%v\n",
+				count,
+				checkErr,
+			)
+			continue
 		}
+		log.Debug.Printf(
+			"recordIndex=%d, Dedup: key=%s, mode=%s, decision=%s\n",
+			count,
+			dedupKey,
+			conf.DedupMode,
+			decision,
+		)
 
-		// Marshal to JSON and put in to channel
-		if json, err := json.Marshal(stringified); err == nil {
-			log.Info.Printf("Sending => %s\n", json)
-			pi.EventJsonChan <- &json
-		} else {
-			log.Error.Printf("Failed to marshal as JSON: %v (%#v)\n", err, stringified)
+		switch decision {
+		case DedupDuplicate:
+			pi.Metrics.Inc(METRIC_DEDUP_HIT)
+			continue
+		case DedupHold:
+			// summarize mode: sent as a summary when the window closes,
+			// unless another instance claims the window
+			pi.Metrics.Inc(METRIC_DEDUP_MISS)
+			candidate.Hold = true
+		case DedupResend:
+			pi.Metrics.Inc(METRIC_DEDUP_CHANGED)
+		default:
+			pi.Metrics.Inc(METRIC_DEDUP_MISS)
 		}
 
+		candidates = append(candidates, candidate)
+
+	}
+
+	// check all candidates against any shared store at once, then send
+	claimNow := time.Now()
+	for i, claimed := range pi.Dedup.Claim(candidates, claimNow) {
+		candidate := candidates[i]
+		if !claimed {
+			log.Debug.Printf(
+				"Skipping send as already sent by another instance: key=%s\n",
+				candidate.Key,
+			)
+			if candidate.Hold {
+				pi.Dedup.Suppress(candidate.Key, claimNow)
+			}
+			continue
+		}
+		if !candidate.Hold {
+			pi.sendRecord(candidate.Record, candidate.Timestamp, candidate.Original)
+		}
 	}
 
 	return output.FLB_OK
@@ -243,8 +453,17 @@ func FLBPluginFlushCtx(ctx, data unsafe.Pointer, length C.int, tag *C.char) int
 
 //export FLBPluginExit
 func FLBPluginExit() int {
+	closeAdminServers()
 	for k := range flbInstances {
-		close(flbInstances[k].EventJsonChan)
+		pi := flbInstances[k]
+		close(pi.Done)
+		// wait for housekeeping to stop, then close any open summary windows
+		pi.Housekeeping.Wait()
+		pi.Dedup.Flush()
+		close(pi.EventJsonChan)
+		if pi.RejectJsonChan != nil {
+			close(pi.RejectJsonChan)
+		}
 	}
 	wg.Wait()
 	return output.FLB_OK
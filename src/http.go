@@ -10,7 +10,9 @@ import (
 	"time"
 )
 
-const ()
+const (
+	defaultUserAgent = "FLB/go-odp (github.com/JamesJJ/fluent-bit-output-deduplicated-post)"
+)
 
 type (
 	HttpClient struct {
@@ -56,7 +58,6 @@ func (httpClient HttpClient) postData(
 	data io.Reader,
 ) {
 
-	defaultUserAgent := "FLB/go-odp (github.com/JamesJJ/fluent-bit-output-deduplicated-post)"
 	request, reqErr := http.NewRequest("POST", url, data)
 	if reqErr != nil {
 		log.Error.Printf(
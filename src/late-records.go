@@ -0,0 +1,67 @@
+package main
+
+import (
+	"time"
+)
+
+const (
+	LATE_RECORD_DROP               = "drop"
+	LATE_RECORD_SEND_WITHOUT_DEDUP = "send_without_dedup"
+	LATE_RECORD_CLAMP_TIMESTAMP    = "clamp_timestamp"
+)
+
+func validLateRecordPolicy(policy string) bool {
+	switch policy {
+	case LATE_RECORD_DROP, LATE_RECORD_SEND_WITHOUT_DEDUP, LATE_RECORD_CLAMP_TIMESTAMP:
+		return true
+	}
+	return false
+}
+
+// admitTimestamp applies `late_record_policy` to a record timestamp older
+// than `max_record_age` or further ahead than `max_future_skew` (either
+// check is disabled by 0). It returns the timestamp to use, and whether the
+// record should be sent without deduplication; ok is false if the record
+// should be dropped.
+func (pi *PInstance) admitTimestamp(timestamp time.Time, now time.Time) (admitted time.Time, withoutDedup bool, ok bool) {
+
+	conf := pi.Config
+	maxAge := time.Duration(conf.MaxRecordAge) * time.Second
+	maxSkew := time.Duration(conf.MaxFutureSkew) * time.Second
+
+	var limit time.Time
+	switch {
+	case maxAge > 0 && now.Sub(timestamp) > maxAge:
+		pi.Metrics.Inc(METRIC_RECORDS_TOO_OLD)
+		limit = now.Add(-maxAge)
+	case maxSkew > 0 && timestamp.Sub(now) > maxSkew:
+		pi.Metrics.Inc(METRIC_RECORDS_TOO_NEW)
+		limit = now.Add(maxSkew)
+	default:
+		return timestamp, false, true
+	}
+
+	switch conf.LateRecordPolicy {
+	case LATE_RECORD_SEND_WITHOUT_DEDUP:
+		pi.Metrics.Inc(METRIC_LATE_SENT_WITHOUT_DEDUP)
+		return timestamp, true, true
+	case LATE_RECORD_CLAMP_TIMESTAMP:
+		pi.Metrics.Inc(METRIC_LATE_CLAMPED)
+		return limit, false, true
+	}
+	pi.Metrics.Inc(METRIC_LATE_DROPPED)
+	return timestamp, false, false
+}
+
+// dedupSeenTime returns when a record's dedup key is seen, which its TTL
+// runs from. That is the record's timestamp, unless the key would already
+// have expired by now: a clamped timestamp (the only kind admitTimestamp
+// changes) is at the edge of the accepted window, and an admitted timestamp
+// may be older than the TTL when `max_record_age` is longer. Such keys are
+// seen as of the record's arrival instead.
+func dedupSeenTime(eventTime time.Time, admitted time.Time, now time.Time, ttl time.Duration) time.Time {
+	if !admitted.Equal(eventTime) || now.Sub(admitted) >= ttl {
+		return now
+	}
+	return admitted
+}
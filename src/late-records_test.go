@@ -0,0 +1,170 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestClampedDuplicatesSuppressed(t *testing.T) {
+	const ttl = time.Hour
+	for mode, first := range map[string]DedupDecision{
+		DEDUP_MODE_FIRST:     DedupSend,
+		DEDUP_MODE_ON_CHANGE: DedupSend,
+		DEDUP_MODE_SUMMARIZE: DedupHold,
+	} {
+		// max_record_age defaults to deduplicate_ttl
+		pi := &PInstance{
+			Config: &Config{
+				DeduplicateTTL:   uint64(ttl / time.Second),
+				MaxRecordAge:     uint64(ttl / time.Second),
+				LateRecordPolicy: LATE_RECORD_CLAMP_TIMESTAMP,
+			},
+			Metrics: newMetrics(),
+		}
+		summaries := 0
+		d, err := newDeduplicator(
+			mode,
+			func(onRemoved RemovalCallback) (DedupStore, error) {
+				return newExpiringCache(100, onRemoved)
+			},
+			nil,
+			func(*DedupEntry) { summaries++ },
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		start := time.Now()
+		eventTime := start.Add(-2 * ttl)
+		record := StringifiedRecordType{"v": "late"}
+		for i, arrival := range []time.Duration{0, time.Second, ttl / 2} {
+			now := start.Add(arrival)
+			admitted, withoutDedup, ok := pi.admitTimestamp(eventTime, now)
+			if !ok || withoutDedup || !admitted.Equal(now.Add(-ttl)) {
+				t.Fatalf("%s: admitted %v, %v, %v, want clamped to %v", mode, admitted, withoutDedup, ok, now.Add(-ttl))
+			}
+			d.Expire(now)
+			seen := dedupSeenTime(eventTime, admitted, now, ttl)
+			decision, _ := d.Check(&DedupCandidate{Key: "k", Record: record, Timestamp: admitted, Seen: seen, TTL: ttl}, now)
+			want := DedupDuplicate
+			if i == 0 {
+				want = first
+			}
+			if decision != want {
+				t.Fatalf("%s: arrival %d (+%s): decision %s, want %s", mode, i, arrival, decision, want)
+			}
+		}
+		if summaries != 0 {
+			t.Fatalf("%s: summary sent before the window closed", mode)
+		}
+
+		// the key lasts the TTL from the first arrival
+		d.Expire(start.Add(ttl + time.Second))
+		if d.Len() != 0 {
+			t.Fatalf("%s: key outlived its TTL", mode)
+		}
+		if mode == DEDUP_MODE_SUMMARIZE && summaries != 1 {
+			t.Fatalf("%s: %d summaries, want 1", mode, summaries)
+		}
+	}
+}
+
+func TestClampedClaimTTL(t *testing.T) {
+	server := newRespServer(t)
+	d, err := newDeduplicator(
+		DEDUP_MODE_FIRST,
+		func(onRemoved RemovalCallback) (DedupStore, error) {
+			return newTestRedisStore(t, server.Address()), nil
+		},
+		nil,
+		nil,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	admitted := now.Add(-time.Hour)
+	seen := dedupSeenTime(now.Add(-2*time.Hour), admitted, now, time.Hour)
+	d.Claim([]*DedupCandidate{{Key: "k", Timestamp: admitted, Seen: seen, TTL: time.Hour}}, now)
+	if command := server.Commands()[0]; command[len(command)-1] != "3600" {
+		t.Fatalf("claimed with %v, want a TTL of an hour", command)
+	}
+}
+
+func TestAgeLongerThanTTL(t *testing.T) {
+	const ttl = time.Hour
+	pi := &PInstance{
+		Config: &Config{
+			DeduplicateTTL:   uint64(ttl / time.Second),
+			MaxRecordAge:     uint64(3 * ttl / time.Second),
+			LateRecordPolicy: LATE_RECORD_CLAMP_TIMESTAMP,
+		},
+		Metrics: newMetrics(),
+	}
+	d, err := newDeduplicator(
+		DEDUP_MODE_FIRST,
+		func(onRemoved RemovalCallback) (DedupStore, error) {
+			return newExpiringCache(100, onRemoved)
+		},
+		nil,
+		nil,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// admitted unclamped, but older than the TTL
+	start := time.Now()
+	eventTime := start.Add(-2 * ttl)
+	for i, arrival := range []time.Duration{0, time.Second, ttl / 2} {
+		now := start.Add(arrival)
+		admitted, withoutDedup, ok := pi.admitTimestamp(eventTime, now)
+		if !ok || withoutDedup || !admitted.Equal(eventTime) {
+			t.Fatalf("admitted %v, %v, %v, want %v", admitted, withoutDedup, ok, eventTime)
+		}
+		d.Expire(now)
+		seen := dedupSeenTime(eventTime, admitted, now, ttl)
+		decision, _ := d.Check(&DedupCandidate{Key: "k", Record: StringifiedRecordType{"v": "old"}, Timestamp: admitted, Seen: seen, TTL: ttl}, now)
+		want := DedupDuplicate
+		if i == 0 {
+			want = DedupSend
+		}
+		if decision != want {
+			t.Fatalf("arrival %d (+%s): decision %s, want %s", i, arrival, decision, want)
+		}
+	}
+
+	// the key lasts the TTL from the first arrival
+	d.Expire(start.Add(ttl + time.Second))
+	if d.Len() != 0 {
+		t.Fatal("key outlived its TTL")
+	}
+
+	// a timestamp within the TTL is still seen when it happened
+	recent := start.Add(-ttl / 2)
+	if seen := dedupSeenTime(recent, recent, start, ttl); !seen.Equal(recent) {
+		t.Fatalf("seen %v, want %v", seen, recent)
+	}
+}
+
+func TestAgeLongerThanTTLClaimTTL(t *testing.T) {
+	server := newRespServer(t)
+	d, err := newDeduplicator(
+		DEDUP_MODE_FIRST,
+		func(onRemoved RemovalCallback) (DedupStore, error) {
+			return newTestRedisStore(t, server.Address()), nil
+		},
+		nil,
+		nil,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	admitted := now.Add(-2 * time.Hour)
+	seen := dedupSeenTime(admitted, admitted, now, time.Hour)
+	d.Claim([]*DedupCandidate{{Key: "k", Timestamp: admitted, Seen: seen, TTL: time.Hour}}, now)
+	if command := server.Commands()[0]; command[len(command)-1] != "3600" {
+		t.Fatalf("claimed with %v, want a TTL of an hour", command)
+	}
+}
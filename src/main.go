@@ -1,4 +1,61 @@
 package main
 
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// main only runs when built as a program rather than as the plugin, where
+// it validates a match map, e.g. in CI:
+//
+//	go build -o match-map-check ./src
+//	./match-map-check -check etc/match_map_file-EXAMPLE.json
 func main() {
+	if len(os.Args) > 1 {
+		os.Exit(checkMatchMap(os.Args[1:]))
+	}
+}
+
+func checkMatchMap(args []string) int {
+	flags := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	filename := flags.String("check", "", "match map file to validate")
+	format := flags.String("format", "", "json, yaml or csv (default from the file extension)")
+	keyColumn := flags.String("csv-key-column", "", "CSV column matched against the record field of the same name (default the first)")
+	valueColumns := flags.String("csv-value-columns", "", "comma separated CSV columns to add to matching records (default all others)")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if len(*filename) == 0 {
+		flags.Usage()
+		return 2
+	}
+
+	mmFormat := &MatchMapFormat{
+		Format:       strings.ToLower(*format),
+		CsvKeyColumn: *keyColumn,
+	}
+	if len(mmFormat.Format) == 0 {
+		mmFormat.Format = matchMapFormatFor(*filename)
+	}
+	if !validMatchMapFormat(mmFormat.Format) {
+		fmt.Fprintf(os.Stderr, "Invalid format: %s\n", *format)
+		return 2
+	}
+	csvAppend(*valueColumns, &mmFormat.CsvValueColumns)
+
+	raw, err := ioutil.ReadFile(*filename)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+	matchMap, err := parseMatchMap(raw, mmFormat)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", *filename, err)
+		return 1
+	}
+	fmt.Printf("%s: OK (%s, %d rules)\n", *filename, mmFormat.Format, matchMap.Len())
+	return 0
 }
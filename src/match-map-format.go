@@ -0,0 +1,444 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	yaml "gopkg.in/yaml.v3"
+	"io"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+)
+
+const (
+	MATCH_MAP_FORMAT_JSON = "json"
+	MATCH_MAP_FORMAT_YAML = "yaml"
+	MATCH_MAP_FORMAT_CSV  = "csv"
+)
+
+type (
+	// MatchMapFormat says how to read a raw match map. CSV maps have one
+	// key column, named for the record field it matches, and value columns
+	// which are added to matching records.
+	MatchMapFormat struct {
+		Format          string
+		CsvKeyColumn    string
+		CsvValueColumns []string
+	}
+
+	// MatchMapError locates a problem in a match map
+	MatchMapError struct {
+		Line   int
+		Column int
+		Err    error
+	}
+)
+
+func (e *MatchMapError) Error() string {
+	if e.Column > 0 {
+		return fmt.Sprintf("line %d, column %d: %v", e.Line, e.Column, e.Err)
+	}
+	return fmt.Sprintf("line %d: %v", e.Line, e.Err)
+}
+
+func validMatchMapFormat(format string) bool {
+	switch format {
+	case MATCH_MAP_FORMAT_JSON, MATCH_MAP_FORMAT_YAML, MATCH_MAP_FORMAT_CSV:
+		return true
+	}
+	return false
+}
+
+// matchMapFormatFor guesses the format of a match map file or URL from its
+// extension, defaulting to JSON
+func matchMapFormatFor(name string) string {
+	if u, err := url.Parse(name); err == nil && len(u.Scheme) > 0 {
+		name = u.Path
+	}
+	switch strings.ToLower(path.Ext(name)) {
+	case ".yaml", ".yml":
+		return MATCH_MAP_FORMAT_YAML
+	case ".csv":
+		return MATCH_MAP_FORMAT_CSV
+	}
+	return MATCH_MAP_FORMAT_JSON
+}
+
+// parseMatchMap decodes, validates and compiles a match map
+func parseMatchMap(raw []byte, format *MatchMapFormat) (*CompiledMatchMap, error) {
+	var entries []*MatchEntry
+	var err error
+	switch format.Format {
+	case MATCH_MAP_FORMAT_YAML:
+		entries, err = yamlMatchEntries(raw)
+	case MATCH_MAP_FORMAT_CSV:
+		entries, err = csvMatchEntries(raw, format.CsvKeyColumn, format.CsvValueColumns)
+	default:
+		entries, err = jsonMatchEntries(raw)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return compileMatchMap(entries), nil
+}
+
+// patternSet rejects a pattern given twice for the same field, which in
+// the nested formats would silently replace the first
+type patternSet map[string]map[string]bool
+
+func (p patternSet) add(field string, pattern string) error {
+	if p[field] == nil {
+		p[field] = make(map[string]bool)
+	}
+	if p[field][pattern] {
+		return fmt.Errorf("%s: Duplicate pattern: %s", field, pattern)
+	}
+	p[field][pattern] = true
+	return nil
+}
+
+// textPosition returns the line and column (in bytes, from 1) of `offset`
+func textPosition(raw []byte, offset int64) (int, int) {
+	if offset > int64(len(raw)) {
+		offset = int64(len(raw))
+	}
+	line := 1 + bytes.Count(raw[:offset], []byte("\n"))
+	return line, int(offset) - bytes.LastIndexByte(raw[:offset], '\n')
+}
+
+// jsonPosition returns the line and column of the first token at or after
+// `offset`
+func jsonPosition(raw []byte, offset int64) (int, int) {
+	for offset < int64(len(raw)) && strings.IndexByte(" \t\r\n,:", raw[offset]) >= 0 {
+		offset++
+	}
+	return textPosition(raw, offset)
+}
+
+func jsonError(raw []byte, offset int64, err error) error {
+	line, column := jsonPosition(raw, offset)
+	return &MatchMapError{Line: line, Column: column, Err: err}
+}
+
+// jsonMatchEntries decodes a JSON match map of either format, keeping file
+// order
+func jsonMatchEntries(raw []byte) ([]*MatchEntry, error) {
+	// syntax errors first, as their offsets are only exact for a whole
+	// document
+	var document interface{}
+	if err := json.Unmarshal(raw, &document); err != nil {
+		if syntaxErr, isSyntax := err.(*json.SyntaxError); isSyntax {
+			return nil, jsonError(raw, syntaxErr.Offset-1, err)
+		}
+		return nil, err
+	}
+	top, isObject := document.(map[string]interface{})
+	if !isObject {
+		return nil, jsonError(raw, 0, fmt.Errorf("Expected an object"))
+	}
+	_, isRules := top["rules"].([]interface{})
+
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.DisallowUnknownFields()
+	dec.UseNumber()
+	expectDelim := func(delim json.Delim) error {
+		offset := dec.InputOffset()
+		if token, _ := dec.Token(); token != delim {
+			return jsonError(raw, offset, fmt.Errorf("Expected `%s`", delim))
+		}
+		return nil
+	}
+	readKey := func() (string, int64) {
+		offset := dec.InputOffset()
+		token, _ := dec.Token()
+		key, _ := token.(string)
+		return key, offset
+	}
+
+	entries := []*MatchEntry{}
+	if err := expectDelim('{'); err != nil {
+		return nil, err
+	}
+	if isRules {
+		for dec.More() {
+			if key, offset := readKey(); key != "rules" {
+				return nil, jsonError(raw, offset, fmt.Errorf("Unknown key alongside `rules`: %s", key))
+			}
+			if err := expectDelim('['); err != nil {
+				return nil, err
+			}
+			for dec.More() {
+				offset := dec.InputOffset()
+				for offset < int64(len(raw)) && strings.IndexByte(" \t\r\n,", raw[offset]) >= 0 {
+					offset++
+				}
+				var rule MatchRule
+				if err := dec.Decode(&rule); err != nil {
+					if typeErr, isType := err.(*json.UnmarshalTypeError); isType {
+						return nil, jsonError(raw, offset+typeErr.Offset-1, fmt.Errorf("Rule %d: %v", len(entries)+1, err))
+					}
+					return nil, jsonError(raw, offset, fmt.Errorf("Rule %d: %v", len(entries)+1, err))
+				}
+				entry, err := ruleMatchEntry(&rule)
+				if err != nil {
+					return nil, jsonError(raw, offset, fmt.Errorf("Rule %d: %v", len(entries)+1, err))
+				}
+				entries = append(entries, entry)
+			}
+			if err := expectDelim(']'); err != nil {
+				return nil, err
+			}
+		}
+		return entries, nil
+	}
+
+	seen := patternSet{}
+	for dec.More() {
+		field, _ := readKey()
+		if err := expectDelim('{'); err != nil {
+			return nil, err
+		}
+		for dec.More() {
+			pattern, offset := readKey()
+			if err := seen.add(field, pattern); err != nil {
+				return nil, jsonError(raw, offset, err)
+			}
+			var fields map[string]interface{}
+			if err := dec.Decode(&fields); err != nil {
+				return nil, jsonError(raw, offset, fmt.Errorf("%s: %s: Expected an object", field, pattern))
+			}
+			entry, err := legacyMatchEntry(field, pattern, fields)
+			if err != nil {
+				return nil, jsonError(raw, offset, err)
+			}
+			entries = append(entries, entry)
+		}
+		if err := expectDelim('}'); err != nil {
+			return nil, err
+		}
+	}
+	return entries, nil
+}
+
+// yamlTimesToStrings replaces unquoted dates and timestamps in a decoded
+// YAML value with their string form, which JSON would otherwise give as
+// RFC 3339
+func yamlTimesToStrings(value interface{}) interface{} {
+	switch v := value.(type) {
+	case time.Time:
+		return timeValueString(v)
+	case map[string]interface{}:
+		for k, item := range v {
+			v[k] = yamlTimesToStrings(item)
+		}
+	case []interface{}:
+		for i, item := range v {
+			v[i] = yamlTimesToStrings(item)
+		}
+	}
+	return value
+}
+
+func yamlError(node *yaml.Node, err error) error {
+	return &MatchMapError{Line: node.Line, Column: node.Column, Err: err}
+}
+
+// yamlMatchEntries decodes a YAML match map of either format, keeping file
+// order. Rules are validated as their JSON equivalent.
+func yamlMatchEntries(raw []byte) ([]*MatchEntry, error) {
+	var document yaml.Node
+	if err := yaml.Unmarshal(raw, &document); err != nil {
+		return nil, err
+	}
+	if len(document.Content) == 0 {
+		return nil, fmt.Errorf("Empty match map")
+	}
+	top := document.Content[0]
+	if top.Kind != yaml.MappingNode {
+		return nil, yamlError(top, fmt.Errorf("Expected a mapping"))
+	}
+
+	entries := []*MatchEntry{}
+	for i := 0; i < len(top.Content); i += 2 {
+		if top.Content[i].Value == "rules" && top.Content[i+1].Kind == yaml.SequenceNode {
+			if len(top.Content) > 2 {
+				return nil, yamlError(top, fmt.Errorf("Unknown key alongside `rules`"))
+			}
+			for _, node := range top.Content[i+1].Content {
+				var value interface{}
+				if err := node.Decode(&value); err != nil {
+					return nil, yamlError(node, fmt.Errorf("Rule %d: %v", len(entries)+1, err))
+				}
+				asJson, err := json.Marshal(yamlTimesToStrings(value))
+				if err != nil {
+					return nil, yamlError(node, fmt.Errorf("Rule %d: %v", len(entries)+1, err))
+				}
+				var rule MatchRule
+				dec := json.NewDecoder(bytes.NewReader(asJson))
+				dec.DisallowUnknownFields()
+				dec.UseNumber()
+				if err := dec.Decode(&rule); err != nil {
+					return nil, yamlError(node, fmt.Errorf("Rule %d: %v", len(entries)+1, err))
+				}
+				entry, err := ruleMatchEntry(&rule)
+				if err != nil {
+					return nil, yamlError(node, fmt.Errorf("Rule %d: %v", len(entries)+1, err))
+				}
+				entries = append(entries, entry)
+			}
+			return entries, nil
+		}
+	}
+
+	seen := patternSet{}
+	for i := 0; i < len(top.Content); i += 2 {
+		field, patterns := top.Content[i].Value, top.Content[i+1]
+		if patterns.Kind != yaml.MappingNode {
+			return nil, yamlError(patterns, fmt.Errorf("%s: Expected a mapping of patterns", field))
+		}
+		for j := 0; j < len(patterns.Content); j += 2 {
+			patternNode := patterns.Content[j]
+			pattern := patternNode.Value
+			if err := seen.add(field, pattern); err != nil {
+				return nil, yamlError(patternNode, err)
+			}
+			var fields map[string]interface{}
+			if err := patterns.Content[j+1].Decode(&fields); err != nil {
+				return nil, yamlError(patterns.Content[j+1], fmt.Errorf("%s: %s: Expected a mapping", field, pattern))
+			}
+			entry, err := legacyMatchEntry(field, pattern, fields)
+			if err != nil {
+				return nil, yamlError(patternNode, err)
+			}
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
+
+// csvFieldOffsets returns where each field of each record starts in `raw`,
+// splitting it as encoding/csv does: records end at newlines outside
+// quotes, and empty lines are skipped. It only holds for input the reader
+// parses, and stands in for csv.Reader.FieldPos, which needs Go 1.17.
+func csvFieldOffsets(raw []byte) [][]int64 {
+	records := [][]int64{}
+	var fields []int64
+	quoted := false
+	for i := 0; i < len(raw); i++ {
+		if fields == nil {
+			if raw[i] == '\n' || raw[i] == '\r' && i+1 < len(raw) && raw[i+1] == '\n' {
+				continue
+			}
+			fields = []int64{int64(i)}
+		}
+		switch raw[i] {
+		case '"':
+			quoted = !quoted
+		case ',':
+			if !quoted {
+				fields = append(fields, int64(i+1))
+			}
+		case '\n':
+			if !quoted {
+				records = append(records, fields)
+				fields = nil
+			}
+		}
+	}
+	if fields != nil {
+		records = append(records, fields)
+	}
+	return records
+}
+
+// csvMatchEntries decodes a CSV match map with a header row. Patterns in
+// the key column follow the original format (exact, "prefix*" or CIDR),
+// and empty value cells are not added.
+func csvMatchEntries(raw []byte, keyColumn string, valueColumns []string) ([]*MatchEntry, error) {
+	reader := csv.NewReader(bytes.NewReader(raw))
+	csvError := func(err error) error {
+		if parseErr, isParse := err.(*csv.ParseError); isParse {
+			return &MatchMapError{Line: parseErr.Line, Column: parseErr.Column, Err: parseErr.Err}
+		}
+		return err
+	}
+	offsets := csvFieldOffsets(raw)
+	fieldError := func(record int, field int, err error) error {
+		line, column := textPosition(raw, offsets[record][field])
+		return &MatchMapError{Line: line, Column: column, Err: err}
+	}
+
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, fmt.Errorf("Empty match map")
+	}
+	if err != nil {
+		return nil, csvError(err)
+	}
+	columnIndex := func(name string) (int, error) {
+		for i, column := range header {
+			if strings.TrimSpace(column) == name {
+				return i, nil
+			}
+		}
+		return 0, fieldError(0, 0, fmt.Errorf("Missing column: %s", name))
+	}
+
+	keyIndex := 0
+	if len(keyColumn) > 0 {
+		if keyIndex, err = columnIndex(keyColumn); err != nil {
+			return nil, err
+		}
+	}
+	field := strings.TrimSpace(header[keyIndex])
+	valueIndexes := []int{}
+	if len(valueColumns) == 0 {
+		for i := range header {
+			if i != keyIndex {
+				valueIndexes = append(valueIndexes, i)
+			}
+		}
+	}
+	for _, column := range valueColumns {
+		i, err := columnIndex(column)
+		if err != nil {
+			return nil, err
+		}
+		valueIndexes = append(valueIndexes, i)
+	}
+
+	entries := []*MatchEntry{}
+	seen := patternSet{}
+	for n := 1; ; n++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, csvError(err)
+		}
+
+		pattern := strings.TrimSpace(record[keyIndex])
+		if len(pattern) == 0 {
+			return nil, fieldError(n, keyIndex, fmt.Errorf("Empty %s", field))
+		}
+		if err := seen.add(field, pattern); err != nil {
+			return nil, fieldError(n, keyIndex, err)
+		}
+		fields := make(map[string]interface{}, len(valueIndexes))
+		for _, i := range valueIndexes {
+			if value := strings.TrimSpace(record[i]); len(value) > 0 {
+				fields[strings.TrimSpace(header[i])] = value
+			}
+		}
+		entry, err := legacyMatchEntry(field, pattern, fields)
+		if err != nil {
+			return nil, fieldError(n, keyIndex, err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
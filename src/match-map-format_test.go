@@ -0,0 +1,168 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"testing"
+)
+
+// parseTestMatchMap parses a match map, returning its rules in file order
+func parseTestMatchMap(t *testing.T, raw string, format *MatchMapFormat) []*MatchEntry {
+	matchMap, err := parseMatchMap([]byte(raw), format)
+	if err != nil {
+		t.Fatalf("%s: %v", raw, err)
+	}
+	return matchMap.Entries()
+}
+
+// describeEntries summarizes rules as "field kind pattern {fields}"
+func describeEntries(entries []*MatchEntry) []string {
+	described := make([]string, len(entries))
+	for i, entry := range entries {
+		fields := []string{}
+		for k, v := range entry.Fields {
+			fields = append(fields, k+"="+keyString(v))
+		}
+		sort.Strings(fields)
+		described[i] = entry.Field + " " + entry.Kind.String() + " " + entry.Pattern + " {" + strings.Join(fields, ",") + "}"
+		if entry.Drop {
+			described[i] += " drop"
+		}
+	}
+	return described
+}
+
+func checkEntries(t *testing.T, name string, entries []*MatchEntry, want []string) {
+	got := describeEntries(entries)
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("%s: got\n\t%s\nwant\n\t%s", name, strings.Join(got, "\n\t"), strings.Join(want, "\n\t"))
+	}
+}
+
+func TestCsvMatchMap(t *testing.T) {
+	csvFormat := &MatchMapFormat{Format: MATCH_MAP_FORMAT_CSV}
+	raw := "rip,a1, a2\n" +
+		"\n" +
+		"10.0.0.0/8,corp,\n" +
+		"\"192.168.\n1.1\",\"multi\nline\",x\n" +
+		"\r\n" +
+		"app.*,\"quoted, comma\",\"say \"\"hi\"\"\"\n" +
+		"172.16.*,,\n"
+	checkEntries(t, "csv", parseTestMatchMap(t, raw, csvFormat), []string{
+		"rip cidr 10.0.0.0/8 {a1=corp}",
+		"rip exact 192.168.\n1.1 {a1=multi\nline,a2=x}",
+		"rip prefix app. {a1=quoted, comma,a2=say \"hi\"}",
+		"rip prefix 172.16. {}",
+	})
+
+	// a chosen key column and value columns
+	checkEntries(t, "csv columns", parseTestMatchMap(t, "a1,rip,a2\ncorp,10.0.0.1,x\n", &MatchMapFormat{
+		Format:          MATCH_MAP_FORMAT_CSV,
+		CsvKeyColumn:    "rip",
+		CsvValueColumns: []string{"a2"},
+	}), []string{
+		"rip exact 10.0.0.1 {a2=x}",
+	})
+}
+
+func TestJsonAndYamlMatchMaps(t *testing.T) {
+	for _, test := range []struct {
+		format string
+		raw    string
+		want   []string
+	}{
+		{MATCH_MAP_FORMAT_JSON, `{"rip": {"10.0.0.0/8": {"a1": "corp"}, "10.1.*": {"a1": 1}}, "app": {"x": {}}}`, []string{
+			"rip cidr 10.0.0.0/8 {a1=corp}",
+			"rip prefix 10.1. {a1=1}",
+			"app exact x {}",
+		}},
+		{MATCH_MAP_FORMAT_YAML, "rip:\n  10.0.0.0/8: {a1: corp}\n  \"10.1.*\":\n    a1: 1\napp:\n  x: {}\n", []string{
+			"rip cidr 10.0.0.0/8 {a1=corp}",
+			"rip prefix 10.1. {a1=1}",
+			"app exact x {}",
+		}},
+		// unquoted YAML dates are added as written
+		{MATCH_MAP_FORMAT_YAML, "rip:\n  10.0.0.1: {since: 2024-03-01, at: 2024-03-01T10:00:00Z}\n", []string{
+			"rip exact 10.0.0.1 {at=2024-03-01T10:00:00Z,since=2024-03-01}",
+		}},
+		{MATCH_MAP_FORMAT_JSON, `{"rules": [{"field": "rip", "cidr": "10.0.0.0/8", "add": {"a1": "corp"}}, {"field": "debug", "exists": true, "action": "drop"}]}`, []string{
+			"rip cidr 10.0.0.0/8 {a1=corp}",
+			`debug condition {"field":"debug","exists":true} {} drop`,
+		}},
+		{MATCH_MAP_FORMAT_YAML, "rules:\n  - {field: rip, cidr: 10.0.0.0/8, add: {a1: corp}}\n  - field: debug\n    exists: true\n    action: drop\n", []string{
+			"rip cidr 10.0.0.0/8 {a1=corp}",
+			`debug condition {"field":"debug","exists":true} {} drop`,
+		}},
+	} {
+		checkEntries(t, test.format, parseTestMatchMap(t, test.raw, &MatchMapFormat{Format: test.format}), test.want)
+	}
+}
+
+func TestMatchMapErrorPositions(t *testing.T) {
+	for _, test := range []struct {
+		format *MatchMapFormat
+		raw    string
+		want   string
+	}{
+		// CSV positions survive skipped blank lines and quoted newlines
+		{&MatchMapFormat{Format: MATCH_MAP_FORMAT_CSV}, "rip,a1\n\n\"x\ny\",1\n\n10.0.0.1,2\n10.0.0.1,3\n",
+			"line 7, column 1: rip: Duplicate pattern: 10.0.0.1"},
+		{&MatchMapFormat{Format: MATCH_MAP_FORMAT_CSV, CsvKeyColumn: "rip"}, "a1,rip\r\n\r\n\"a\r\nb\",x\r\n2, \r\n",
+			"line 5, column 3: Empty rip"},
+		{&MatchMapFormat{Format: MATCH_MAP_FORMAT_CSV, CsvKeyColumn: "ip"}, "\nrip,a1\n",
+			"line 2, column 1: Missing column: ip"},
+		{&MatchMapFormat{Format: MATCH_MAP_FORMAT_CSV}, "rip,a1\n10.0.0.1,\"x\ny\n",
+			"line 3"},
+		{&MatchMapFormat{Format: MATCH_MAP_FORMAT_CSV}, "rip,a1\n10.0.0.1\n",
+			"line 2"},
+		{&MatchMapFormat{Format: MATCH_MAP_FORMAT_CSV}, "",
+			"Empty match map"},
+		{&MatchMapFormat{Format: MATCH_MAP_FORMAT_JSON}, "{\n  \"rip\": {\n    \"10.0.0.1\": {},\n    \"10.0.0.1\": {}\n  }\n}",
+			"line 4, column 5: rip: Duplicate pattern: 10.0.0.1"},
+		{&MatchMapFormat{Format: MATCH_MAP_FORMAT_JSON}, "{\"rules\": [\n  {\"field\": \"a\", \"exact\": \"x\"},\n  {\"field\": \"a\", \"exact\": \"x\", \"action\": \"keep\"}\n]}",
+			"line 3, column 3: Rule 2: Invalid `action`: keep"},
+		{&MatchMapFormat{Format: MATCH_MAP_FORMAT_JSON}, "{\"rules\": [\n  {\"field\": \"a\", \"exact\": 1}\n]}",
+			"line 2, column 27: Rule 1:"},
+		{&MatchMapFormat{Format: MATCH_MAP_FORMAT_JSON}, "{\n  \"rip\": {\n    \"10.0.0.1\": {\"a\": 1,}\n  }\n}",
+			"line 3, column 25: invalid character"},
+		{&MatchMapFormat{Format: MATCH_MAP_FORMAT_JSON}, "[]",
+			"line 1, column 1: Expected an object"},
+		{&MatchMapFormat{Format: MATCH_MAP_FORMAT_YAML}, "rip:\n  10.0.0.1: {}\n  10.0.0.1: {}\n",
+			"line 3, column 3: rip: Duplicate pattern: 10.0.0.1"},
+		{&MatchMapFormat{Format: MATCH_MAP_FORMAT_YAML}, "rip:\n  10.0.0.1: [1]\n",
+			"line 2, column 13: rip: 10.0.0.1: Expected a mapping"},
+		{&MatchMapFormat{Format: MATCH_MAP_FORMAT_YAML}, "rip: [1]\n",
+			"line 1, column 6: rip: Expected a mapping of patterns"},
+		{&MatchMapFormat{Format: MATCH_MAP_FORMAT_YAML}, "rules:\n  - field: a\n    exact: x\n  - field: a\n    regex: \"(\"\n",
+			"line 4, column 5: Rule 2: a: Invalid regex"},
+		{&MatchMapFormat{Format: MATCH_MAP_FORMAT_YAML}, "rules:\n  - field: a\n    exacly: x\n",
+			"line 2, column 5: Rule 1: json: unknown field \"exacly\""},
+		{&MatchMapFormat{Format: MATCH_MAP_FORMAT_YAML}, "rules: []\nrip: {}\n",
+			"line 1, column 1: Unknown key alongside `rules`"},
+		{&MatchMapFormat{Format: MATCH_MAP_FORMAT_YAML}, "- a\n",
+			"line 1, column 1: Expected a mapping"},
+		{&MatchMapFormat{Format: MATCH_MAP_FORMAT_YAML}, "",
+			"Empty match map"},
+	} {
+		_, err := parseMatchMap([]byte(test.raw), test.format)
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%s %q: got error %v, want %q", test.format.Format, test.raw, err, test.want)
+		}
+	}
+}
+
+func TestCsvFieldOffsets(t *testing.T) {
+	raw := "a,b\n\n\"x\n,y\",\"\"\r\n\r\nlast,"
+	got := csvFieldOffsets([]byte(raw))
+	want := [][]int64{{0, 2}, {5, 12}, {18, 23}}
+	if len(got) != len(want) {
+		t.Fatalf("offsets %v, want %v", got, want)
+	}
+	for i := range want {
+		for j := range want[i] {
+			if len(got[i]) != len(want[i]) || got[i][j] != want[i][j] {
+				t.Fatalf("offsets %v, want %v", got, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	MATCH_MAP_UNMATCHED_DROP    = "drop"
+	MATCH_MAP_UNMATCHED_PASS    = "pass"
+	MATCH_MAP_UNMATCHED_DEFAULT = "default"
+
+	matchMapFetchTimeout = 30 * time.Second
+)
+
+type (
+	// matchMapFetcher returns the raw match map, or nil if it is known not
+	// to have changed since the last call. `force` skips any such check.
+	matchMapFetcher interface {
+		Fetch(force bool) ([]byte, error)
+		Describe() string
+	}
+
+	matchMapFileFetcher struct {
+		filename string
+		modTime  time.Time
+		size     int64
+	}
+
+	// matchMapHttpFetcher makes conditional requests using the ETag and
+	// Last-Modified of the last successful response
+	matchMapHttpFetcher struct {
+		url          string
+		client       *HttpClient
+		etag         string
+		lastModified string
+	}
+
+	// MatchMapSource holds the current match map, and replaces it atomically
+	// when its file or URL changes. Flushes always see a complete map, old
+	// or new.
+	MatchMapSource struct {
+		current   atomic.Value
+		lock      sync.Mutex
+		fetcher   matchMapFetcher
+		format    *MatchMapFormat
+		cacheFile string
+		hash      string
+		version   string
+		// ttlErr rejects maps using `_dedup_ttl` where it cannot apply
+		ttlErr error
+	}
+)
+
+func (f *matchMapFileFetcher) Describe() string {
+	return f.filename
+}
+
+// Fetch reads the file if its modification time or size has changed
+func (f *matchMapFileFetcher) Fetch(force bool) ([]byte, error) {
+	info, err := os.Stat(f.filename)
+	if err != nil {
+		return nil, err
+	}
+	if !force && info.ModTime().Equal(f.modTime) && info.Size() == f.size {
+		return nil, nil
+	}
+	raw, err := ioutil.ReadFile(f.filename)
+	if err != nil {
+		return nil, err
+	}
+	f.modTime = info.ModTime()
+	f.size = info.Size()
+	return raw, nil
+}
+
+func (f *matchMapHttpFetcher) Describe() string {
+	return f.url
+}
+
+func (f *matchMapHttpFetcher) Fetch(force bool) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), matchMapFetchTimeout)
+	defer cancel()
+	request, err := http.NewRequestWithContext(ctx, "GET", f.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("User-Agent", defaultUserAgent)
+	if !force {
+		if len(f.etag) > 0 {
+			request.Header.Set("If-None-Match", f.etag)
+		}
+		if len(f.lastModified) > 0 {
+			request.Header.Set("If-Modified-Since", f.lastModified)
+		}
+	}
+	resp, err := f.client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("HTTP status %d", resp.StatusCode)
+	}
+	raw, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	f.etag = resp.Header.Get("ETag")
+	f.lastModified = resp.Header.Get("Last-Modified")
+	return raw, nil
+}
+
+func newMatchMapSource(conf *Config, log *SimpleLogger) (*MatchMapSource, error) {
+	source := &MatchMapSource{
+		format: conf.matchMapFormat(),
+		ttlErr: dedupTTLOverrideError(conf),
+	}
+	if len(conf.MatchMapUrl) > 0 {
+		hc, err := httpClient()
+		if err != nil {
+			return nil, err
+		}
+		source.fetcher = &matchMapHttpFetcher{
+			url:    conf.MatchMapUrl,
+			client: hc,
+		}
+		source.cacheFile = conf.MatchMapCacheFile
+	} else {
+		source.fetcher = &matchMapFileFetcher{
+			filename: conf.MatchMapFile,
+		}
+	}
+
+	_, cacheErr, err := source.Reload(true)
+	if cacheErr != nil {
+		log.Error.Printf("Match map loaded, but not cached: %v\n", cacheErr)
+	}
+	if err == nil {
+		return source, nil
+	}
+	if len(source.cacheFile) == 0 {
+		return nil, err
+	}
+
+	// the last good copy lets us start while the match map service is down
+	log.Error.Printf("Failed to load match map, trying cache: %v\n", err)
+	raw, cacheErr := ioutil.ReadFile(source.cacheFile)
+	if cacheErr != nil {
+		return nil, fmt.Errorf("%v (cache: %v)", err, cacheErr)
+	}
+	if cacheErr = source.apply(raw); cacheErr != nil {
+		return nil, fmt.Errorf("%v (cache: %s: %v)", err, source.cacheFile, cacheErr)
+	}
+	return source, nil
+}
+
+// Current returns the match map to use for a flush, which is empty if no
+// match map is configured
+func (s *MatchMapSource) Current() *CompiledMatchMap {
+	if s == nil {
+		return nil
+	}
+	return s.current.Load().(*CompiledMatchMap)
+}
+
+// Reload fetches the match map and replaces the current one if its content
+// differs. On error the current map is kept. Returns true if the map was
+// replaced, which it is even if it could not then be cached, as reported by
+// `cacheErr`.
+func (s *MatchMapSource) Reload(force bool) (reloaded bool, cacheErr error, err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	raw, err := s.fetcher.Fetch(force)
+	if err != nil {
+		return false, nil, fmt.Errorf("%s: %v", s.fetcher.Describe(), err)
+	}
+	if raw == nil || s.sameContent(raw) {
+		return false, nil, nil
+	}
+	if err := s.apply(raw); err != nil {
+		return false, nil, fmt.Errorf("%s: %v", s.fetcher.Describe(), err)
+	}
+	if len(s.cacheFile) > 0 {
+		if err := writeFileAtomic(s.cacheFile, raw); err != nil {
+			return true, fmt.Errorf("%s: %v", s.cacheFile, err), nil
+		}
+	}
+	return true, nil, nil
+}
+
+func contentHash(raw []byte) string {
+	sum := sha256.Sum256(raw)
+	return hex.EncodeToString(sum[:])
+}
+
+func (s *MatchMapSource) sameContent(raw []byte) bool {
+	return contentHash(raw) == s.hash
+}
+
+func (s *MatchMapSource) apply(raw []byte) error {
+	matchMap, err := parseMatchMap(raw, s.format)
+	if err != nil {
+		return err
+	}
+	if s.ttlErr != nil {
+		for _, entry := range matchMap.Entries() {
+			if entry.Overrides != nil && entry.Overrides.TTL != nil {
+				return fmt.Errorf("%s: %s: %v", entry.Field, entry.Pattern, s.ttlErr)
+			}
+		}
+	}
+	s.current.Store(matchMap)
+	s.hash = contentHash(raw)
+	s.version = s.hash[:12]
+	if f, isHttp := s.fetcher.(*matchMapHttpFetcher); isHttp && len(f.etag) > 0 {
+		s.version = f.etag
+	}
+	return nil
+}
+
+// Version identifies the current map, by ETag if there is one, otherwise
+// by a prefix of its content hash
+func (s *MatchMapSource) Version() string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.version
+}
+
+// writeFileAtomic replaces a file via a temporary file and rename, so that
+// readers never see a partial file
+func writeFileAtomic(filename string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(filename), filepath.Base(filename)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), filename)
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMatchMapDedupTTLUnsupported(t *testing.T) {
+	dir, err := ioutil.TempDir("", "match-map")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	withTTL := filepath.Join(dir, "ttl.json")
+	ioutil.WriteFile(withTTL, []byte(`{ "rip": { "127.0.0.2": { "a1":"partner", "_dedup_ttl":"3600" } } }`), 0644)
+	withoutTTL := filepath.Join(dir, "plain.json")
+	ioutil.WriteFile(withoutTTL, []byte(`{ "rip": { "127.0.0.2": { "a1":"partner", "_dedup_skip":"true" } } }`), 0644)
+
+	for _, test := range []struct {
+		backend string
+		window  string
+		file    string
+		err     string
+	}{
+		{DEDUP_BACKEND_MEMORY, DEDUP_WINDOW_ROLLING, withTTL, ""},
+		{DEDUP_BACKEND_PROBABILISTIC, DEDUP_WINDOW_ROLLING, withTTL, "`dedup_backend` `probabilistic`"},
+		{DEDUP_BACKEND_MEMORY, DEDUP_WINDOW_CALENDAR, withTTL, "`dedup_window` `calendar`"},
+		{DEDUP_BACKEND_PROBABILISTIC, DEDUP_WINDOW_CALENDAR, withoutTTL, ""},
+	} {
+		conf := &Config{
+			MatchMapFile:   test.file,
+			MatchMapFormat: MATCH_MAP_FORMAT_JSON,
+			DedupBackend:   test.backend,
+			DedupWindow:    test.window,
+		}
+		_, err := newMatchMapSource(conf, Logger("error", ""))
+		if len(test.err) == 0 && err != nil {
+			t.Fatalf("%s/%s: %v", test.backend, test.window, err)
+		}
+		if len(test.err) > 0 && (err == nil || !strings.Contains(err.Error(), test.err)) {
+			t.Fatalf("%s/%s: got %v, want an error mentioning %s", test.backend, test.window, err, test.err)
+		}
+	}
+}
+
+// testCounter returns a counter, which is 0 until first counted
+func testCounter(metrics *Metrics, name string) uint64 {
+	count, _ := metrics.Snapshot()[name].(uint64)
+	return count
+}
+
+// testMatchMapValue returns the `a1` a match map adds to a record with `rip`
+func testMatchMapValue(source *MatchMapSource, rip string) interface{} {
+	_, fields, _ := matchRecordToMatchMap(StringifiedRecordType{"rip": rip}, source.Current())
+	return fields["a1"]
+}
+
+func TestMatchMapReloadKeepsMapOnError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "match-map")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "map.json")
+	write := func(content string, age time.Duration) {
+		if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		// the fetcher notices changes by modification time and size
+		modTime := time.Now().Add(-age)
+		os.Chtimes(file, modTime, modTime)
+	}
+	write(`{ "rip": { "127.0.0.2": { "a1":"first" } } }`, time.Hour)
+
+	log, metrics := Logger("error", ""), newMetrics()
+	source, err := newMatchMapSource(&Config{MatchMapFile: file, MatchMapFormat: MATCH_MAP_FORMAT_JSON}, log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	version := source.Version()
+
+	for i, test := range []struct {
+		content string
+		age     time.Duration
+		want    string
+		reloads uint64
+		errors  uint64
+	}{
+		// unchanged
+		{``, 0, "first", 0, 0},
+		{`{ "rip": { "127.0.0.2": `, 2 * time.Minute, "first", 0, 1},
+		{`{ "rip": { "127.0.0.2": { "a1":"x", "_dedup_ttl":"soon" } } }`, time.Minute, "first", 0, 2},
+		{`{ "rip": { "127.0.0.2": { "a1":"second" } } }`, 0, "second", 1, 2},
+	} {
+		if len(test.content) > 0 {
+			write(test.content, test.age)
+		}
+		reloadMatchMap(log, metrics, source, false)
+		if value := testMatchMapValue(source, "127.0.0.2"); value != test.want {
+			t.Fatalf("step %d: map adds %v, want %s", i, value, test.want)
+		}
+		reloads, errors := testCounter(metrics, METRIC_MATCH_MAP_RELOAD), testCounter(metrics, METRIC_MATCH_MAP_ERROR)
+		if reloads != test.reloads || errors != test.errors {
+			t.Fatalf("step %d: %d reloads and %d errors, want %d and %d", i, reloads, errors, test.reloads, test.errors)
+		}
+	}
+	if source.Version() == version || metrics.Snapshot()[METRIC_MATCH_MAP_VER] != source.Version() {
+		t.Fatalf("version %s (was %s), metric %v", source.Version(), version, metrics.Snapshot()[METRIC_MATCH_MAP_VER])
+	}
+}
+
+// matchMapServer serves a match map with an ETag, answering conditional
+// requests for the current one with 304 Not Modified
+type matchMapServer struct {
+	lock        sync.Mutex
+	body        string
+	etag        string
+	status      int
+	requests    int
+	notModified int
+}
+
+func (m *matchMapServer) set(body string, etag string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.body, m.etag = body, etag
+}
+
+func (m *matchMapServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.requests++
+	if m.status != 0 {
+		w.WriteHeader(m.status)
+		return
+	}
+	if r.Header.Get("If-None-Match") == m.etag {
+		m.notModified++
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("ETag", m.etag)
+	fmt.Fprint(w, m.body)
+}
+
+func TestMatchMapReloadFromUrl(t *testing.T) {
+	dir, err := ioutil.TempDir("", "match-map")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	mapServer := &matchMapServer{}
+	mapServer.set(`{ "rip": { "127.0.0.2": { "a1":"first" } } }`, `"v1"`)
+	server := httptest.NewServer(mapServer)
+	defer server.Close()
+
+	conf := &Config{
+		MatchMapUrl:       server.URL,
+		MatchMapFormat:    MATCH_MAP_FORMAT_JSON,
+		MatchMapCacheFile: filepath.Join(dir, "cache.json"),
+	}
+	log, metrics := Logger("error", ""), newMetrics()
+	source, err := newMatchMapSource(conf, log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if source.Version() != `"v1"` || testMatchMapValue(source, "127.0.0.2") != "first" {
+		t.Fatalf("loaded version %s", source.Version())
+	}
+
+	// unchanged, by ETag
+	reloadMatchMap(log, metrics, source, false)
+	if mapServer.notModified != 1 || testCounter(metrics, METRIC_MATCH_MAP_RELOAD) != 0 {
+		t.Fatalf("%d not modified responses, %d reloads", mapServer.notModified, testCounter(metrics, METRIC_MATCH_MAP_RELOAD))
+	}
+
+	// changed, but the cache cannot be written, which does not undo the
+	// reload
+	mapServer.set(`{ "rip": { "127.0.0.2": { "a1":"second" } } }`, `"v2"`)
+	source.cacheFile = filepath.Join(dir, "missing", "cache.json")
+	reloadMatchMap(log, metrics, source, false)
+	if testMatchMapValue(source, "127.0.0.2") != "second" || metrics.Snapshot()[METRIC_MATCH_MAP_VER] != `"v2"` ||
+		testCounter(metrics, METRIC_MATCH_MAP_RELOAD) != 1 || testCounter(metrics, METRIC_MATCH_MAP_ERROR) != 0 {
+		t.Fatalf("after reload with a failed cache write: %v", metrics.Snapshot())
+	}
+
+	// a forced reload of the same content is not a change
+	reloadMatchMap(log, metrics, source, true)
+	if mapServer.requests != 4 || testCounter(metrics, METRIC_MATCH_MAP_RELOAD) != 1 {
+		t.Fatalf("%d requests, %d reloads", mapServer.requests, testCounter(metrics, METRIC_MATCH_MAP_RELOAD))
+	}
+
+	// the service fails, so the current map is kept
+	mapServer.lock.Lock()
+	mapServer.status = http.StatusInternalServerError
+	mapServer.lock.Unlock()
+	reloadMatchMap(log, metrics, source, false)
+	if testMatchMapValue(source, "127.0.0.2") != "second" || testCounter(metrics, METRIC_MATCH_MAP_ERROR) != 1 {
+		t.Fatalf("after a failed fetch: %v", metrics.Snapshot())
+	}
+
+	// and a new instance starts from the cache written at first load
+	restarted, err := newMatchMapSource(conf, log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if testMatchMapValue(restarted, "127.0.0.2") != "first" {
+		t.Fatalf("cached map adds %v", testMatchMapValue(restarted, "127.0.0.2"))
+	}
+}
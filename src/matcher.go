@@ -0,0 +1,607 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	MATCH_MAP_WILDCARD = "*"
+
+	MATCH_ACTION_ADD  = "add"
+	MATCH_ACTION_DROP = "drop"
+
+	// rule kinds, in order of precedence between rules of equal priority.
+	// Compound rules (all, any, not, exists, missing) are the most specific.
+	MatchCompound MatchKind = iota
+	MatchExact
+	MatchCIDR
+	MatchPrefix
+	MatchGlob
+	MatchRegex
+)
+
+type (
+	MatchKind int
+
+	// MatchCondition tests a record. It is either a test of one field's
+	// value (exact, prefix, cidr, glob or regex), a test of one field's presence
+	// (exists or missing), or a combination of other conditions (all, any
+	// or not).
+	MatchCondition struct {
+		Field   string           `json:"field,omitempty"`
+		Exact   *string          `json:"exact,omitempty"`
+		Prefix  *string          `json:"prefix,omitempty"`
+		CIDR    *string          `json:"cidr,omitempty"`
+		Glob    *string          `json:"glob,omitempty"`
+		Regex   *string          `json:"regex,omitempty"`
+		Exists  bool             `json:"exists,omitempty"`
+		Missing bool             `json:"missing,omitempty"`
+		All     []MatchCondition `json:"all,omitempty"`
+		Any     []MatchCondition `json:"any,omitempty"`
+		Not     *MatchCondition  `json:"not,omitempty"`
+	}
+
+	// MatchRule is one rule of the ordered match map format:
+	//
+	//	{"rules": [
+	//	  {"field": "rip", "cidr": "10.0.0.0/8", "add": {"a1": "corp"}},
+	//	  {"field": "app_id", "regex": "^com\\.(\\w+)\\.", "add": {"a3": "$1"}, "priority": 10},
+	//	  {"all": [{"field": "rip", "cidr": "10.0.0.0/8"}, {"field": "rcc", "exact": "TW"}], "add": {"a1": "tw"}},
+	//	  {"field": "debug", "exists": true, "action": "drop"},
+	//	  {"field": "_tag", "glob": "app.*.prod", "add": {"env": "prod"}}
+	//	]}
+	//
+	// Globs follow path.Match, as in "app.*" or "kube.?". `action` is "add" (the default), or "drop" to discard matching records.
+	MatchRule struct {
+		MatchCondition
+		Priority int                    `json:"priority,omitempty"`
+		Action   string                 `json:"action,omitempty"`
+		Add      map[string]interface{} `json:"add,omitempty"`
+	}
+
+	// matchCondition is a compiled MatchCondition
+	matchCondition struct {
+		field   string
+		kind    MatchKind
+		pattern string
+		re      *regexp.Regexp
+		network *net.IPNet
+		exists  bool
+		missing bool
+		all     []*matchCondition
+		any     []*matchCondition
+		not     *matchCondition
+	}
+
+	// matchCapture is the first regex to match while evaluating a condition,
+	// whose capture groups may be used in added fields
+	matchCapture struct {
+		re         *regexp.Regexp
+		value      string
+		submatches []int
+	}
+
+	// MatchEntry is one compiled rule: the record field and pattern it
+	// matches, and the fields (compiled by compileValue) it adds to
+	// matching records
+	MatchEntry struct {
+		Field       string
+		Pattern     string
+		Kind        MatchKind
+		Priority    int
+		Order       int
+		Specificity int
+		Regexp      *regexp.Regexp
+		Condition   *matchCondition
+		Drop        bool
+		Fields      map[string]interface{}
+		Overrides   *DedupOverrides
+	}
+
+	// fieldMatcher holds every rule for one record field
+	fieldMatcher struct {
+		exact    map[string][]*MatchEntry
+		cidr     PrefixTree
+		prefixes []*MatchEntry
+		globs    []*MatchEntry
+		regexes  []*MatchEntry
+	}
+
+	CompiledMatchMap struct {
+		size       int
+		entries    []*MatchEntry
+		fieldOrder []string
+		fields     map[string]*fieldMatcher
+		compound   []*MatchEntry
+	}
+)
+
+func (k MatchKind) String() string {
+	switch k {
+	case MatchCompound:
+		return "condition"
+	case MatchExact:
+		return "exact"
+	case MatchCIDR:
+		return "cidr"
+	case MatchPrefix:
+		return "prefix"
+	case MatchGlob:
+		return "glob"
+	case MatchRegex:
+		return "regex"
+	}
+	return "unknown"
+}
+
+// before reports whether `e` takes precedence over `other`: higher priority
+// first, then compound before exact before CIDR before prefix before glob
+// before regex, then the longer prefix (or glob with more literal
+// characters), then file order
+func (e *MatchEntry) before(other *MatchEntry) bool {
+	if e.Priority != other.Priority {
+		return e.Priority > other.Priority
+	}
+	if e.Kind != other.Kind {
+		return e.Kind < other.Kind
+	}
+	if e.Specificity != other.Specificity {
+		return e.Specificity > other.Specificity
+	}
+	return e.Order < other.Order
+}
+
+// newMatchEntry compiles a rule. Its added field values are templates
+// within `scope`, along with the capture groups of a regex pattern, or
+// literal if `scope` is nil.
+func newMatchEntry(field string, kind MatchKind, pattern string, fields map[string]interface{}, scope *templateScope) (*MatchEntry, error) {
+	overrides, err := dedupOverridesFromMatchMap(fields)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s: %v", field, pattern, err)
+	}
+	entry := &MatchEntry{
+		Field:     field,
+		Pattern:   pattern,
+		Kind:      kind,
+		Overrides: overrides,
+	}
+	switch kind {
+	case MatchPrefix:
+		entry.Specificity = len(pattern)
+	case MatchCIDR:
+		_, length, isCIDR := parseCIDR(pattern)
+		if !isCIDR {
+			return nil, fmt.Errorf("%s: Invalid CIDR block: %s", field, pattern)
+		}
+		entry.Specificity = length
+	case MatchGlob:
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("%s: Invalid glob: %s", field, pattern)
+		}
+		entry.Specificity = len(pattern) - strings.Count(pattern, "*") - strings.Count(pattern, "?")
+	case MatchRegex:
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("%s: Invalid regex: %v", field, err)
+		}
+		entry.Regexp = re
+		if scope != nil {
+			scope.addGroups(re)
+		}
+	}
+	entry.Fields = make(map[string]interface{}, len(fields))
+	for k, v := range fields {
+		if strings.HasPrefix(k, MATCH_MAP_DEDUP_PREFIX) {
+			continue
+		}
+		if entry.Fields[k], err = compileValue(v, scope); err != nil {
+			return nil, fmt.Errorf("%s: %s: %s: %v", field, pattern, k, err)
+		}
+	}
+	return entry, nil
+}
+
+// legacyMatchEntry builds an entry of the original format, `{field:
+// {pattern: fields}}`. Patterns ending in "*" are prefixes (of what comes
+// before the first "*"), valid CIDR blocks are ranges, and anything else,
+// including "?" or "*" elsewhere, is matched exactly. Globs are only
+// available as `rules`. Added values are copied as they are, never
+// templates.
+func legacyMatchEntry(field string, pattern string, fields map[string]interface{}) (*MatchEntry, error) {
+	kind := MatchExact
+	if strings.HasSuffix(pattern, MATCH_MAP_WILDCARD) {
+		kind = MatchPrefix
+		pattern = strings.Split(pattern, MATCH_MAP_WILDCARD)[0]
+	} else if _, _, isCIDR := parseCIDR(pattern); isCIDR {
+		kind = MatchCIDR
+	}
+	return newMatchEntry(field, kind, pattern, fields, nil)
+}
+
+// valueTest returns the kind and pattern of a condition which tests a
+// field's value, and how many value tests it gives
+func (c *MatchCondition) valueTest() (MatchKind, string, int) {
+	var kind MatchKind
+	var pattern string
+	given := 0
+	for _, test := range []struct {
+		kind    MatchKind
+		pattern *string
+	}{
+		{MatchExact, c.Exact},
+		{MatchPrefix, c.Prefix},
+		{MatchCIDR, c.CIDR},
+		{MatchGlob, c.Glob},
+		{MatchRegex, c.Regex},
+	} {
+		if test.pattern != nil {
+			kind, pattern = test.kind, *test.pattern
+			given++
+		}
+	}
+	return kind, pattern, given
+}
+
+// simple reports whether a condition is a single test of a field's value,
+// which can be indexed
+func (c *MatchCondition) simple() bool {
+	_, _, given := c.valueTest()
+	return given == 1 && !c.Exists && !c.Missing && c.All == nil && c.Any == nil && c.Not == nil
+}
+
+func compileCondition(c *MatchCondition) (*matchCondition, error) {
+	kind, pattern, given := c.valueTest()
+	forms := given
+	for _, present := range []bool{c.Exists, c.Missing, c.All != nil, c.Any != nil, c.Not != nil} {
+		if present {
+			forms++
+		}
+	}
+	if forms != 1 {
+		return nil, fmt.Errorf("Exactly one of `exact`, `prefix`, `cidr`, `glob`, `regex`, `exists`, `missing`, `all`, `any` or `not` is required")
+	}
+
+	compiled := &matchCondition{
+		field:   c.Field,
+		exists:  c.Exists,
+		missing: c.Missing,
+	}
+	switch {
+	case given == 1 || c.Exists || c.Missing:
+		if len(c.Field) == 0 {
+			return nil, fmt.Errorf("Missing `field`")
+		}
+		compiled.kind = kind
+		compiled.pattern = pattern
+		switch {
+		case given == 0:
+		case kind == MatchCIDR:
+			_, network, err := net.ParseCIDR(pattern)
+			if err != nil {
+				return nil, fmt.Errorf("%s: Invalid CIDR block: %s", c.Field, pattern)
+			}
+			compiled.network = network
+		case kind == MatchGlob:
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("%s: Invalid glob: %s", c.Field, pattern)
+			}
+		case kind == MatchRegex:
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				return nil, fmt.Errorf("%s: Invalid regex: %v", c.Field, err)
+			}
+			compiled.re = re
+		}
+	case c.Not != nil:
+		not, err := compileCondition(c.Not)
+		if err != nil {
+			return nil, fmt.Errorf("not: %v", err)
+		}
+		compiled.not = not
+	default:
+		name, children := "all", c.All
+		if c.Any != nil {
+			name, children = "any", c.Any
+		}
+		if len(children) == 0 {
+			return nil, fmt.Errorf("`%s` must not be empty", name)
+		}
+		if len(c.Field) > 0 {
+			return nil, fmt.Errorf("`field` has no effect with `%s`", name)
+		}
+		for i := range children {
+			child, err := compileCondition(&children[i])
+			if err != nil {
+				return nil, fmt.Errorf("%s %d: %v", name, i+1, err)
+			}
+			if c.All != nil {
+				compiled.all = append(compiled.all, child)
+			} else {
+				compiled.any = append(compiled.any, child)
+			}
+		}
+	}
+	return compiled, nil
+}
+
+// eval tests a record against a compiled condition. The first regex to
+// match is recorded in `capture`, unless it is nil.
+func (c *matchCondition) eval(record StringifiedRecordType, capture *matchCapture) bool {
+	switch {
+	case c.not != nil:
+		return !c.not.eval(record, nil)
+	case c.all != nil:
+		for _, child := range c.all {
+			if !child.eval(record, capture) {
+				return false
+			}
+		}
+		return true
+	case c.any != nil:
+		for _, child := range c.any {
+			if child.eval(record, capture) {
+				return true
+			}
+		}
+		return false
+	}
+
+	raw, exists := lookupField(record, c.field)
+	switch {
+	case c.exists:
+		return exists
+	case c.missing:
+		return !exists
+	}
+	value, isScalar := scalarString(raw)
+	if !isScalar {
+		return false
+	}
+	switch c.kind {
+	case MatchExact:
+		return value == c.pattern
+	case MatchPrefix:
+		return strings.HasPrefix(value, c.pattern)
+	case MatchCIDR:
+		ip := net.ParseIP(value)
+		return ip != nil && c.network.Contains(ip)
+	case MatchGlob:
+		matched, _ := path.Match(c.pattern, value)
+		return matched
+	case MatchRegex:
+		submatches := c.re.FindStringSubmatchIndex(value)
+		if submatches != nil && capture != nil && capture.re == nil {
+			*capture = matchCapture{re: c.re, value: value, submatches: submatches}
+		}
+		return submatches != nil
+	}
+	return false
+}
+
+// regexes returns the regexes of a condition which may capture groups for
+// added fields, i.e. those not under `not`
+func (c *matchCondition) regexes() []*regexp.Regexp {
+	var regexes []*regexp.Regexp
+	if c.re != nil {
+		regexes = append(regexes, c.re)
+	}
+	for _, child := range append(c.all, c.any...) {
+		regexes = append(regexes, child.regexes()...)
+	}
+	return regexes
+}
+
+// ruleMatchEntry builds an entry of the ordered `rules` format
+func ruleMatchEntry(rule *MatchRule) (*MatchEntry, error) {
+	var entry *MatchEntry
+	if rule.simple() {
+		kind, pattern, _ := rule.valueTest()
+		if len(rule.Field) == 0 {
+			return nil, fmt.Errorf("Missing `field`")
+		}
+		var err error
+		if entry, err = newMatchEntry(rule.Field, kind, pattern, rule.Add, &templateScope{}); err != nil {
+			return nil, err
+		}
+	} else {
+		condition, err := compileCondition(&rule.MatchCondition)
+		if err != nil {
+			return nil, err
+		}
+		// the condition itself identifies the rule, e.g. in dedup keys
+		description, _ := json.Marshal(rule.MatchCondition)
+		scope := &templateScope{}
+		for _, re := range condition.regexes() {
+			scope.addGroups(re)
+		}
+		if entry, err = newMatchEntry(rule.Field, MatchCompound, string(description), rule.Add, scope); err != nil {
+			return nil, err
+		}
+		entry.Condition = condition
+	}
+	switch rule.Action {
+	case "", MATCH_ACTION_ADD:
+	case MATCH_ACTION_DROP:
+		if len(rule.Add) > 0 {
+			return nil, fmt.Errorf("`add` has no effect with `action` %s", MATCH_ACTION_DROP)
+		}
+		entry.Drop = true
+	default:
+		return nil, fmt.Errorf("Invalid `action`: %s", rule.Action)
+	}
+	entry.Priority = rule.Priority
+	return entry, nil
+}
+
+// compileMatchMap indexes match map entries by field and kind. Entries are
+// numbered in file order, which breaks any remaining ties.
+func compileMatchMap(entries []*MatchEntry) *CompiledMatchMap {
+	compiled := &CompiledMatchMap{
+		size:    len(entries),
+		entries: entries,
+		fields:  make(map[string]*fieldMatcher),
+	}
+	for i, entry := range entries {
+		entry.Order = i
+		if entry.Kind == MatchCompound {
+			compiled.compound = append(compiled.compound, entry)
+			continue
+		}
+		fm, exists := compiled.fields[entry.Field]
+		if !exists {
+			fm = &fieldMatcher{
+				exact: make(map[string][]*MatchEntry),
+			}
+			compiled.fields[entry.Field] = fm
+			compiled.fieldOrder = append(compiled.fieldOrder, entry.Field)
+		}
+		switch entry.Kind {
+		case MatchExact:
+			fm.exact[entry.Pattern] = append(fm.exact[entry.Pattern], entry)
+		case MatchCIDR:
+			key, length, _ := parseCIDR(entry.Pattern)
+			fm.cidr.Insert(key, length, entry)
+		case MatchPrefix:
+			fm.prefixes = append(fm.prefixes, entry)
+		case MatchGlob:
+			fm.globs = append(fm.globs, entry)
+		case MatchRegex:
+			fm.regexes = append(fm.regexes, entry)
+		}
+	}
+	sort.SliceStable(compiled.compound, func(i, j int) bool {
+		return compiled.compound[i].before(compiled.compound[j])
+	})
+	for _, fm := range compiled.fields {
+		sort.SliceStable(fm.prefixes, func(i, j int) bool {
+			return fm.prefixes[i].before(fm.prefixes[j])
+		})
+		sort.SliceStable(fm.globs, func(i, j int) bool {
+			return fm.globs[i].before(fm.globs[j])
+		})
+		sort.SliceStable(fm.regexes, func(i, j int) bool {
+			return fm.regexes[i].before(fm.regexes[j])
+		})
+	}
+	return compiled
+}
+
+// Len returns the number of rules in the map
+func (m *CompiledMatchMap) Len() int {
+	return m.size
+}
+
+// Entries returns the rules in file order
+func (m *CompiledMatchMap) Entries() []*MatchEntry {
+	return m.entries
+}
+
+// best returns the rule for `value` which takes precedence, and any regex
+// submatch indexes for it
+func (fm *fieldMatcher) best(value string) (*MatchEntry, []int) {
+	var best *MatchEntry
+	var submatches []int
+	consider := func(entry *MatchEntry) bool {
+		if best == nil || entry.before(best) {
+			best = entry
+			return true
+		}
+		return false
+	}
+	for _, entry := range fm.exact[value] {
+		consider(entry)
+	}
+	if fm.cidr.Len() > 0 {
+		if ip := net.ParseIP(value); ip != nil {
+			for _, entry := range fm.cidr.LookupAll(ip) {
+				consider(entry)
+			}
+		}
+	}
+	for _, entry := range fm.prefixes {
+		if strings.HasPrefix(value, entry.Pattern) {
+			// sorted by precedence, so the first match is the best
+			consider(entry)
+			break
+		}
+	}
+	for _, entry := range fm.globs {
+		if best != nil && !entry.before(best) {
+			break
+		}
+		if matched, _ := path.Match(entry.Pattern, value); matched {
+			consider(entry)
+			break
+		}
+	}
+	for _, entry := range fm.regexes {
+		if best != nil && !entry.before(best) {
+			break
+		}
+		if match := entry.Regexp.FindStringSubmatchIndex(value); match != nil {
+			consider(entry)
+			submatches = match
+			break
+		}
+	}
+	if best != nil && best.Kind != MatchRegex {
+		submatches = nil
+	}
+	return best, submatches
+}
+
+// matchRecordToMatchMap returns the match map entry for a record, if any,
+// and the fields it adds, rendered for this record
+func matchRecordToMatchMap(stringifiedRecord StringifiedRecordType, matchMap *CompiledMatchMap) (*MatchEntry, map[string]interface{}, bool) {
+	if matchMap == nil {
+		return nil, nil, false
+	}
+	var best *MatchEntry
+	var capture matchCapture
+	for _, field := range matchMap.fieldOrder {
+		raw, _ := lookupField(stringifiedRecord, field)
+		value, isScalar := scalarString(raw)
+		if !isScalar {
+			continue
+		}
+		if entry, submatches := matchMap.fields[field].best(value); entry != nil && (best == nil || entry.before(best)) {
+			best = entry
+			capture = matchCapture{re: entry.Regexp, value: value, submatches: submatches}
+		}
+	}
+	for _, entry := range matchMap.compound {
+		if best != nil && !entry.before(best) {
+			// sorted by precedence, so no later rule can win
+			break
+		}
+		var entryCapture matchCapture
+		if entry.Condition.eval(stringifiedRecord, &entryCapture) {
+			best, capture = entry, entryCapture
+			break
+		}
+	}
+	if best == nil {
+		return nil, nil, false
+	}
+
+	ctx := &templateContext{
+		record:  stringifiedRecord,
+		capture: &capture,
+		now:     time.Now(),
+	}
+	if best.Kind != MatchCompound {
+		ctx.matched = capture.value
+	}
+	fields := make(map[string]interface{}, len(best.Fields))
+	for k, v := range best.Fields {
+		fields[k] = renderValue(v, ctx)
+	}
+	return best, fields, true
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// testMatchMap compiles a JSON match map
+func testMatchMap(t *testing.T, raw string) *CompiledMatchMap {
+	matchMap, err := parseMatchMap([]byte(raw), &MatchMapFormat{Format: MATCH_MAP_FORMAT_JSON})
+	if err != nil {
+		t.Fatalf("%s: %v", raw, err)
+	}
+	return matchMap
+}
+
+// matchedRule returns the `rule` field added by the rule a record matches,
+// or "" if none does
+func matchedRule(matchMap *CompiledMatchMap, record StringifiedRecordType) string {
+	_, fields, matched := matchRecordToMatchMap(record, matchMap)
+	if !matched {
+		return ""
+	}
+	rule, _ := fields["rule"].(string)
+	return rule
+}
+
+func TestMatchPrecedence(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		rules  string
+		record StringifiedRecordType
+		want   string
+	}{
+		{"exact before cidr, prefix and regex", `
+			{"field": "rip", "regex": "^10\\.", "add": {"rule": "regex"}},
+			{"field": "rip", "prefix": "10.", "add": {"rule": "prefix"}},
+			{"field": "rip", "cidr": "10.0.0.0/8", "add": {"rule": "cidr"}},
+			{"field": "rip", "exact": "10.1.2.3", "add": {"rule": "exact"}}`,
+			StringifiedRecordType{"rip": "10.1.2.3"}, "exact"},
+		{"cidr before prefix and regex", `
+			{"field": "rip", "regex": "^10\\.", "add": {"rule": "regex"}},
+			{"field": "rip", "prefix": "10.", "add": {"rule": "prefix"}},
+			{"field": "rip", "cidr": "10.0.0.0/8", "add": {"rule": "cidr"}},
+			{"field": "rip", "exact": "10.1.2.3", "add": {"rule": "exact"}}`,
+			StringifiedRecordType{"rip": "10.1.2.4"}, "cidr"},
+		{"prefix before glob and regex", `
+			{"field": "rip", "regex": "^10\\.", "add": {"rule": "regex"}},
+			{"field": "rip", "glob": "10.*", "add": {"rule": "glob"}},
+			{"field": "rip", "prefix": "10.", "add": {"rule": "prefix"}},
+			{"field": "rip", "cidr": "10.0.0.0/8", "add": {"rule": "cidr"}}`,
+			StringifiedRecordType{"rip": "10.x"}, "prefix"},
+		{"glob before regex", `
+			{"field": "rip", "regex": "^10\\.", "add": {"rule": "regex"}},
+			{"field": "rip", "glob": "10.*", "add": {"rule": "glob"}}`,
+			StringifiedRecordType{"rip": "10.x"}, "glob"},
+		{"regex", `
+			{"field": "rip", "regex": "^10\\.", "add": {"rule": "regex"}},
+			{"field": "rip", "prefix": "11", "add": {"rule": "prefix"}}`,
+			StringifiedRecordType{"rip": "10.x"}, "regex"},
+		{"longest prefix", `
+			{"field": "app", "prefix": "com.", "add": {"rule": "short"}},
+			{"field": "app", "prefix": "com.example.", "add": {"rule": "long"}},
+			{"field": "app", "prefix": "com.ex", "add": {"rule": "middle"}}`,
+			StringifiedRecordType{"app": "com.example.app"}, "long"},
+		{"narrowest cidr", `
+			{"field": "rip", "cidr": "10.0.0.0/8", "add": {"rule": "8"}},
+			{"field": "rip", "cidr": "10.1.0.0/16", "add": {"rule": "16"}},
+			{"field": "rip", "cidr": "0.0.0.0/0", "add": {"rule": "0"}}`,
+			StringifiedRecordType{"rip": "10.1.2.3"}, "16"},
+		{"most literal glob", `
+			{"field": "_tag", "glob": "app.*", "add": {"rule": "app"}},
+			{"field": "_tag", "glob": "app.*.prod", "add": {"rule": "prod"}}`,
+			StringifiedRecordType{"_tag": "app.web.prod"}, "prod"},
+		{"first regex in file order", `
+			{"field": "app", "regex": "b", "add": {"rule": "b"}},
+			{"field": "app", "regex": "a", "add": {"rule": "a"}}`,
+			StringifiedRecordType{"app": "ab"}, "b"},
+		{"priority before kind", `
+			{"field": "rip", "exact": "10.1.2.3", "add": {"rule": "exact"}},
+			{"field": "rip", "regex": "^10\\.", "add": {"rule": "regex"}, "priority": 1}`,
+			StringifiedRecordType{"rip": "10.1.2.3"}, "regex"},
+		{"priority before specificity", `
+			{"field": "rip", "cidr": "10.1.0.0/16", "add": {"rule": "16"}},
+			{"field": "rip", "cidr": "10.0.0.0/8", "add": {"rule": "8"}, "priority": 1}`,
+			StringifiedRecordType{"rip": "10.1.2.3"}, "8"},
+		{"negative priority", `
+			{"field": "rip", "exact": "10.1.2.3", "add": {"rule": "exact"}, "priority": -1},
+			{"field": "rip", "regex": "^10\\.", "add": {"rule": "regex"}}`,
+			StringifiedRecordType{"rip": "10.1.2.3"}, "regex"},
+		// across fields, rules compete in the same way
+		{"file order across fields", `
+			{"field": "b", "exact": "1", "add": {"rule": "b"}},
+			{"field": "a", "exact": "1", "add": {"rule": "a"}}`,
+			StringifiedRecordType{"a": "1", "b": "1"}, "b"},
+		{"kind across fields", `
+			{"field": "b", "prefix": "1", "add": {"rule": "b"}},
+			{"field": "a", "exact": "1", "add": {"rule": "a"}}`,
+			StringifiedRecordType{"a": "1", "b": "1"}, "a"},
+		{"priority across fields", `
+			{"field": "b", "exact": "1", "add": {"rule": "b"}},
+			{"field": "a", "regex": "1", "add": {"rule": "a"}, "priority": 2}`,
+			StringifiedRecordType{"a": "1", "b": "1"}, "a"},
+		{"only fields present", `
+			{"field": "b", "exact": "1", "add": {"rule": "b"}},
+			{"field": "a", "regex": "1", "add": {"rule": "a"}}`,
+			StringifiedRecordType{"a": "1"}, "a"},
+		// conditions come before single tests
+		{"condition before exact", `
+			{"field": "rip", "exact": "10.1.2.3", "add": {"rule": "exact"}},
+			{"all": [{"field": "rip", "cidr": "10.0.0.0/8"}], "add": {"rule": "all"}}`,
+			StringifiedRecordType{"rip": "10.1.2.3"}, "all"},
+		{"priority before condition", `
+			{"all": [{"field": "rip", "cidr": "10.0.0.0/8"}], "add": {"rule": "all"}},
+			{"field": "rip", "regex": "^10", "add": {"rule": "regex"}, "priority": 1}`,
+			StringifiedRecordType{"rip": "10.1.2.3"}, "regex"},
+		{"first condition in file order", `
+			{"any": [{"field": "b", "exists": true}], "add": {"rule": "b"}},
+			{"any": [{"field": "a", "exists": true}], "add": {"rule": "a"}}`,
+			StringifiedRecordType{"a": "1", "b": "1"}, "b"},
+		{"failing condition", `
+			{"all": [{"field": "rip", "cidr": "10.0.0.0/8"}, {"field": "rcc", "exact": "TW"}], "add": {"rule": "all"}},
+			{"field": "rip", "regex": "^10", "add": {"rule": "regex"}}`,
+			StringifiedRecordType{"rip": "10.1.2.3", "rcc": "JP"}, "regex"},
+		{"no match", `
+			{"field": "rip", "cidr": "10.0.0.0/8", "add": {"rule": "cidr"}}`,
+			StringifiedRecordType{"rip": "11.1.2.3"}, ""},
+	} {
+		matchMap := testMatchMap(t, `{"rules": [`+test.rules+`]}`)
+		if got := matchedRule(matchMap, test.record); got != test.want {
+			t.Errorf("%s: matched %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestMatchConditions(t *testing.T) {
+	for _, test := range []struct {
+		condition string
+		matches   []StringifiedRecordType
+		misses    []StringifiedRecordType
+	}{
+		{`"all": [{"field": "rip", "cidr": "10.0.0.0/8"}, {"field": "rcc", "exact": "TW"}]`,
+			[]StringifiedRecordType{{"rip": "10.1.2.3", "rcc": "TW"}},
+			[]StringifiedRecordType{{"rip": "10.1.2.3", "rcc": "JP"}, {"rip": "11.1.2.3", "rcc": "TW"}, {"rcc": "TW"}}},
+		{`"any": [{"field": "rcc", "exact": "TW"}, {"field": "rcc", "exact": "JP"}]`,
+			[]StringifiedRecordType{{"rcc": "TW"}, {"rcc": "JP"}},
+			[]StringifiedRecordType{{"rcc": "KR"}, {}}},
+		{`"not": {"field": "rcc", "exact": "TW"}`,
+			[]StringifiedRecordType{{"rcc": "JP"}, {}},
+			[]StringifiedRecordType{{"rcc": "TW"}}},
+		{`"field": "debug", "exists": true`,
+			[]StringifiedRecordType{{"debug": true}, {"debug": nil}, {"debug": map[string]interface{}{}}},
+			[]StringifiedRecordType{{}, {"other": 1}}},
+		{`"field": "debug", "missing": true`,
+			[]StringifiedRecordType{{}, {"other": 1}},
+			[]StringifiedRecordType{{"debug": false}, {"debug": nil}}},
+		{`"field": "req.user.id", "exists": true`,
+			[]StringifiedRecordType{{"req": map[string]interface{}{"user": map[string]interface{}{"id": int64(1)}}}},
+			[]StringifiedRecordType{{"req": map[string]interface{}{"user": "x"}}, {"req": map[string]interface{}{}}}},
+		{`"all": [{"field": "a", "exists": true}, {"not": {"any": [{"field": "b", "exists": true}, {"field": "c", "prefix": "x"}]}}]`,
+			[]StringifiedRecordType{{"a": 1}, {"a": 1, "c": "yx"}},
+			[]StringifiedRecordType{{"a": 1, "b": 1}, {"a": 1, "c": "xy"}, {"c": "y"}}},
+		// value tests match scalars, by their string form
+		{`"field": "n", "exact": "7"`,
+			[]StringifiedRecordType{{"n": int64(7)}, {"n": "7"}},
+			[]StringifiedRecordType{{"n": []interface{}{"7"}}, {"n": map[string]interface{}{"7": 7}}, {"n": nil}}},
+		{`"field": "n", "glob": "tr?e"`,
+			[]StringifiedRecordType{{"n": true}},
+			[]StringifiedRecordType{{"n": false}}},
+	} {
+		matchMap := testMatchMap(t, `{"rules": [{`+test.condition+`, "add": {"rule": "x"}}]}`)
+		for _, record := range test.matches {
+			if matchedRule(matchMap, record) != "x" {
+				t.Errorf("{%s} did not match %v", test.condition, record)
+			}
+		}
+		for _, record := range test.misses {
+			if matchedRule(matchMap, record) != "" {
+				t.Errorf("{%s} matched %v", test.condition, record)
+			}
+		}
+	}
+}
+
+func TestMatchDrop(t *testing.T) {
+	matchMap := testMatchMap(t, `{"rules": [
+		{"field": "debug", "exists": true, "action": "drop"},
+		{"field": "rip", "cidr": "10.0.0.0/8", "action": "drop", "priority": 1},
+		{"field": "rip", "prefix": "", "action": "add", "add": {"rule": "kept"}}
+	]}`)
+	for _, test := range []struct {
+		record StringifiedRecordType
+		drop   bool
+	}{
+		{StringifiedRecordType{"rip": "11.1.2.3"}, false},
+		{StringifiedRecordType{"rip": "11.1.2.3", "debug": 1}, true},
+		{StringifiedRecordType{"rip": "10.1.2.3"}, true},
+	} {
+		entry, fields, matched := matchRecordToMatchMap(test.record, matchMap)
+		if !matched || entry.Drop != test.drop {
+			t.Errorf("%v: matched %v, drop %v, want drop %v", test.record, matched, matched && entry.Drop, test.drop)
+		}
+		if test.drop && len(fields) != 0 {
+			t.Errorf("%v: dropped, but adds %v", test.record, fields)
+		}
+	}
+}
+
+func TestMatchRuleErrors(t *testing.T) {
+	for _, test := range []struct {
+		rule string
+		want string
+	}{
+		{`{"field": "a", "exact": "x", "action": "drop", "add": {"b": 1}}`, "`add` has no effect with `action` drop"},
+		{`{"field": "a", "exact": "x", "action": "discard"}`, "Invalid `action`: discard"},
+		{`{"exact": "x"}`, "Missing `field`"},
+		{`{"field": "a"}`, "Exactly one of"},
+		{`{"field": "a", "exact": "x", "prefix": "x"}`, "Exactly one of"},
+		{`{"field": "a", "exact": "x", "exists": true}`, "Exactly one of"},
+		{`{"all": []}`, "`all` must not be empty"},
+		{`{"field": "a", "any": [{"field": "b", "exists": true}]}`, "`field` has no effect with `any`"},
+		{`{"all": [{"field": "a", "exists": true}, {"exists": true}]}`, "all 2: Missing `field`"},
+		{`{"not": {"field": "a", "cidr": "10.0.0.0/33"}}`, "not: a: Invalid CIDR block"},
+		{`{"field": "a", "glob": "["}`, "a: Invalid glob"},
+		{`{"field": "a", "regex": "("}`, "a: Invalid regex"},
+	} {
+		_, err := parseMatchMap([]byte(`{"rules": [`+test.rule+`]}`), &MatchMapFormat{Format: MATCH_MAP_FORMAT_JSON})
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%s: got error %v, want %q", test.rule, err, test.want)
+		}
+	}
+}
+
+func TestLegacyPatterns(t *testing.T) {
+	matchMap := testMatchMap(t, `{
+		"app": {
+			"a?c": {"rule": "question mark"},
+			"x*y": {"rule": "inner star"},
+			"com.*.test*": {"rule": "two stars"},
+			"[ab]": {"rule": "brackets"}
+		},
+		"rip": {
+			"10.0.0.0/8": {"rule": "cidr"},
+			"*": {"rule": "any"}
+		}
+	}`)
+	for _, test := range []struct {
+		record StringifiedRecordType
+		want   string
+	}{
+		// "?", "*" before the end and brackets are literal
+		{StringifiedRecordType{"app": "a?c"}, "question mark"},
+		{StringifiedRecordType{"app": "abc"}, ""},
+		{StringifiedRecordType{"app": "x*y"}, "inner star"},
+		{StringifiedRecordType{"app": "xzy"}, ""},
+		{StringifiedRecordType{"app": "[ab]"}, "brackets"},
+		{StringifiedRecordType{"app": "a"}, ""},
+		// a trailing "*" is a prefix of what comes before the first "*"
+		{StringifiedRecordType{"app": "com.other"}, "two stars"},
+		{StringifiedRecordType{"app": "com."}, "two stars"},
+		{StringifiedRecordType{"rip": "10.1.2.3"}, "cidr"},
+		{StringifiedRecordType{"rip": "anything"}, "any"},
+	} {
+		if got := matchedRule(matchMap, test.record); got != test.want {
+			t.Errorf("%v: matched %q, want %q", test.record, got, test.want)
+		}
+	}
+	for _, entry := range matchMap.Entries() {
+		if entry.Kind == MatchGlob {
+			t.Errorf("legacy pattern %s is a glob", entry.Pattern)
+		}
+	}
+}
+
+func TestTagMatching(t *testing.T) {
+	rules := testMatchMap(t, `{"rules": [
+		{"field": "_tag", "glob": "app.*.prod", "add": {"rule": "prod"}},
+		{"field": "_tag", "glob": "app.*", "add": {"rule": "app"}},
+		{"field": "_tag", "glob": "kube.?", "add": {"rule": "kube"}},
+		{"field": "_tag", "glob": "clean_[0-9].test", "action": "drop"},
+		{"field": "_tag", "exact": "app.web.prod", "add": {"rule": "exact"}}
+	]}`)
+	legacy := testMatchMap(t, `{"_tag": {"app.*": {"rule": "legacy prefix"}, "kube.?": {"rule": "legacy exact"}}}`)
+	for _, test := range []struct {
+		tag    string
+		rules  string
+		legacy string
+	}{
+		{"app.web.prod", "exact", "legacy prefix"},
+		{"app.api.prod", "prod", "legacy prefix"},
+		{"app.web.dev", "app", "legacy prefix"},
+		{"app.", "app", "legacy prefix"},
+		{"kube.a", "kube", ""},
+		{"kube.ab", "", ""},
+		{"kube.?", "kube", "legacy exact"},
+		{"other", "", ""},
+	} {
+		pi := newTestPInstance(t, &Config{})
+		record := StringifiedRecordType{"v": 1}
+		release := pi.exposeTag(record, test.tag)
+		if got := matchedRule(rules, record); got != test.rules {
+			t.Errorf("%s: rules matched %q, want %q", test.tag, got, test.rules)
+		}
+		if got := matchedRule(legacy, record); got != test.legacy {
+			t.Errorf("%s: legacy map matched %q, want %q", test.tag, got, test.legacy)
+		}
+		release()
+	}
+
+	entry, _, matched := matchRecordToMatchMap(StringifiedRecordType{"_tag": "clean_1.test"}, rules)
+	if !matched || !entry.Drop {
+		t.Fatalf("clean_1.test not dropped")
+	}
+}
+
+func TestExposeTag(t *testing.T) {
+	for _, test := range []struct {
+		tagKey string
+		record StringifiedRecordType
+		want   StringifiedRecordType
+	}{
+		{"", StringifiedRecordType{"v": 1}, StringifiedRecordType{"v": 1}},
+		{"fluent_tag", StringifiedRecordType{"v": 1}, StringifiedRecordType{"v": 1, "fluent_tag": "app.web"}},
+		// a real `_tag` field is hidden while matching, then restored
+		{"", StringifiedRecordType{"_tag": "real"}, StringifiedRecordType{"_tag": "real"}},
+		{"_tag", StringifiedRecordType{"_tag": "real"}, StringifiedRecordType{"_tag": "app.web"}},
+		// `tag_key` replaces a field of the same name
+		{"v", StringifiedRecordType{"v": 1}, StringifiedRecordType{"v": "app.web"}},
+	} {
+		pi := newTestPInstance(t, &Config{TagKey: test.tagKey})
+		release := pi.exposeTag(test.record, "app.web")
+		if test.record[RECORD_TAG_FIELD] != "app.web" {
+			t.Fatalf("%v: tag not exposed", test.record)
+		}
+		key, err := generateDeduplicationKeyFromRecordValues([]string{RECORD_TAG_FIELD}, test.record, nil)
+		if err != nil || key != "app.web" {
+			t.Fatalf("%v: dedup key %q, %v", test.record, key, err)
+		}
+		release()
+		// releasing is idempotent
+		release()
+		if len(test.record) != len(test.want) {
+			t.Errorf("tag_key %q: record %v, want %v", test.tagKey, test.record, test.want)
+		}
+		for k, v := range test.want {
+			if test.record[k] != v {
+				t.Errorf("tag_key %q: record %v, want %v", test.tagKey, test.record, test.want)
+			}
+		}
+	}
+}
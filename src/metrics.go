@@ -0,0 +1,96 @@
+package main
+
+import (
+	"sync"
+)
+
+const (
+	METRIC_DEDUP_HIT      = "dedup_hit"
+	METRIC_DEDUP_MISS     = "dedup_miss"
+	METRIC_DEDUP_EXPIRED  = "dedup_expired"
+	METRIC_DEDUP_EVICTED  = "dedup_evicted"
+	METRIC_DEDUP_CHANGED  = "dedup_changed"
+	METRIC_DEDUP_NO_KEY   = "dedup_missing_key"
+	METRIC_DEDUP_SKIPPED  = "dedup_skipped"
+	METRIC_SHARED_HIT     = "dedup_shared_hit"
+	METRIC_SHARED_ERROR   = "dedup_shared_error"
+	METRIC_RECORDS_SENT   = "records_sent"
+	METRIC_RECORDS_REJECT = "records_rejected"
+	METRIC_SUMMARIES_SENT = "summaries_sent"
+
+	METRIC_MATCH_MAP_RELOAD = "match_map_reloads"
+	METRIC_MATCH_MAP_ERROR  = "match_map_reload_errors"
+	METRIC_MATCH_MAP_VER    = "match_map_version"
+
+	METRIC_RECORDS_TOO_OLD         = "records_too_old"
+	METRIC_RECORDS_TOO_NEW         = "records_too_new"
+	METRIC_LATE_DROPPED            = "late_records_dropped"
+	METRIC_LATE_SENT_WITHOUT_DEDUP = "late_records_sent_without_dedup"
+	METRIC_LATE_CLAMPED            = "late_records_clamped"
+	METRIC_TIME_SOURCE_FALLBACK    = "time_source_fallbacks"
+
+	METRIC_MATCH_MAP_UNMATCHED = "match_map_unmatched"
+	METRIC_MATCH_MAP_DROPPED   = "match_map_dropped"
+
+	METRIC_PROBABILISTIC_CAPACITY = "probabilistic_window_capacity"
+	METRIC_PROBABILISTIC_FILL     = "probabilistic_window_fill"
+	METRIC_PROBABILISTIC_KEYS     = "probabilistic_window_keys"
+	METRIC_PROBABILISTIC_FP_RATE  = "probabilistic_false_positive_rate"
+)
+
+type (
+	Metrics struct {
+		lock     sync.Mutex
+		counters map[string]uint64
+		gauges   map[string]float64
+		info     map[string]string
+	}
+)
+
+func newMetrics() *Metrics {
+	return &Metrics{
+		counters: make(map[string]uint64),
+		gauges:   make(map[string]float64),
+		info:     make(map[string]string),
+	}
+}
+
+func (m *Metrics) Add(name string, n uint64) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.counters[name] += n
+}
+
+func (m *Metrics) Inc(name string) {
+	m.Add(name, 1)
+}
+
+// Set records the current value of a gauge
+func (m *Metrics) Set(name string, v float64) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.gauges[name] = v
+}
+
+// SetInfo records a descriptive value, such as a version
+func (m *Metrics) SetInfo(name string, v string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.info[name] = v
+}
+
+func (m *Metrics) Snapshot() map[string]interface{} {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	snapshot := make(map[string]interface{}, len(m.counters)+len(m.gauges)+len(m.info))
+	for k, v := range m.counters {
+		snapshot[k] = v
+	}
+	for k, v := range m.gauges {
+		snapshot[k] = v
+	}
+	for k, v := range m.info {
+		snapshot[k] = v
+	}
+	return snapshot
+}
@@ -0,0 +1,890 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+type (
+	// jsonSchema is a compiled JSON Schema (draft 7 or later). The
+	// validation keywords in compileObject are supported, and annotations
+	// (schemaAnnotations) ignored; any other keyword, such as `$dynamicRef`
+	// or a misspelling, fails compilation rather than go unchecked. `$ref`
+	// may only point within the file.
+	jsonSchema struct {
+		always               *bool
+		ref                  *jsonSchema
+		types                []string
+		enum                 []interface{}
+		constant             interface{}
+		hasConst             bool
+		properties           map[string]*jsonSchema
+		patternProperties    []patternSchema
+		additionalProperties *jsonSchema
+		required             []string
+		minProperties        *int
+		maxProperties        *int
+		items                *jsonSchema
+		prefixItems          []*jsonSchema
+		minItems             *int
+		maxItems             *int
+		uniqueItems          bool
+		minLength            *int
+		maxLength            *int
+		pattern              *regexp.Regexp
+		minimum              *float64
+		maximum              *float64
+		exclusiveMinimum     *float64
+		exclusiveMaximum     *float64
+		multipleOf           *float64
+		allOf                []*jsonSchema
+		anyOf                []*jsonSchema
+		oneOf                []*jsonSchema
+		not                  *jsonSchema
+
+		ifSchema              *jsonSchema
+		thenSchema            *jsonSchema
+		elseSchema            *jsonSchema
+		contains              *jsonSchema
+		minContains           *int
+		maxContains           *int
+		propertyNames         *jsonSchema
+		dependencies          []propertyDependency
+		unevaluatedProperties *jsonSchema
+		unevaluatedItems      *jsonSchema
+	}
+
+	patternSchema struct {
+		re     *regexp.Regexp
+		schema *jsonSchema
+	}
+
+	// propertyDependency applies when an object has the property `name`:
+	// from `dependentRequired` (or an array in `dependencies`) it requires
+	// other properties, and from `dependentSchemas` (or a schema in
+	// `dependencies`) the object must match a schema
+	propertyDependency struct {
+		name     string
+		required []string
+		schema   *jsonSchema
+	}
+
+	// schemaEvaluation records which properties and items of a value the
+	// keywords of a schema, and of the schemas it applies in place (such as
+	// `allOf` or `$ref`), have evaluated, for `unevaluatedProperties` and
+	// `unevaluatedItems`. A nil evaluation records nothing.
+	schemaEvaluation struct {
+		properties map[string]bool
+		items      map[int]bool
+		allItems   bool
+	}
+
+	schemaCompiler struct {
+		root interface{}
+		refs map[string]*jsonSchema
+	}
+
+	// SchemaError is a validation failure at a JSON pointer in a record
+	SchemaError struct {
+		Path string
+		Err  string
+	}
+)
+
+func (e *SchemaError) Error() string {
+	path := e.Path
+	if len(path) == 0 {
+		path = "/"
+	}
+	return fmt.Sprintf("%s: %s", path, e.Err)
+}
+
+// schemaAnnotations are keywords which never constrain a value
+var schemaAnnotations = map[string]bool{
+	"$schema":          true,
+	"$id":              true,
+	"id":               true,
+	"$comment":         true,
+	"title":            true,
+	"description":      true,
+	"default":          true,
+	"examples":         true,
+	"format":           true,
+	"readOnly":         true,
+	"writeOnly":        true,
+	"deprecated":       true,
+	"contentEncoding":  true,
+	"contentMediaType": true,
+}
+
+func loadOutputSchema(path string) (*jsonSchema, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return compileOutputSchema(raw)
+}
+
+func compileOutputSchema(raw []byte) (*jsonSchema, error) {
+	var root interface{}
+	if err := decodeJsonNumbers(raw, &root); err != nil {
+		return nil, err
+	}
+	c := &schemaCompiler{root: root, refs: make(map[string]*jsonSchema)}
+	return c.compile(root, "#")
+}
+
+// decodeJsonNumbers decodes JSON keeping numbers as json.Number
+func decodeJsonNumbers(raw []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	return dec.Decode(v)
+}
+
+func (c *schemaCompiler) compile(node interface{}, at string) (*jsonSchema, error) {
+	s := &jsonSchema{}
+	return s, c.compileInto(s, node, at)
+}
+
+func (c *schemaCompiler) compileInto(s *jsonSchema, node interface{}, at string) error {
+	switch n := node.(type) {
+	case bool:
+		s.always = &n
+		return nil
+	case map[string]interface{}:
+		return c.compileObject(s, n, at)
+	}
+	return fmt.Errorf("%s: Expected a schema object or boolean", at)
+}
+
+// resolve returns the schema at a `$ref` such as "#/definitions/name",
+// compiling it once so that recursive references terminate
+func (c *schemaCompiler) resolve(ref string, at string) (*jsonSchema, error) {
+	if s, exists := c.refs[ref]; exists {
+		return s, nil
+	}
+	if !strings.HasPrefix(ref, "#") {
+		return nil, fmt.Errorf("%s: Unsupported `$ref` (only local references): %s", at, ref)
+	}
+	node := c.root
+	if pointer := ref[1:]; len(pointer) > 0 {
+		if !strings.HasPrefix(pointer, "/") {
+			return nil, fmt.Errorf("%s: Unsupported `$ref`: %s", at, ref)
+		}
+		for _, segment := range splitFieldPath(pointer) {
+			var exists bool
+			if node, exists = childValue(node, segment); !exists {
+				return nil, fmt.Errorf("%s: Unresolved `$ref`: %s", at, ref)
+			}
+		}
+	}
+	s := &jsonSchema{}
+	c.refs[ref] = s
+	return s, c.compileInto(s, node, ref)
+}
+
+func (c *schemaCompiler) compileObject(s *jsonSchema, n map[string]interface{}, at string) error {
+	var err error
+
+	schemaAt := func(key string) (*jsonSchema, error) {
+		return c.compile(n[key], at+"/"+key)
+	}
+	schemasAt := func(key string) ([]*jsonSchema, error) {
+		list, isList := n[key].([]interface{})
+		if !isList {
+			return nil, fmt.Errorf("%s/%s: Expected an array of schemas", at, key)
+		}
+		schemas := make([]*jsonSchema, len(list))
+		for i, item := range list {
+			if schemas[i], err = c.compile(item, fmt.Sprintf("%s/%s/%d", at, key, i)); err != nil {
+				return nil, err
+			}
+		}
+		return schemas, nil
+	}
+	intAt := func(key string) (*int, error) {
+		number, isNumber := n[key].(json.Number)
+		i, convErr := strconv.Atoi(string(number))
+		if !isNumber || convErr != nil || i < 0 {
+			return nil, fmt.Errorf("%s/%s: Expected a non-negative integer", at, key)
+		}
+		return &i, nil
+	}
+	numberAt := func(key string) (*float64, error) {
+		number, isNumber := n[key].(json.Number)
+		f, convErr := number.Float64()
+		if !isNumber || convErr != nil {
+			return nil, fmt.Errorf("%s/%s: Expected a number", at, key)
+		}
+		return &f, nil
+	}
+	namesAt := func(value interface{}, at string) ([]string, error) {
+		list, isList := value.([]interface{})
+		if !isList {
+			return nil, fmt.Errorf("%s: Expected an array", at)
+		}
+		names := make([]string, 0, len(list))
+		for _, item := range list {
+			name, isString := item.(string)
+			if !isString {
+				return nil, fmt.Errorf("%s: Expected property names", at)
+			}
+			names = append(names, name)
+		}
+		return names, nil
+	}
+	regexpAt := func(key, pattern string) (*regexp.Regexp, error) {
+		re, reErr := regexp.Compile(pattern)
+		if reErr != nil {
+			return nil, fmt.Errorf("%s/%s: Invalid pattern: %v", at, key, reErr)
+		}
+		return re, nil
+	}
+
+	// keywords are compiled in a fixed order, so errors are repeatable
+	keys := make([]string, 0, len(n))
+	for key := range n {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		value := n[key]
+		switch key {
+		case "$ref":
+			ref, isString := value.(string)
+			if !isString {
+				return fmt.Errorf("%s/$ref: Expected a string", at)
+			}
+			s.ref, err = c.resolve(ref, at)
+		case "type":
+			switch v := value.(type) {
+			case string:
+				s.types = []string{v}
+			case []interface{}:
+				for _, t := range v {
+					name, isString := t.(string)
+					if !isString {
+						return fmt.Errorf("%s/type: Expected a type name", at)
+					}
+					s.types = append(s.types, name)
+				}
+			default:
+				return fmt.Errorf("%s/type: Expected a type name or array", at)
+			}
+			for _, name := range s.types {
+				switch name {
+				case "null", "boolean", "object", "array", "number", "integer", "string":
+				default:
+					return fmt.Errorf("%s/type: Unknown type: %s", at, name)
+				}
+			}
+		case "enum":
+			list, isList := value.([]interface{})
+			if !isList {
+				return fmt.Errorf("%s/enum: Expected an array", at)
+			}
+			s.enum = list
+		case "const":
+			s.constant, s.hasConst = value, true
+		case "properties", "definitions", "$defs", "patternProperties":
+			object, isObject := value.(map[string]interface{})
+			if !isObject {
+				return fmt.Errorf("%s/%s: Expected an object", at, key)
+			}
+			if key == "definitions" || key == "$defs" {
+				// compiled when referenced
+				continue
+			}
+			for _, name := range sortedNames(object) {
+				sub, subErr := c.compile(object[name], at+"/"+key+"/"+name)
+				if subErr != nil {
+					return subErr
+				}
+				if key == "properties" {
+					if s.properties == nil {
+						s.properties = make(map[string]*jsonSchema, len(object))
+					}
+					s.properties[name] = sub
+					continue
+				}
+				re, reErr := regexpAt(key, name)
+				if reErr != nil {
+					return reErr
+				}
+				s.patternProperties = append(s.patternProperties, patternSchema{re: re, schema: sub})
+			}
+		case "additionalProperties":
+			s.additionalProperties, err = schemaAt(key)
+		case "required":
+			s.required, err = namesAt(value, at+"/required")
+		case "propertyNames":
+			s.propertyNames, err = schemaAt(key)
+		case "dependencies", "dependentRequired", "dependentSchemas":
+			object, isObject := value.(map[string]interface{})
+			if !isObject {
+				return fmt.Errorf("%s/%s: Expected an object", at, key)
+			}
+			for _, name := range sortedNames(object) {
+				dependency := propertyDependency{name: name}
+				_, isList := object[name].([]interface{})
+				if key == "dependentRequired" || (key == "dependencies" && isList) {
+					dependency.required, err = namesAt(object[name], at+"/"+key+"/"+name)
+				} else {
+					dependency.schema, err = c.compile(object[name], at+"/"+key+"/"+name)
+				}
+				if err != nil {
+					return err
+				}
+				s.dependencies = append(s.dependencies, dependency)
+			}
+		case "unevaluatedProperties":
+			s.unevaluatedProperties, err = schemaAt(key)
+		case "minProperties":
+			s.minProperties, err = intAt(key)
+		case "maxProperties":
+			s.maxProperties, err = intAt(key)
+		case "items":
+			// draft 7 allows an array of schemas, as `prefixItems` since
+			if _, isList := value.([]interface{}); isList {
+				s.prefixItems, err = schemasAt(key)
+			} else {
+				s.items, err = schemaAt(key)
+			}
+		case "prefixItems":
+			s.prefixItems, err = schemasAt(key)
+		case "additionalItems":
+			if _, isList := n["items"].([]interface{}); isList {
+				s.items, err = schemaAt(key)
+			}
+		case "contains":
+			s.contains, err = schemaAt(key)
+		case "minContains":
+			s.minContains, err = intAt(key)
+		case "maxContains":
+			s.maxContains, err = intAt(key)
+		case "unevaluatedItems":
+			s.unevaluatedItems, err = schemaAt(key)
+		case "minItems":
+			s.minItems, err = intAt(key)
+		case "maxItems":
+			s.maxItems, err = intAt(key)
+		case "uniqueItems":
+			s.uniqueItems, _ = value.(bool)
+		case "minLength":
+			s.minLength, err = intAt(key)
+		case "maxLength":
+			s.maxLength, err = intAt(key)
+		case "pattern":
+			pattern, isString := value.(string)
+			if !isString {
+				return fmt.Errorf("%s/pattern: Expected a string", at)
+			}
+			s.pattern, err = regexpAt(key, pattern)
+		case "minimum":
+			s.minimum, err = numberAt(key)
+		case "maximum":
+			s.maximum, err = numberAt(key)
+		case "exclusiveMinimum":
+			s.exclusiveMinimum, err = numberAt(key)
+		case "exclusiveMaximum":
+			s.exclusiveMaximum, err = numberAt(key)
+		case "multipleOf":
+			if s.multipleOf, err = numberAt(key); err == nil && *s.multipleOf <= 0 {
+				err = fmt.Errorf("%s/multipleOf: Expected a positive number", at)
+			}
+		case "allOf":
+			s.allOf, err = schemasAt(key)
+		case "anyOf":
+			s.anyOf, err = schemasAt(key)
+		case "oneOf":
+			s.oneOf, err = schemasAt(key)
+		case "not":
+			s.not, err = schemaAt(key)
+		case "if":
+			s.ifSchema, err = schemaAt(key)
+		case "then":
+			// without `if`, `then` and `else` have no effect
+			s.thenSchema, err = schemaAt(key)
+		case "else":
+			s.elseSchema, err = schemaAt(key)
+		default:
+			if !schemaAnnotations[key] {
+				return fmt.Errorf("%s: Unsupported keyword: %s", at, key)
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Validate checks a value decoded with json.Number, returning the first
+// failure found
+func (s *jsonSchema) Validate(value interface{}) error {
+	return s.validate(value, "", nil)
+}
+
+// validate checks a value, recording what it evaluates in `seen` (which
+// may be nil) for a parent schema's unevaluated keywords
+func (s *jsonSchema) validate(value interface{}, path string, seen *schemaEvaluation) error {
+	fail := func(format string, args ...interface{}) error {
+		return &SchemaError{Path: path, Err: fmt.Sprintf(format, args...)}
+	}
+
+	if s.always != nil {
+		if !*s.always {
+			return fail("not allowed")
+		}
+		return nil
+	}
+
+	// unevaluated keywords need what every other keyword evaluated
+	if s.unevaluatedProperties != nil || s.unevaluatedItems != nil {
+		own := &schemaEvaluation{}
+		if err := s.validateKeywords(value, path, own, fail); err != nil {
+			return err
+		}
+		if err := s.validateUnevaluated(value, path, own, fail); err != nil {
+			return err
+		}
+		seen.merge(own)
+		return nil
+	}
+	return s.validateKeywords(value, path, seen, fail)
+}
+
+func (s *jsonSchema) validateKeywords(value interface{}, path string, seen *schemaEvaluation, fail func(string, ...interface{}) error) error {
+	if s.ref != nil {
+		if err := s.ref.validate(value, path, seen); err != nil {
+			return err
+		}
+	}
+
+	if len(s.types) > 0 {
+		matched := false
+		for _, t := range s.types {
+			if jsonTypeIs(value, t) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return fail("expected %s, got %s", strings.Join(s.types, " or "), jsonTypeOf(value))
+		}
+	}
+
+	if s.enum != nil {
+		matched := false
+		for _, allowed := range s.enum {
+			if jsonEqual(value, allowed) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return fail("not one of the allowed values")
+		}
+	}
+
+	if s.hasConst && !jsonEqual(value, s.constant) {
+		return fail("not the allowed value")
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		if err := s.validateObject(v, path, seen, fail); err != nil {
+			return err
+		}
+	case []interface{}:
+		if err := s.validateArray(v, path, seen, fail); err != nil {
+			return err
+		}
+	case string:
+		length := utf8.RuneCountInString(v)
+		if s.minLength != nil && length < *s.minLength {
+			return fail("shorter than %d characters", *s.minLength)
+		}
+		if s.maxLength != nil && length > *s.maxLength {
+			return fail("longer than %d characters", *s.maxLength)
+		}
+		if s.pattern != nil && !s.pattern.MatchString(v) {
+			return fail("does not match pattern %s", s.pattern)
+		}
+	case json.Number:
+		f, _ := v.Float64()
+		if s.minimum != nil && f < *s.minimum {
+			return fail("less than %v", *s.minimum)
+		}
+		if s.maximum != nil && f > *s.maximum {
+			return fail("greater than %v", *s.maximum)
+		}
+		if s.exclusiveMinimum != nil && f <= *s.exclusiveMinimum {
+			return fail("not greater than %v", *s.exclusiveMinimum)
+		}
+		if s.exclusiveMaximum != nil && f >= *s.exclusiveMaximum {
+			return fail("not less than %v", *s.exclusiveMaximum)
+		}
+		if s.multipleOf != nil {
+			if q := f / *s.multipleOf; math.Abs(q-math.Round(q)) > 1e-9 {
+				return fail("not a multiple of %v", *s.multipleOf)
+			}
+		}
+	}
+
+	for _, sub := range s.allOf {
+		if err := sub.validate(value, path, seen); err != nil {
+			return err
+		}
+	}
+
+	// evaluations from a subschema which does not match are discarded
+	if s.anyOf != nil {
+		matched := false
+		for _, sub := range s.anyOf {
+			own := seen.branch()
+			if sub.validate(value, path, own) == nil {
+				matched = true
+				seen.merge(own)
+				if seen == nil {
+					break
+				}
+			}
+		}
+		if !matched {
+			return fail("does not match any of `anyOf`")
+		}
+	}
+
+	if s.oneOf != nil {
+		matches := 0
+		var matchedSeen *schemaEvaluation
+		for _, sub := range s.oneOf {
+			own := seen.branch()
+			if sub.validate(value, path, own) == nil {
+				matches++
+				matchedSeen = own
+			}
+		}
+		if matches != 1 {
+			return fail("matches %d of `oneOf`, expected exactly 1", matches)
+		}
+		seen.merge(matchedSeen)
+	}
+
+	if s.not != nil && s.not.validate(value, path, nil) == nil {
+		return fail("matches `not`")
+	}
+
+	if s.ifSchema != nil {
+		own := seen.branch()
+		if s.ifSchema.validate(value, path, own) == nil {
+			seen.merge(own)
+			if s.thenSchema != nil {
+				if err := s.thenSchema.validate(value, path, seen); err != nil {
+					return err
+				}
+			}
+		} else if s.elseSchema != nil {
+			if err := s.elseSchema.validate(value, path, seen); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (s *jsonSchema) validateObject(v map[string]interface{}, path string, seen *schemaEvaluation, fail func(string, ...interface{}) error) error {
+	for _, name := range s.required {
+		if _, exists := v[name]; !exists {
+			return fail("missing required property %q", name)
+		}
+	}
+	if s.minProperties != nil && len(v) < *s.minProperties {
+		return fail("fewer than %d properties", *s.minProperties)
+	}
+	if s.maxProperties != nil && len(v) > *s.maxProperties {
+		return fail("more than %d properties", *s.maxProperties)
+	}
+	for _, dependency := range s.dependencies {
+		if _, exists := v[dependency.name]; !exists {
+			continue
+		}
+		for _, name := range dependency.required {
+			if _, exists := v[name]; !exists {
+				return fail("missing property %q (required by %q)", name, dependency.name)
+			}
+		}
+		if dependency.schema != nil {
+			if err := dependency.schema.validate(v, path, seen); err != nil {
+				return err
+			}
+		}
+	}
+	for _, name := range sortedNames(v) {
+		childPath := path + "/" + jsonPointerEscaper.Replace(name)
+		if s.propertyNames != nil {
+			if err := s.propertyNames.validate(name, childPath, nil); err != nil {
+				return fail("invalid property name %q: %s", name, schemaErrorReason(err))
+			}
+		}
+		declared := false
+		if sub, exists := s.properties[name]; exists {
+			declared = true
+			if err := sub.validate(v[name], childPath, nil); err != nil {
+				return err
+			}
+		}
+		for _, p := range s.patternProperties {
+			if p.re.MatchString(name) {
+				declared = true
+				if err := p.schema.validate(v[name], childPath, nil); err != nil {
+					return err
+				}
+			}
+		}
+		if !declared && s.additionalProperties != nil {
+			if s.additionalProperties.always != nil && !*s.additionalProperties.always {
+				return fail("unexpected property %q", name)
+			}
+			if err := s.additionalProperties.validate(v[name], childPath, nil); err != nil {
+				return err
+			}
+			declared = true
+		}
+		if declared {
+			seen.addProperty(name)
+		}
+	}
+	return nil
+}
+
+func (s *jsonSchema) validateArray(v []interface{}, path string, seen *schemaEvaluation, fail func(string, ...interface{}) error) error {
+	if s.minItems != nil && len(v) < *s.minItems {
+		return fail("fewer than %d items", *s.minItems)
+	}
+	if s.maxItems != nil && len(v) > *s.maxItems {
+		return fail("more than %d items", *s.maxItems)
+	}
+	for i, item := range v {
+		sub := s.items
+		if i < len(s.prefixItems) {
+			sub = s.prefixItems[i]
+		}
+		if sub == nil {
+			continue
+		}
+		if err := sub.validate(item, path+"/"+strconv.Itoa(i), nil); err != nil {
+			return err
+		}
+		seen.addItem(i)
+	}
+	if s.uniqueItems {
+		for i := range v {
+			for j := i + 1; j < len(v); j++ {
+				if jsonEqual(v[i], v[j]) {
+					return fail("items %d and %d are equal", i, j)
+				}
+			}
+		}
+	}
+	if s.contains != nil {
+		matches := 0
+		for i, item := range v {
+			if s.contains.validate(item, path+"/"+strconv.Itoa(i), nil) == nil {
+				matches++
+				seen.addItem(i)
+			}
+		}
+		minContains := 1
+		if s.minContains != nil {
+			minContains = *s.minContains
+		}
+		if matches < minContains {
+			return fail("fewer than %d items match `contains`", minContains)
+		}
+		if s.maxContains != nil && matches > *s.maxContains {
+			return fail("more than %d items match `contains`", *s.maxContains)
+		}
+	}
+	return nil
+}
+
+// validateUnevaluated applies `unevaluatedProperties` and
+// `unevaluatedItems` to what the schema's other keywords did not evaluate
+func (s *jsonSchema) validateUnevaluated(value interface{}, path string, seen *schemaEvaluation, fail func(string, ...interface{}) error) error {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		if s.unevaluatedProperties == nil {
+			return nil
+		}
+		for _, name := range sortedNames(v) {
+			if seen.properties[name] {
+				continue
+			}
+			if s.unevaluatedProperties.always != nil && !*s.unevaluatedProperties.always {
+				return fail("unevaluated property %q", name)
+			}
+			childPath := path + "/" + jsonPointerEscaper.Replace(name)
+			if err := s.unevaluatedProperties.validate(v[name], childPath, nil); err != nil {
+				return err
+			}
+			seen.addProperty(name)
+		}
+	case []interface{}:
+		if s.unevaluatedItems == nil || seen.allItems {
+			return nil
+		}
+		for i, item := range v {
+			if seen.items[i] {
+				continue
+			}
+			if s.unevaluatedItems.always != nil && !*s.unevaluatedItems.always {
+				return fail("unevaluated item %d", i)
+			}
+			if err := s.unevaluatedItems.validate(item, path+"/"+strconv.Itoa(i), nil); err != nil {
+				return err
+			}
+		}
+		seen.allItems = true
+	}
+	return nil
+}
+
+// branch returns an evaluation for a subschema whose evaluations are only
+// kept if it matches, or nil if nothing is being recorded
+func (e *schemaEvaluation) branch() *schemaEvaluation {
+	if e == nil {
+		return nil
+	}
+	return &schemaEvaluation{}
+}
+
+func (e *schemaEvaluation) merge(other *schemaEvaluation) {
+	if e == nil || other == nil {
+		return
+	}
+	for name := range other.properties {
+		e.addProperty(name)
+	}
+	for i := range other.items {
+		e.addItem(i)
+	}
+	e.allItems = e.allItems || other.allItems
+}
+
+func (e *schemaEvaluation) addProperty(name string) {
+	if e == nil {
+		return
+	}
+	if e.properties == nil {
+		e.properties = make(map[string]bool)
+	}
+	e.properties[name] = true
+}
+
+func (e *schemaEvaluation) addItem(i int) {
+	if e == nil {
+		return
+	}
+	if e.items == nil {
+		e.items = make(map[int]bool)
+	}
+	e.items[i] = true
+}
+
+func sortedNames(v map[string]interface{}) []string {
+	names := make([]string, 0, len(v))
+	for name := range v {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// schemaErrorReason returns a validation failure without its path
+func schemaErrorReason(err error) string {
+	if schemaErr, isSchemaErr := err.(*SchemaError); isSchemaErr {
+		return schemaErr.Err
+	}
+	return err.Error()
+}
+
+var jsonPointerEscaper = strings.NewReplacer("~", "~0", "/", "~1")
+
+func jsonTypeOf(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case map[string]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	case json.Number:
+		return "number"
+	case string:
+		return "string"
+	}
+	return fmt.Sprintf("%T", value)
+}
+
+func jsonTypeIs(value interface{}, t string) bool {
+	if t == "integer" {
+		number, isNumber := value.(json.Number)
+		if !isNumber {
+			return false
+		}
+		f, err := number.Float64()
+		return err == nil && f == math.Trunc(f)
+	}
+	return jsonTypeOf(value) == t
+}
+
+// jsonEqual compares decoded JSON values, with numbers equal by value
+func jsonEqual(a, b interface{}) bool {
+	switch av := a.(type) {
+	case json.Number:
+		bv, isNumber := b.(json.Number)
+		if !isNumber {
+			return false
+		}
+		af, aErr := av.Float64()
+		bf, bErr := bv.Float64()
+		return aErr == nil && bErr == nil && af == bf
+	case map[string]interface{}:
+		bv, isObject := b.(map[string]interface{})
+		if !isObject || len(av) != len(bv) {
+			return false
+		}
+		for k, item := range av {
+			if other, exists := bv[k]; !exists || !jsonEqual(item, other) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		bv, isArray := b.([]interface{})
+		if !isArray || len(av) != len(bv) {
+			return false
+		}
+		for i := range av {
+			if !jsonEqual(av[i], bv[i]) {
+				return false
+			}
+		}
+		return true
+	}
+	return a == b
+}
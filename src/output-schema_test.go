@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func compileTestSchema(t *testing.T, raw string) *jsonSchema {
+	schema, err := compileOutputSchema([]byte(raw))
+	if err != nil {
+		t.Fatalf("%s: %v", raw, err)
+	}
+	return schema
+}
+
+func validateTestValue(t *testing.T, schema *jsonSchema, raw string) error {
+	var value interface{}
+	if err := decodeJsonNumbers([]byte(raw), &value); err != nil {
+		t.Fatalf("%s: %v", raw, err)
+	}
+	return schema.Validate(value)
+}
+
+func TestOutputSchemaKeywords(t *testing.T) {
+	for _, test := range []struct {
+		schema  string
+		valid   string
+		invalid string
+		want    string
+	}{
+		{`true`, `1`, ``, ``},
+		{`false`, ``, `1`, `/: not allowed`},
+		{`{"type":"string"}`, `"a"`, `1`, `/: expected string, got number`},
+		{`{"type":["integer","null"]}`, `null`, `1.5`, `expected integer or null`},
+		{`{"enum":["a",1]}`, `1.0`, `"b"`, `not one of the allowed values`},
+		{`{"const":{"a":[1]}}`, `{"a":[1]}`, `{"a":[2]}`, `not the allowed value`},
+		{`{"properties":{"a":{"type":"string"}}}`, `{"a":"x","b":1}`, `{"a":1}`, `/a: expected string`},
+		{`{"patternProperties":{"^n_":{"type":"number"}}}`, `{"n_a":1,"s":"x"}`, `{"n_a":"x"}`, `/n_a: expected number`},
+		{`{"properties":{"a":{}},"additionalProperties":false}`, `{"a":1}`, `{"a":1,"b":2}`, `unexpected property "b"`},
+		{`{"additionalProperties":{"type":"string"}}`, `{"a":"x"}`, `{"a":1}`, `/a: expected string`},
+		{`{"required":["a"]}`, `{"a":null}`, `{"b":1}`, `missing required property "a"`},
+		{`{"minProperties":1}`, `{"a":1}`, `{}`, `fewer than 1 properties`},
+		{`{"maxProperties":1}`, `{"a":1}`, `{"a":1,"b":2}`, `more than 1 properties`},
+		{`{"items":{"type":"number"}}`, `[1,2]`, `[1,"x"]`, `/1: expected number`},
+		{`{"prefixItems":[{"type":"string"}]}`, `["a",1]`, `[1]`, `/0: expected string`},
+		{`{"items":[{"type":"string"}],"additionalItems":false}`, `["a"]`, `["a",1]`, `/1: not allowed`},
+		{`{"minItems":1}`, `[1]`, `[]`, `fewer than 1 items`},
+		{`{"maxItems":1}`, `[1]`, `[1,2]`, `more than 1 items`},
+		{`{"uniqueItems":true}`, `[1,"1"]`, `[1,1.0]`, `items 0 and 1 are equal`},
+		{`{"minLength":2}`, `"éé"`, `"é"`, `shorter than 2 characters`},
+		{`{"maxLength":1}`, `"é"`, `"ab"`, `longer than 1 characters`},
+		{`{"pattern":"^[a-z]+$"}`, `"abc"`, `"ab1"`, `does not match pattern`},
+		{`{"minimum":1}`, `1`, `0.5`, `less than 1`},
+		{`{"maximum":1}`, `1`, `1.5`, `greater than 1`},
+		{`{"exclusiveMinimum":1}`, `1.5`, `1`, `not greater than 1`},
+		{`{"exclusiveMaximum":1}`, `0.5`, `1`, `not less than 1`},
+		{`{"multipleOf":0.1}`, `0.3`, `0.35`, `not a multiple of 0.1`},
+		{`{"allOf":[{"type":"number"},{"minimum":1}]}`, `2`, `0`, `less than 1`},
+		{`{"anyOf":[{"type":"string"},{"minimum":1}]}`, `"a"`, `0`, `does not match any of`},
+		{`{"oneOf":[{"type":"number"},{"minimum":1}]}`, `0`, `2`, `matches 2 of`},
+		{`{"not":{"type":"null"}}`, `1`, `null`, "matches `not`"},
+		{`{"$ref":"#/definitions/id","definitions":{"id":{"type":"integer"}}}`, `1`, `"a"`, `expected integer`},
+		{`{"$defs":{"node":{"properties":{"next":{"$ref":"#/$defs/node"},"v":{"type":"number"}}}},"$ref":"#/$defs/node"}`,
+			`{"v":1,"next":{"v":2}}`, `{"next":{"next":{"v":"x"}}}`, `/next/next/v: expected number`},
+		{`{"if":{"required":["a"]},"then":{"required":["b"]},"else":{"required":["c"]}}`, `{"a":1,"b":2}`, `{"a":1}`, `missing required property "b"`},
+		{`{"if":{"required":["a"]},"then":{"required":["b"]},"else":{"required":["c"]}}`, `{"c":1}`, `{}`, `missing required property "c"`},
+		{`{"then":false,"else":false}`, `1`, ``, ``},
+		{`{"contains":{"type":"string"}}`, `[1,"a"]`, `[1,2]`, "fewer than 1 items match `contains`"},
+		{`{"contains":{"type":"string"},"minContains":2}`, `["a","b"]`, `["a",1]`, "fewer than 2 items match `contains`"},
+		{`{"contains":{"type":"string"},"maxContains":1}`, `["a",1]`, `["a","b"]`, "more than 1 items match `contains`"},
+		{`{"contains":{"type":"string"},"minContains":0}`, `[1]`, ``, ``},
+		{`{"minContains":2,"maxContains":0}`, `[1]`, ``, ``},
+		{`{"propertyNames":{"maxLength":3}}`, `{"abc":1}`, `{"abcd":1}`, `/: invalid property name "abcd": longer than 3 characters`},
+		{`{"propertyNames":{"pattern":"^[a-z]+$"}}`, `{}`, `{"a":1,"B":2}`, `invalid property name "B"`},
+		{`{"dependencies":{"a":["b"]}}`, `{"b":1}`, `{"a":1}`, `missing property "b" (required by "a")`},
+		{`{"dependencies":{"a":{"properties":{"b":{"type":"string"}}}}}`, `{"b":1}`, `{"a":1,"b":1}`, `/b: expected string`},
+		{`{"dependentRequired":{"a":["b","c"]}}`, `{"a":1,"b":2,"c":3}`, `{"a":1,"b":2}`, `missing property "c" (required by "a")`},
+		{`{"dependentSchemas":{"a":{"maxProperties":1}}}`, `{"a":1}`, `{"a":1,"b":2}`, `more than 1 properties`},
+		{`{"properties":{"a":{}},"unevaluatedProperties":false}`, `{"a":1}`, `{"a":1,"b":2}`, `unevaluated property "b"`},
+		{`{"unevaluatedProperties":{"type":"string"}}`, `{"a":"x"}`, `{"a":1}`, `/a: expected string`},
+		{`{"allOf":[{"properties":{"a":{}}}],"unevaluatedProperties":false}`, `{"a":1}`, `{"a":1,"b":2}`, `unevaluated property "b"`},
+		{`{"$ref":"#/$defs/a","$defs":{"a":{"properties":{"a":{}}}},"unevaluatedProperties":false}`, `{"a":1}`, `{"b":1}`, `unevaluated property "b"`},
+		{`{"anyOf":[{"properties":{"a":{"type":"string"}}},{"properties":{"b":{}}}],"unevaluatedProperties":false}`,
+			`{"a":"x","b":1}`, `{"a":1,"b":1}`, `unevaluated property "a"`},
+		{`{"oneOf":[{"properties":{"a":{}},"required":["a"]},{"properties":{"b":{}},"required":["b"]}],"unevaluatedProperties":false}`,
+			`{"b":1}`, `{"b":1,"a2":1}`, `unevaluated property "a2"`},
+		{`{"if":{"properties":{"t":{"const":"x"}},"required":["t"]},"then":{"properties":{"x":{}}},"else":{"properties":{"y":{}}},"unevaluatedProperties":false}`,
+			`{"t":"x","x":1}`, `{"t":"y","x":1}`, `unevaluated property "t"`},
+		{`{"dependentSchemas":{"a":{"properties":{"b":{}}}},"properties":{"a":{}},"unevaluatedProperties":false}`,
+			`{"a":1,"b":2}`, `{"b":2}`, `unevaluated property "b"`},
+		{`{"not":{"properties":{"a":{"type":"string"}}},"unevaluatedProperties":false}`, ``, `{"a":1}`, `unevaluated property "a"`},
+		{`{"properties":{"o":{"properties":{"a":{}}}},"unevaluatedProperties":false}`, `{"o":{"b":1}}`, `{"p":1}`, `unevaluated property "p"`},
+		{`{"prefixItems":[{}],"unevaluatedItems":false}`, `[1]`, `[1,2]`, `unevaluated item 1`},
+		{`{"items":{},"unevaluatedItems":false}`, `[1,2]`, ``, ``},
+		{`{"contains":{"type":"string"},"unevaluatedItems":{"type":"number"}}`, `["a",1]`, `["a",null]`, `/1: expected number`},
+		{`{"allOf":[{"prefixItems":[{},{}]}],"unevaluatedItems":false}`, `[1,2]`, `[1,2,3]`, `unevaluated item 2`},
+		{`{"title":"t","description":"d","default":1,"examples":[1],"format":"uri","$comment":"c","$schema":"http://json-schema.org/draft-07/schema#","$id":"x"}`,
+			`"not a uri"`, ``, ``},
+	} {
+		schema := compileTestSchema(t, test.schema)
+		if len(test.valid) > 0 {
+			if err := validateTestValue(t, schema, test.valid); err != nil {
+				t.Errorf("%s: %s failed: %v", test.schema, test.valid, err)
+			}
+		}
+		if len(test.invalid) > 0 {
+			err := validateTestValue(t, schema, test.invalid)
+			if err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Errorf("%s: %s gave %v, want %q", test.schema, test.invalid, err, test.want)
+			}
+		}
+	}
+}
+
+func TestOutputSchemaRejected(t *testing.T) {
+	for _, test := range []struct {
+		schema string
+		want   string
+	}{
+		// keywords which are not supported fail rather than go unchecked
+		{`{"$dynamicRef":"#node"}`, `#: Unsupported keyword: $dynamicRef`},
+		{`{"requried":["a"]}`, `#: Unsupported keyword: requried`},
+		{`{"properties":{"a":{"items":{"requried":[]}}}}`, `#/properties/a/items: Unsupported keyword: requried`},
+		{`{"$ref":"#/definitions/a","definitions":{"a":{"$dynamicRef":"#a"}}}`, `#/definitions/a: Unsupported keyword: $dynamicRef`},
+		// malformed keywords
+		{`{"type":"text"}`, `#/type: Unknown type: text`},
+		{`{"minLength":-1}`, `#/minLength: Expected a non-negative integer`},
+		{`{"multipleOf":0}`, `#/multipleOf: Expected a positive number`},
+		{`{"pattern":"("}`, `#/pattern: Invalid pattern`},
+		{`{"allOf":{}}`, `#/allOf: Expected an array of schemas`},
+		{`{"$ref":"other.json#/a"}`, `Unsupported ` + "`$ref`"},
+		{`{"$ref":"#/definitions/missing"}`, `Unresolved ` + "`$ref`"},
+		{`{"properties":{"a":1}}`, `#/properties/a: Expected a schema object or boolean`},
+		{`{"if":1}`, `#/if: Expected a schema object or boolean`},
+		{`{"then":{"requried":[]}}`, `#/then: Unsupported keyword: requried`},
+		{`{"minContains":-1}`, `#/minContains: Expected a non-negative integer`},
+		{`{"dependentRequired":{"a":"b"}}`, `#/dependentRequired/a: Expected an array`},
+		{`{"dependentRequired":{"a":[1]}}`, `#/dependentRequired/a: Expected property names`},
+		{`{"dependentSchemas":{"a":["b"]}}`, `#/dependentSchemas/a: Expected a schema object or boolean`},
+		{`{"dependencies":{"a":1}}`, `#/dependencies/a: Expected a schema object or boolean`},
+		{`{"unevaluatedProperties":[]}`, `#/unevaluatedProperties: Expected a schema object or boolean`},
+	} {
+		_, err := compileOutputSchema([]byte(test.schema))
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%s: got error %v, want %q", test.schema, err, test.want)
+		}
+	}
+}
+
+func TestOutputSchemaExample(t *testing.T) {
+	if _, err := loadOutputSchema("../etc/output_schema-EXAMPLE.json"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestQueueRecordRejected(t *testing.T) {
+	pi := &PInstance{
+		Config:         &Config{OutputRejectErrorKey: "_schema_error"},
+		EventJsonChan:  make(chan *[]byte, 1),
+		RejectJsonChan: make(chan *[]byte, 1),
+		OutputSchema:   compileTestSchema(t, `{"required":["id"],"properties":{"id":{"type":"integer"}}}`),
+		Log:            Logger("error", ""),
+		Metrics:        newMetrics(),
+	}
+	now := time.Now()
+
+	pi.queueRecord(StringifiedRecordType{"id": 1}, now, now)
+	select {
+	case sent := <-pi.EventJsonChan:
+		if string(*sent) != `{"id":1}` {
+			t.Fatalf("sent %s", *sent)
+		}
+	default:
+		t.Fatal("valid record not sent")
+	}
+
+	pi.queueRecord(StringifiedRecordType{"id": "x"}, now, now)
+	select {
+	case sent := <-pi.EventJsonChan:
+		t.Fatalf("invalid record sent: %s", *sent)
+	case rejected := <-pi.RejectJsonChan:
+		var record map[string]interface{}
+		if err := json.Unmarshal(*rejected, &record); err != nil {
+			t.Fatal(err)
+		}
+		if record["id"] != "x" || record["_schema_error"] != "/id: expected integer, got string" {
+			t.Fatalf("rejected %s", *rejected)
+		}
+	default:
+		t.Fatal("invalid record not rejected")
+	}
+
+	snapshot := pi.Metrics.Snapshot()
+	if snapshot[METRIC_RECORDS_SENT] != uint64(1) || snapshot[METRIC_RECORDS_REJECT] != uint64(1) {
+		t.Fatalf("metrics %v, want one sent and one rejected", snapshot)
+	}
+}
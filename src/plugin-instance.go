@@ -2,24 +2,49 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
-	lru "github.com/hashicorp/golang-lru"
 	strftime "github.com/lestrrat-go/strftime"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	SUMMARY_DUP_COUNT_KEY  = "dup_count"
+	SUMMARY_FIRST_SEEN_KEY = "first_seen"
+	SUMMARY_LAST_SEEN_KEY  = "last_seen"
+
+	// RECORD_TAG_FIELD is the pseudo-field holding the Fluent Bit tag
+	RECORD_TAG_FIELD = "_tag"
 )
 
 type (
-	MatchMapType map[string]map[string]map[string]string
-	PInstance    struct {
+	PInstance struct {
 		Config        *Config
 		EventJsonChan chan *[]byte
 		ToPostChan    chan *bytes.Buffer
-		HttpClient    *HttpClient
-		Log           *SimpleLogger
-		LRU           *lru.Cache
-		MatchMap      MatchMapType
-		TimeFormatter *strftime.Strftime
+		// rejected records, if `output_reject_url` is set
+		RejectJsonChan chan *[]byte
+		RejectPostChan chan *bytes.Buffer
+		OutputSchema   *jsonSchema
+		HttpClient     *HttpClient
+		Log            *SimpleLogger
+		Dedup          *Deduplicator
+		Metrics        *Metrics
+		MatchMap       *MatchMapSource
+		TimeFormatter  *strftime.Strftime
+		TimeFields     []outputTimeField
+		Done           chan struct{}
+		Housekeeping   sync.WaitGroup
 	}
 	PInstances map[string]*PInstance
+
+	// outputTimeField is one of `output_time_fields`
+	outputTimeField struct {
+		Key       string
+		Formatter *strftime.Strftime
+	}
 )
 
 func makePInstance(conf *Config) (*PInstance, error) {
@@ -30,11 +55,7 @@ func makePInstance(conf *Config) (*PInstance, error) {
 
 	toPostChan := make(chan *bytes.Buffer, conf.MaxRecords)
 
-	timeFormatter, tfErr := strftime.New(
-		conf.OutputTimeFormat,
-		strftime.WithMilliseconds('L'),
-		strftime.WithUnixSeconds('s'),
-	)
+	timeFormatter, tfErr := newTimeFormatter(conf.OutputTimeFormat)
 	if tfErr != nil {
 		return nil, fmt.Errorf(
 			"Invalid `output_time_format`: %v (%s)",
@@ -43,20 +64,49 @@ func makePInstance(conf *Config) (*PInstance, error) {
 		)
 	}
 
-	newLru, lruErr := lru.New(conf.DeduplicateSize)
-	if lruErr != nil {
-		return nil, fmt.Errorf(
-			"Failed to create LRU: %v",
-			lruErr,
-		)
+	timeFields := make([]outputTimeField, 0, len(conf.OutputTimeFields))
+	for _, field := range conf.OutputTimeFields {
+		formatter, err := newTimeFormatter(field.Value)
+		if err != nil {
+			return nil, fmt.Errorf(
+				"Invalid `output_time_fields` format: %v (%s)",
+				err,
+				field.Value,
+			)
+		}
+		timeFields = append(timeFields, outputTimeField{Key: field.Key, Formatter: formatter})
 	}
 
-	var matchMap MatchMapType
-	if mmfErr := loadMatchMapFile(conf.MatchMapFile, &matchMap); mmfErr != nil {
-		return nil, fmt.Errorf(
-			"Failed to load match map file: %v",
-			mmfErr,
-		)
+	var outputSchema *jsonSchema
+	var rejectJsonChan chan *[]byte
+	var rejectPostChan chan *bytes.Buffer
+	if len(conf.OutputSchemaFile) > 0 {
+		var osErr error
+		if outputSchema, osErr = loadOutputSchema(conf.OutputSchemaFile); osErr != nil {
+			return nil, fmt.Errorf(
+				"Invalid `output_schema_file`: %v",
+				osErr,
+			)
+		}
+		if len(conf.OutputRejectUrl) > 0 {
+			rejectJsonChan = make(chan *[]byte, conf.MaxRecords)
+			rejectPostChan = make(chan *bytes.Buffer, conf.MaxRecords)
+		}
+	}
+
+	metrics := newMetrics()
+
+	var matchMap *MatchMapSource
+	if len(conf.MatchMapFile) > 0 || len(conf.MatchMapUrl) > 0 {
+		var mmfErr error
+		if matchMap, mmfErr = newMatchMapSource(conf, log); mmfErr != nil {
+			return nil, fmt.Errorf(
+				"Failed to load match map: %v",
+				mmfErr,
+			)
+		}
+		metrics.SetInfo(METRIC_MATCH_MAP_VER, matchMap.Version())
+		log.Info.Printf("Match map loaded: version=%s\n", matchMap.Version())
 	}
 
 	hc, hcErr := httpClient()
@@ -67,15 +117,262 @@ func makePInstance(conf *Config) (*PInstance, error) {
 		)
 	}
 
-	return &PInstance{
-		Config:        conf,
-		EventJsonChan: eventJsonChan,
-		ToPostChan:    toPostChan,
-		HttpClient:    hc,
-		Log:           log,
-		LRU:           newLru,
-		MatchMap:      matchMap,
-		TimeFormatter: timeFormatter,
-	}, nil
+	pi := &PInstance{
+		Config:         conf,
+		EventJsonChan:  eventJsonChan,
+		ToPostChan:     toPostChan,
+		RejectJsonChan: rejectJsonChan,
+		RejectPostChan: rejectPostChan,
+		OutputSchema:   outputSchema,
+		HttpClient:     hc,
+		Log:            log,
+		Metrics:        metrics,
+		MatchMap:       matchMap,
+		TimeFormatter:  timeFormatter,
+		TimeFields:     timeFields,
+		Done:           make(chan struct{}),
+	}
+
+	dedup, ddErr := newDeduplicator(
+		conf.DedupMode,
+		func(onRemoved RemovalCallback) (DedupStore, error) {
+			return newDedupStore(conf, log, metrics, onRemoved)
+		},
+		func(key string, _ interface{}, reason RemovalReason) {
+			switch reason {
+			case RemovedExpired:
+				metrics.Inc(METRIC_DEDUP_EXPIRED)
+				log.Debug.Printf("Deduplication cache expired: key=%s\n", key)
+			case RemovedEvicted:
+				metrics.Inc(METRIC_DEDUP_EVICTED)
+				log.Info.Printf("Deduplication cache evicted live record (consider a larger `deduplicate_size`): key=%s\n", key)
+			}
+		},
+		pi.sendSummary,
+	)
+	if ddErr != nil {
+		return nil, fmt.Errorf(
+			"Failed to create deduplication cache: %v",
+			ddErr,
+		)
+	}
+	pi.Dedup = dedup
+
+	return pi, nil
+
+}
+
+// exposeTag adds the Fluent Bit tag to a record as the `_tag` pseudo-field,
+// for the match map and dedup keys. The returned function, which may be
+// called more than once, removes it again (restoring any real `_tag`
+// field) and adds the tag under `tag_key` if configured.
+func (pi *PInstance) exposeTag(record StringifiedRecordType, tag string) func() {
+	shadowed, hasShadowed := record[RECORD_TAG_FIELD]
+	record[RECORD_TAG_FIELD] = tag
+	released := false
+	return func() {
+		if released {
+			return
+		}
+		released = true
+		delete(record, RECORD_TAG_FIELD)
+		if hasShadowed {
+			record[RECORD_TAG_FIELD] = shadowed
+		}
+		if len(pi.Config.TagKey) > 0 {
+			record[pi.Config.TagKey] = tag
+		}
+	}
+}
+
+// outputTime formats a time as configured by `output_time_format`,
+// `output_time_zone` and `output_time_integer`
+func (pi *PInstance) outputTime(t time.Time) interface{} {
+	return pi.formatTime(pi.TimeFormatter, t)
+}
+
+func (pi *PInstance) formatTime(tf *strftime.Strftime, t time.Time) interface{} {
+	timeValue := formattedTime(tf, t.In(pi.Config.OutputTimeLocation))
+	if pi.Config.OutputTimeAsInteger && timeValue.Int64 != nil {
+		return *timeValue.Int64
+	}
+	return *timeValue.String
+}
+
+// shapeRecord applies the output projection to a record which has passed
+// deduplication, in order: pseudonymization, `keep_fields`, `remove_fields`,
+// `rename_fields`, then `move_fields`. Each refers to fields by the names
+// left by the one before.
+func (pi *PInstance) shapeRecord(record StringifiedRecordType) StringifiedRecordType {
+
+	conf := pi.Config
+
+	pi.pseudonymize(record)
+
+	// keep only the allowed fields (or nested values)
+	if len(conf.KeepFields) > 0 {
+		kept := make(StringifiedRecordType, len(conf.KeepFields))
+		for _, keepFieldKey := range conf.KeepFields {
+			if value, exists := record[keepFieldKey]; exists {
+				kept[keepFieldKey] = value
+			} else if value, exists := lookupField(record, keepFieldKey); exists {
+				setField(kept, keepFieldKey, value)
+			}
+		}
+		record = kept
+	}
+
+	// remove any undesired fields (or nested values)
+	for _, removeFieldKey := range conf.RemoveFields {
+		deleteField(record, removeFieldKey)
+	}
+
+	// rename `old:new`, where either may be a path
+	for _, rename := range conf.RenameFields {
+		if value, exists := lookupField(record, rename.Key); exists {
+			deleteField(record, rename.Key)
+			if !setField(record, rename.Value, value) {
+				pi.Log.Debug.Printf("Unable to rename field: %s to %s\n", rename.Key, rename.Value)
+				setField(record, rename.Key, value)
+			}
+		}
+	}
+
+	// move `field:object` into an object, keeping the field's own name
+	for _, move := range conf.MoveFields {
+		value, exists := lookupField(record, move.Key)
+		if !exists {
+			continue
+		}
+		name := move.Key
+		if _, topLevel := record[move.Key]; !topLevel {
+			segments := splitFieldPath(move.Key)
+			name = segments[len(segments)-1]
+		}
+		deleteField(record, move.Key)
+		if !setFieldPath(record, append(splitFieldPath(move.Value), name), value) {
+			pi.Log.Debug.Printf("Unable to move field: %s into %s\n", move.Key, move.Value)
+			setField(record, move.Key, value)
+		}
+	}
+
+	return record
+}
+
+// sendRecord shapes a record which has passed deduplication, and queues it
+// for posting. `original` is the Fluent Bit timestamp, which `timestamp`
+// may differ from.
+func (pi *PInstance) sendRecord(record StringifiedRecordType, timestamp time.Time, original time.Time) {
+	pi.queueRecord(pi.shapeRecord(record), timestamp, original)
+}
+
+// sendWithoutKey handles a record whose dedup key fields are missing, which
+// `dedup_missing_key` either sends without deduplication or skips
+func (pi *PInstance) sendWithoutKey(record StringifiedRecordType, timestamp time.Time, original time.Time, recordIndex int, keyErr error) {
+	pi.Metrics.Inc(METRIC_DEDUP_NO_KEY)
+	if pi.Config.DedupMissingKey == DEDUP_MISSING_KEY_PASS {
+		pi.Log.Debug.Printf(
+			"Sending without deduplication: recordIndex=%d, error=%v\n",
+			recordIndex,
+			keyErr,
+		)
+		pi.sendRecord(record, timestamp, original)
+	} else {
+		pi.Log.Debug.Printf(
+			"Skipping record: recordIndex=%d, error=%v\n",
+			recordIndex,
+			keyErr,
+		)
+	}
+}
+
+// queueRecord adds any time fields to a shaped record, and queues it for
+// posting
+func (pi *PInstance) queueRecord(record StringifiedRecordType, timestamp time.Time, original time.Time) {
+
+	log := pi.Log
+	conf := pi.Config
+
+	// add any time fields to the outgoing record
+	if timeKey := strings.TrimSpace(conf.OutputTimeKey); len(timeKey) > 0 {
+		record[timeKey] = pi.outputTime(timestamp)
+	}
+	for _, field := range pi.TimeFields {
+		record[field.Key] = pi.formatTime(field.Formatter, timestamp)
+	}
+	if len(conf.OutputOriginalTimeKey) > 0 {
+		record[conf.OutputOriginalTimeKey] = pi.outputTime(original)
+	}
+	if len(conf.OutputProcessingTimeKey) > 0 {
+		record[conf.OutputProcessingTimeKey] = pi.outputTime(time.Now())
+	}
+
+	// Marshal to JSON, check against any schema, and put in to channel
+	json, err := json.Marshal(record)
+	if err != nil {
+		log.Error.Printf("Failed to marshal as JSON: %v (%#v)\n", err, record)
+		return
+	}
+	if schemaErr := pi.validateOutput(json); schemaErr != nil {
+		pi.rejectRecord(record, schemaErr)
+		return
+	}
+	log.Info.Printf("Sending => %s\n", json)
+	pi.Metrics.Inc(METRIC_RECORDS_SENT)
+	pi.EventJsonChan <- &json
+}
+
+// validateOutput checks a marshaled record against `output_schema_file`.
+// The JSON is decoded again so that the schema sees exactly what is sent.
+func (pi *PInstance) validateOutput(marshaled []byte) error {
+	if pi.OutputSchema == nil {
+		return nil
+	}
+	var value interface{}
+	if err := decodeJsonNumbers(marshaled, &value); err != nil {
+		return err
+	}
+	return pi.OutputSchema.Validate(value)
+}
+
+// rejectRecord sends a record which failed schema validation to
+// `output_reject_url`, with the error under `output_reject_error_key`
+func (pi *PInstance) rejectRecord(record StringifiedRecordType, schemaErr error) {
+	log := pi.Log
+	pi.Metrics.Inc(METRIC_RECORDS_REJECT)
+	record[pi.Config.OutputRejectErrorKey] = schemaErr.Error()
+	json, err := json.Marshal(record)
+	if err != nil {
+		log.Error.Printf("Failed to marshal as JSON: %v (%#v)\n", err, record)
+		return
+	}
+	if pi.RejectJsonChan == nil {
+		log.Info.Printf("Rejected => %s\n", json)
+		return
+	}
+	log.Info.Printf("Sending rejected => %s\n", json)
+	pi.RejectJsonChan <- &json
+}
+
+// summaryTime formats the times of a summary as RFC 3339 in UTC, whatever
+// `output_time_format` is, as that may be unset or lose precision
+func summaryTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339Nano)
+}
 
+// sendSummary is called when a `summarize` window closes, and sends the
+// first record of the window along with how often its key was seen. The
+// summary fields are added after shaping, so `keep_fields` need not list
+// them.
+func (pi *PInstance) sendSummary(entry *DedupEntry) {
+	if entry.Suppressed {
+		pi.Log.Debug.Printf("Skipping summary as sent by another instance: first_seen=%s\n", entry.FirstSeen)
+		return
+	}
+	record := pi.shapeRecord(entry.Record)
+	record[SUMMARY_DUP_COUNT_KEY] = entry.Count
+	record[SUMMARY_FIRST_SEEN_KEY] = summaryTime(entry.FirstSeen)
+	record[SUMMARY_LAST_SEEN_KEY] = summaryTime(entry.LastSeen)
+	pi.Metrics.Inc(METRIC_SUMMARIES_SENT)
+	pi.queueRecord(record, entry.FirstSeen, entry.Original)
 }
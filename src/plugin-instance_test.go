@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+// newTestPInstance returns an instance which queues records rather than
+// posting them
+func newTestPInstance(t *testing.T, conf *Config) *PInstance {
+	if conf.OutputTimeLocation == nil {
+		conf.OutputTimeLocation = time.UTC
+	}
+	timeFormatter, err := newTimeFormatter(conf.OutputTimeFormat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &PInstance{
+		Config:         conf,
+		EventJsonChan:  make(chan *[]byte, 10),
+		RejectJsonChan: make(chan *[]byte, 10),
+		Log:            Logger("error", ""),
+		Metrics:        newMetrics(),
+		TimeFormatter:  timeFormatter,
+	}
+}
+
+// queued returns the next queued record
+func queued(t *testing.T, pi *PInstance) map[string]interface{} {
+	select {
+	case raw := <-pi.EventJsonChan:
+		var record map[string]interface{}
+		if err := json.Unmarshal(*raw, &record); err != nil {
+			t.Fatal(err)
+		}
+		return record
+	default:
+		t.Fatal("no record queued")
+	}
+	return nil
+}
+
+func TestSendSummary(t *testing.T) {
+	first := time.Date(2024, 3, 1, 10, 0, 0, 500000000, time.FixedZone("", 3600))
+	entry := &DedupEntry{
+		FirstSeen: first,
+		LastSeen:  first.Add(time.Minute),
+		Original:  first.Add(time.Second),
+		Count:     3,
+		Record:    StringifiedRecordType{"v": "a"},
+	}
+
+	// `output_time_format` is unset by default; summary times do not use it
+	pi := newTestPInstance(t, &Config{OutputTimeKey: "time", OutputOriginalTimeKey: "ingested"})
+	pi.sendSummary(entry)
+	record := queued(t, pi)
+	for key, want := range map[string]interface{}{
+		"v":                    "a",
+		SUMMARY_DUP_COUNT_KEY:  float64(3),
+		SUMMARY_FIRST_SEEN_KEY: "2024-03-01T09:00:00.5Z",
+		SUMMARY_LAST_SEEN_KEY:  "2024-03-01T09:01:00.5Z",
+	} {
+		if record[key] != want {
+			t.Errorf("%s: got %#v, want %#v", key, record[key], want)
+		}
+	}
+
+	// the record is sent at its event time, with its Fluent Bit time
+	pi = newTestPInstance(t, &Config{
+		OutputTimeKey:         "time",
+		OutputTimeFormat:      "%s",
+		OutputTimeAsInteger:   true,
+		OutputOriginalTimeKey: "ingested",
+	})
+	pi.sendSummary(entry)
+	record = queued(t, pi)
+	if record["time"] != float64(first.Unix()) || record["ingested"] != float64(first.Unix()+1) {
+		t.Fatalf("sent %v", record)
+	}
+
+	// a window claimed by another instance is not summarized here
+	entry.Suppressed = true
+	pi.sendSummary(entry)
+	select {
+	case raw := <-pi.EventJsonChan:
+		t.Fatalf("suppressed summary sent: %s", *raw)
+	default:
+	}
+}
+
+func TestSendWithoutKey(t *testing.T) {
+	placeholder := "-"
+	now := time.Now()
+	for _, test := range []struct {
+		policy string
+		sent   bool
+	}{
+		{DEDUP_MISSING_KEY_SKIP, false},
+		{DEDUP_MISSING_KEY_PASS, true},
+	} {
+		pi := newTestPInstance(t, &Config{DedupMissingKey: test.policy})
+		record := StringifiedRecordType{"v": "a"}
+		_, keyErr := generateDeduplicationKeyFromRecordValues([]string{"id"}, record, nil)
+		if keyErr == nil {
+			t.Fatalf("%s: no error for a missing key", test.policy)
+		}
+		pi.sendWithoutKey(record, now, now, 1, keyErr)
+		if sent := len(pi.EventJsonChan) == 1; sent != test.sent {
+			t.Errorf("%s: sent %v, want %v", test.policy, sent, test.sent)
+		}
+		if missing := pi.Metrics.Snapshot()[METRIC_DEDUP_NO_KEY]; missing != uint64(1) {
+			t.Errorf("%s: %s %v, want 1", test.policy, METRIC_DEDUP_NO_KEY, missing)
+		}
+	}
+
+	// with a placeholder, the key is generated and the record deduplicated
+	if key, err := generateDeduplicationKeyFromRecordValues([]string{"id"}, StringifiedRecordType{}, &placeholder); err != nil || key != "-" {
+		t.Fatalf("placeholder key %q, %v", key, err)
+	}
+}
+
+func TestShapeRecord(t *testing.T) {
+	newRecord := func() StringifiedRecordType {
+		return StringifiedRecordType{
+			"a":   int64(1),
+			"b":   "b",
+			"n":   map[string]interface{}{"x": map[string]interface{}{"y": "y", "z": "z"}, "w": "w"},
+			"r":   "r",
+			"d.e": "dotted",
+		}
+	}
+	for _, test := range []struct {
+		name string
+		conf *Config
+		want string
+	}{
+		{"unchanged", &Config{}, `{"a":1,"b":"b","d.e":"dotted","n":{"w":"w","x":{"y":"y","z":"z"}},"r":"r"}`},
+		// each step refers to the names the one before left
+		{"keep, remove, rename then move", &Config{
+			KeepFields:   []string{"a", "n.x", "r", "d.e"},
+			RemoveFields: []string{"n.x.y", "b"},
+			RenameFields: []KeyValue{{"r", "renamed"}, {"n.x.z", "z2"}, {"b", "c"}},
+			MoveFields:   []KeyValue{{"renamed", "meta"}, {"a", "meta.ids"}, {"d.e", "meta"}, {"r", "other"}},
+		}, `{"meta":{"d.e":"dotted","ids":{"a":1},"renamed":"r"},"n":{"x":{}},"z2":"z"}`},
+		{"rename into a path", &Config{
+			RenameFields: []KeyValue{{"a", "ids.a"}, {"ids.a", "ids.first"}},
+		}, `{"b":"b","d.e":"dotted","ids":{"first":1},"n":{"w":"w","x":{"y":"y","z":"z"}},"r":"r"}`},
+		// a nested field moves under its own name
+		{"move a nested field", &Config{
+			KeepFields: []string{"n.x.y"},
+			MoveFields: []KeyValue{{"n.x.y", "top"}},
+		}, `{"n":{"x":{}},"top":{"y":"y"}}`},
+		// a rename or move through a value which is not an object is undone
+		{"failed rename and move", &Config{
+			KeepFields:   []string{"a", "b"},
+			RenameFields: []KeyValue{{"a", "b.a"}},
+			MoveFields:   []KeyValue{{"b", "a"}},
+		}, `{"a":1,"b":"b"}`},
+	} {
+		pi := newTestPInstance(t, test.conf)
+		shaped, err := json.Marshal(pi.shapeRecord(newRecord()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(shaped) != test.want {
+			t.Errorf("%s: shaped\n\t%s\nwant\n\t%s", test.name, shaped, test.want)
+		}
+	}
+}
+
+func TestOutputTimeFields(t *testing.T) {
+	taipei := time.FixedZone("CST", 8*3600)
+	event := time.Date(2024, 3, 1, 20, 0, 0, 123000000, time.UTC)
+	original := event.Add(time.Second)
+	for _, test := range []struct {
+		conf   *Config
+		fields map[string]string
+		want   map[string]interface{}
+	}{
+		{
+			&Config{OutputTimeKey: "time", OutputTimeFormat: "%Y-%m-%dT%H:%M:%S.%L%z", OutputTimeLocation: taipei},
+			map[string]string{"day": "%Y-%m-%d", "ms": "%Q"},
+			map[string]interface{}{"time": "2024-03-02T04:00:00.123+0800", "day": "2024-03-02", "ms": "1709323200123"},
+		},
+		// every time field follows `output_time_integer`
+		{
+			&Config{OutputTimeKey: "time", OutputTimeFormat: "%s", OutputTimeAsInteger: true, OutputOriginalTimeKey: "ingested"},
+			map[string]string{"ms": "%Q", "text": "%H:%M"},
+			map[string]interface{}{"time": float64(1709323200), "ingested": float64(1709323201), "ms": float64(1709323200123), "text": "20:00"},
+		},
+	} {
+		pi := newTestPInstance(t, test.conf)
+		for key, pattern := range test.fields {
+			formatter, err := newTimeFormatter(pattern)
+			if err != nil {
+				t.Fatal(err)
+			}
+			pi.TimeFields = append(pi.TimeFields, outputTimeField{Key: key, Formatter: formatter})
+		}
+		pi.queueRecord(StringifiedRecordType{}, event, original)
+		record := queued(t, pi)
+		for key, want := range test.want {
+			if record[key] != want {
+				t.Errorf("%s: got %#v, want %#v", key, record[key], want)
+			}
+		}
+	}
+
+	// the processing time is when the record is queued
+	pi := newTestPInstance(t, &Config{OutputProcessingTimeKey: "processed", OutputTimeFormat: "%s", OutputTimeAsInteger: true})
+	before := time.Now().Unix()
+	pi.queueRecord(StringifiedRecordType{}, event, original)
+	if processed := queued(t, pi)["processed"].(float64); processed < float64(before) || processed > float64(time.Now().Unix()) {
+		t.Fatalf("processed at %v", processed)
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"math/bits"
+	"net"
+)
+
+type (
+	// ipKey is an IPv6 address (or IPv4-mapped IPv4 address) as 128 bits
+	ipKey struct {
+		hi uint64
+		lo uint64
+	}
+
+	prefixNode struct {
+		key    ipKey
+		length int
+		entry  *MatchEntry
+		child  [2]*prefixNode
+	}
+
+	// PrefixTree is a path compressed binary trie of IP prefixes, giving
+	// longest-prefix-wins lookups in at most 128 steps however many
+	// prefixes it holds. IPv4 prefixes are stored as IPv4-mapped IPv6.
+	PrefixTree struct {
+		root *prefixNode
+		size int
+	}
+)
+
+func ipKeyFrom(ip net.IP) ipKey {
+	ip16 := ip.To16()
+	var k ipKey
+	for i := 0; i < 8; i++ {
+		k.hi = k.hi<<8 | uint64(ip16[i])
+		k.lo = k.lo<<8 | uint64(ip16[i+8])
+	}
+	return k
+}
+
+// bit returns the i'th most significant bit
+func (k ipKey) bit(i int) int {
+	if i < 64 {
+		return int(k.hi>>(63-uint(i))) & 1
+	}
+	return int(k.lo>>(127-uint(i))) & 1
+}
+
+// mask keeps the `length` most significant bits
+func (k ipKey) mask(length int) ipKey {
+	switch {
+	case length <= 0:
+		return ipKey{}
+	case length < 64:
+		return ipKey{hi: k.hi &^ (^uint64(0) >> uint(length))}
+	case length < 128:
+		return ipKey{hi: k.hi, lo: k.lo &^ (^uint64(0) >> uint(length-64))}
+	}
+	return k
+}
+
+func commonPrefixLength(a ipKey, b ipKey) int {
+	if x := a.hi ^ b.hi; x != 0 {
+		return bits.LeadingZeros64(x)
+	}
+	return 64 + bits.LeadingZeros64(a.lo^b.lo)
+}
+
+func minInt(a int, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// parseCIDR returns the key and prefix length of an IPv4 or IPv6 CIDR block
+func parseCIDR(s string) (ipKey, int, bool) {
+	_, ipNet, err := net.ParseCIDR(s)
+	if err != nil {
+		return ipKey{}, 0, false
+	}
+	ones, size := ipNet.Mask.Size()
+	if size == 32 {
+		ones += 96
+	}
+	return ipKeyFrom(ipNet.IP).mask(ones), ones, true
+}
+
+// Insert adds a prefix. If the same prefix is already present, the entry
+// which takes precedence is kept.
+func (t *PrefixTree) Insert(key ipKey, length int, entry *MatchEntry) {
+	key = key.mask(length)
+	node := &t.root
+	for {
+		n := *node
+		if n == nil {
+			*node = &prefixNode{key: key, length: length, entry: entry}
+			t.size++
+			return
+		}
+		common := minInt(commonPrefixLength(n.key, key), minInt(n.length, length))
+		if common < n.length {
+			// the new prefix diverges within (or ends before) this node
+			split := &prefixNode{key: key.mask(common), length: common}
+			split.child[n.key.bit(common)] = n
+			*node = split
+			if common == length {
+				split.entry = entry
+			} else {
+				split.child[key.bit(common)] = &prefixNode{key: key, length: length, entry: entry}
+			}
+			t.size++
+			return
+		}
+		if n.length == length {
+			if n.entry == nil {
+				t.size++
+				n.entry = entry
+			} else if entry.before(n.entry) {
+				n.entry = entry
+			}
+			return
+		}
+		node = &n.child[key.bit(n.length)]
+	}
+}
+
+// LookupAll returns the entries of every prefix containing `ip`, shortest
+// first
+func (t *PrefixTree) LookupAll(ip net.IP) []*MatchEntry {
+	key := ipKeyFrom(ip)
+	var entries []*MatchEntry
+	for n := t.root; n != nil; {
+		if n.length > 0 && commonPrefixLength(n.key, key) < n.length {
+			break
+		}
+		if n.entry != nil {
+			entries = append(entries, n.entry)
+		}
+		if n.length == 128 {
+			break
+		}
+		n = n.child[key.bit(n.length)]
+	}
+	return entries
+}
+
+func (t *PrefixTree) Len() int {
+	return t.size
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func newTestPrefixTree(t *testing.T, cidrs ...string) *PrefixTree {
+	tree := &PrefixTree{}
+	for i, cidr := range cidrs {
+		key, length, ok := parseCIDR(cidr)
+		if !ok {
+			t.Fatalf("invalid CIDR %s", cidr)
+		}
+		tree.Insert(key, length, &MatchEntry{Pattern: cidr, Kind: MatchCIDR, Specificity: length, Order: i})
+	}
+	return tree
+}
+
+func lookupPatterns(tree *PrefixTree, ip string) string {
+	patterns := []string{}
+	for _, entry := range tree.LookupAll(net.ParseIP(ip)) {
+		patterns = append(patterns, entry.Pattern)
+	}
+	return strings.Join(patterns, " ")
+}
+
+func TestPrefixTreeLookup(t *testing.T) {
+	tree := newTestPrefixTree(t,
+		"10.0.0.0/8",
+		"10.1.0.0/16",
+		"10.1.2.0/24",
+		"10.1.2.3/32",
+		"192.168.0.0/16",
+		"0.0.0.0/0",
+		"2001:db8::/32",
+		"2001:db8:1::/48",
+		"2001:db8:1::1/128",
+		"::/0",
+	)
+
+	for _, test := range []struct {
+		ip   string
+		want string // every containing prefix, shortest (least specific) first
+	}{
+		// IPv4, overlapping prefixes down to /32
+		{"10.1.2.3", "::/0 0.0.0.0/0 10.0.0.0/8 10.1.0.0/16 10.1.2.0/24 10.1.2.3/32"},
+		{"10.1.2.4", "::/0 0.0.0.0/0 10.0.0.0/8 10.1.0.0/16 10.1.2.0/24"},
+		{"10.1.3.1", "::/0 0.0.0.0/0 10.0.0.0/8 10.1.0.0/16"},
+		{"10.2.0.1", "::/0 0.0.0.0/0 10.0.0.0/8"},
+		{"192.168.255.255", "::/0 0.0.0.0/0 192.168.0.0/16"},
+		{"11.0.0.1", "::/0 0.0.0.0/0"},
+		// IPv4-mapped IPv6 is the same address as IPv4
+		{"::ffff:10.1.2.3", "::/0 0.0.0.0/0 10.0.0.0/8 10.1.0.0/16 10.1.2.0/24 10.1.2.3/32"},
+		// IPv6, overlapping prefixes down to /128; 0.0.0.0/0 covers only IPv4
+		{"2001:db8:1::1", "::/0 2001:db8::/32 2001:db8:1::/48 2001:db8:1::1/128"},
+		{"2001:db8:1::2", "::/0 2001:db8::/32 2001:db8:1::/48"},
+		{"2001:db8:2::1", "::/0 2001:db8::/32"},
+		{"2001:db9::1", "::/0"},
+		{"::1", "::/0"},
+	} {
+		if got := lookupPatterns(tree, test.ip); got != test.want {
+			t.Errorf("%s: got %q, want %q", test.ip, got, test.want)
+		}
+	}
+}
+
+func TestPrefixTreeNoDefaultRoute(t *testing.T) {
+	tree := newTestPrefixTree(t, "10.1.2.0/24", "10.1.0.0/16", "172.16.0.0/12", "fd00::/8")
+	for _, test := range []struct {
+		ip   string
+		want string
+	}{
+		// prefixes inserted longest first still nest correctly
+		{"10.1.2.9", "10.1.0.0/16 10.1.2.0/24"},
+		{"172.31.255.255", "172.16.0.0/12"},
+		{"172.32.0.0", ""},
+		{"fdff::1", "fd00::/8"},
+		{"fe00::1", ""},
+		{"10.0.0.1", ""},
+	} {
+		if got := lookupPatterns(tree, test.ip); got != test.want {
+			t.Errorf("%s: got %q, want %q", test.ip, got, test.want)
+		}
+	}
+	if tree.Len() != 4 {
+		t.Fatalf("tree holds %d prefixes, want 4", tree.Len())
+	}
+}
+
+func TestPrefixTreeDuplicatePrefix(t *testing.T) {
+	tree := &PrefixTree{}
+	key, length, _ := parseCIDR("10.0.0.0/8")
+	low := &MatchEntry{Pattern: "low", Kind: MatchCIDR, Order: 0}
+	high := &MatchEntry{Pattern: "high", Kind: MatchCIDR, Order: 1, Priority: 5}
+	later := &MatchEntry{Pattern: "later", Kind: MatchCIDR, Order: 2}
+	tree.Insert(key, length, low)
+	tree.Insert(key, length, high)
+	tree.Insert(key, length, later)
+	if got := lookupPatterns(tree, "10.9.9.9"); got != "high" {
+		t.Fatalf("got %q, want the entry with precedence", got)
+	}
+	if tree.Len() != 1 {
+		t.Fatalf("tree holds %d prefixes, want 1", tree.Len())
+	}
+
+	// host bits beyond the prefix length are ignored
+	key, length, _ = parseCIDR("10.1.2.3/8")
+	tree.Insert(key, length, &MatchEntry{Pattern: "masked", Kind: MatchCIDR, Order: 3})
+	if tree.Len() != 1 {
+		t.Fatalf("tree holds %d prefixes after inserting an unmasked duplicate", tree.Len())
+	}
+}
+
+func TestMatchMapLongestCIDRWins(t *testing.T) {
+	entries := []*MatchEntry{}
+	for _, cidr := range []string{"10.0.0.0/8", "10.1.2.0/24", "10.1.0.0/16", "::ffff:10.1.2.128/121"} {
+		entry, err := newMatchEntry("rip", MatchCIDR, cidr, map[string]interface{}{"net": cidr}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, entry)
+	}
+	matchMap := compileMatchMap(entries)
+	for ip, want := range map[string]string{
+		"10.1.2.200": "::ffff:10.1.2.128/121",
+		"10.1.2.3":   "10.1.2.0/24",
+		"10.1.9.9":   "10.1.0.0/16",
+		"10.9.9.9":   "10.0.0.0/8",
+	} {
+		entry, _, ok := matchRecordToMatchMap(StringifiedRecordType{"rip": ip}, matchMap)
+		if !ok || entry.Pattern != want {
+			t.Errorf("%s: matched %v, want %s", ip, entry, want)
+		}
+	}
+	if _, _, ok := matchRecordToMatchMap(StringifiedRecordType{"rip": "11.0.0.1"}, matchMap); ok {
+		t.Error("11.0.0.1 matched")
+	}
+}
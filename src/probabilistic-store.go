@@ -0,0 +1,252 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"sync"
+	"time"
+)
+
+type (
+	bloomFilter struct {
+		start   time.Time
+		words   []uint64
+		size    uint64
+		hashes  uint64
+		setBits uint64
+		added   uint64
+	}
+
+	// ProbabilisticStore remembers keys in a ring of Bloom filters, one per
+	// sub-window of the TTL. A key is a duplicate if any live filter may
+	// contain it, so keys are protected for between TTL and TTL plus one
+	// sub-window, with a small chance of false positives (records wrongly
+	// treated as duplicates) but no false negatives.
+	ProbabilisticStore struct {
+		lock     sync.Mutex
+		window   time.Duration
+		filters  []*bloomFilter
+		bitsEach uint64
+		hashes   uint64
+		metrics  *Metrics
+	}
+)
+
+func newBloomFilter(start time.Time, size uint64, hashes uint64) *bloomFilter {
+	return &bloomFilter{
+		start:  start,
+		words:  make([]uint64, (size+63)/64),
+		size:   size,
+		hashes: hashes,
+	}
+}
+
+// mix64 is the splitmix64 finalizer, which spreads FNV's weak high bits
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// bloomHashes derives two independent 64 bit hashes for double hashing
+func bloomHashes(key string) (uint64, uint64) {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	sum := h.Sum64()
+	return mix64(sum), mix64(sum^0x9e3779b97f4a7c15) | 1
+}
+
+func (b *bloomFilter) add(h1 uint64, h2 uint64) {
+	for i := uint64(0); i < b.hashes; i++ {
+		bit := (h1 + i*h2) % b.size
+		mask := uint64(1) << (bit % 64)
+		if b.words[bit/64]&mask == 0 {
+			b.words[bit/64] |= mask
+			b.setBits++
+		}
+	}
+	b.added++
+}
+
+func (b *bloomFilter) contains(h1 uint64, h2 uint64) bool {
+	for i := uint64(0); i < b.hashes; i++ {
+		bit := (h1 + i*h2) % b.size
+		if b.words[bit/64]&(uint64(1)<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (b *bloomFilter) fill() float64 {
+	return float64(b.setBits) / float64(b.size)
+}
+
+func (b *bloomFilter) reset(start time.Time) {
+	for i := range b.words {
+		b.words[i] = 0
+	}
+	b.start = start
+	b.setBits = 0
+	b.added = 0
+}
+
+// newProbabilisticStore splits `memoryBytes` across windows+1 filters (the
+// extra filter keeps the oldest sub-window covered while it ages out), and
+// picks the number of hash functions for the target false positive rate.
+func newProbabilisticStore(
+	ttl time.Duration,
+	windows uint64,
+	memoryBytes uint64,
+	falsePositiveRate float64,
+	metrics *Metrics,
+) (*ProbabilisticStore, error) {
+	if windows < 1 {
+		return nil, fmt.Errorf("At least one window is required")
+	}
+	if falsePositiveRate <= 0 || falsePositiveRate >= 1 {
+		return nil, fmt.Errorf("False positive rate must be between 0 and 1: %v", falsePositiveRate)
+	}
+	bitsEach := memoryBytes * 8 / (windows + 1)
+	if bitsEach < 64 {
+		return nil, fmt.Errorf("Memory budget too small: %d bytes", memoryBytes)
+	}
+	hashes := uint64(math.Ceil(-math.Log2(falsePositiveRate)))
+	p := &ProbabilisticStore{
+		window:   ttl / time.Duration(windows),
+		filters:  make([]*bloomFilter, windows+1),
+		bitsEach: bitsEach,
+		hashes:   hashes,
+		metrics:  metrics,
+	}
+	if p.window <= 0 {
+		p.window = time.Second
+	}
+	now := time.Now().Truncate(p.window)
+	for i := range p.filters {
+		p.filters[i] = newBloomFilter(now.Add(-time.Duration(i)*p.window), bitsEach, hashes)
+	}
+	p.metrics.Set(METRIC_PROBABILISTIC_CAPACITY, float64(p.capacity()))
+	p.updateGaugesLocked()
+	return p, nil
+}
+
+// capacity is the number of keys per sub-window at the target error rate
+func (p *ProbabilisticStore) capacity() uint64 {
+	return uint64(float64(p.bitsEach) * math.Ln2 / float64(p.hashes))
+}
+
+// rotateLocked recycles filters whose sub-window has aged out, so filters[0]
+// always covers `now`
+func (p *ProbabilisticStore) rotateLocked(now time.Time) int {
+	rotated := 0
+	for !now.Before(p.filters[0].start.Add(p.window)) && rotated < len(p.filters) {
+		oldest := p.filters[len(p.filters)-1]
+		copy(p.filters[1:], p.filters[:len(p.filters)-1])
+		oldest.reset(p.filters[1].start.Add(p.window))
+		p.filters[0] = oldest
+		rotated++
+	}
+	if rotated == len(p.filters) {
+		// idle for longer than the ring: realign to the current window
+		start := now.Truncate(p.window)
+		for i, filter := range p.filters {
+			filter.start = start.Add(-time.Duration(i) * p.window)
+		}
+	}
+	return rotated
+}
+
+func (p *ProbabilisticStore) updateGaugesLocked() {
+	current := p.filters[0]
+	missProbability := 1.0
+	for _, filter := range p.filters {
+		missProbability *= 1 - math.Pow(filter.fill(), float64(p.hashes))
+	}
+	p.metrics.Set(METRIC_PROBABILISTIC_FILL, current.fill())
+	p.metrics.Set(METRIC_PROBABILISTIC_KEYS, float64(current.added))
+	p.metrics.Set(METRIC_PROBABILISTIC_FP_RATE, 1-missProbability)
+}
+
+// Get reports whether a key may have been seen. As filters only hold
+// membership, the returned entry carries just the start of the sub-window.
+func (p *ProbabilisticStore) Get(key string, now time.Time) (interface{}, bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.rotateLocked(now)
+	h1, h2 := bloomHashes(key)
+	for _, filter := range p.filters {
+		if filter.contains(h1, h2) {
+			return &DedupEntry{FirstSeen: filter.start, LastSeen: filter.start}, true
+		}
+	}
+	return nil, false
+}
+
+func (p *ProbabilisticStore) Peek(key string, now time.Time) (interface{}, time.Time, bool) {
+	entry, found := p.Get(key, now)
+	return entry, time.Time{}, found
+}
+
+// Remove is not possible, as keys cannot be removed from a Bloom filter
+func (p *ProbabilisticStore) Remove(key string) bool {
+	return false
+}
+
+// RemovePrefix can only remove every key, i.e. with an empty prefix
+func (p *ProbabilisticStore) RemovePrefix(prefix string) int {
+	if len(prefix) > 0 {
+		return 0
+	}
+	return p.Purge()
+}
+
+// Add records a key in the current sub-window; `value` and `expires` are
+// ignored as every key lives for the TTL
+func (p *ProbabilisticStore) Add(key string, _ interface{}, _ time.Time) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.rotateLocked(time.Now())
+	h1, h2 := bloomHashes(key)
+	p.filters[0].add(h1, h2)
+	return false
+}
+
+func (p *ProbabilisticStore) RemoveExpired(now time.Time) int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	rotated := p.rotateLocked(now)
+	p.updateGaugesLocked()
+	return rotated
+}
+
+func (p *ProbabilisticStore) Purge() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	count := p.lenLocked()
+	now := time.Now().Truncate(p.window)
+	for i, filter := range p.filters {
+		filter.reset(now.Add(-time.Duration(i) * p.window))
+	}
+	p.updateGaugesLocked()
+	return count
+}
+
+func (p *ProbabilisticStore) lenLocked() int {
+	total := uint64(0)
+	for _, filter := range p.filters {
+		total += filter.added
+	}
+	return int(total)
+}
+
+// Len is the number of keys added across live sub-windows
+func (p *ProbabilisticStore) Len() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.lenLocked()
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func newTestProbabilisticStore(t *testing.T, ttl time.Duration, windows uint64, memoryBytes uint64, rate float64) *ProbabilisticStore {
+	p, err := newProbabilisticStore(ttl, windows, memoryBytes, rate, newMetrics())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// advance moves the store's clock, as Add always uses the current time
+func advance(p *ProbabilisticStore, now time.Time) {
+	p.RemoveExpired(now)
+}
+
+func TestProbabilisticStoreNoFalseNegatives(t *testing.T) {
+	const windows = 4
+	ttl := 4 * time.Minute
+	p := newTestProbabilisticStore(t, ttl, windows, 64*1024, 0.001)
+
+	// add a batch of keys every half sub-window, across several rotations,
+	// checking every key added within the TTL is still found
+	type batch struct {
+		at   time.Time
+		keys []string
+	}
+	batches := []batch{}
+	start := time.Now().Add(time.Hour)
+	for step := 0; step < 6*windows; step++ {
+		now := start.Add(time.Duration(step) * p.window / 2)
+		advance(p, now)
+		b := batch{at: now}
+		for i := 0; i < 50; i++ {
+			key := "step" + strconv.Itoa(step) + ":" + strconv.Itoa(i)
+			p.Add(key, nil, now.Add(ttl))
+			b.keys = append(b.keys, key)
+		}
+		batches = append(batches, b)
+
+		for _, earlier := range batches {
+			if now.Sub(earlier.at) > ttl {
+				continue
+			}
+			for _, key := range earlier.keys {
+				if _, found := p.Get(key, now); !found {
+					t.Fatalf("key %s added %s ago not found (TTL %s)", key, now.Sub(earlier.at), ttl)
+				}
+			}
+		}
+	}
+
+	// keys are forgotten once TTL plus one sub-window has passed
+	later := batches[len(batches)-1].at.Add(ttl + p.window)
+	forgotten := 0
+	for _, key := range batches[0].keys {
+		if _, found := p.Get(key, later); !found {
+			forgotten++
+		}
+	}
+	if forgotten < len(batches[0].keys)-1 {
+		t.Fatalf("only %d of %d expired keys forgotten", forgotten, len(batches[0].keys))
+	}
+}
+
+func TestProbabilisticStoreFalsePositiveRate(t *testing.T) {
+	const windows = 4
+	const rate = 0.01
+	p := newTestProbabilisticStore(t, 4*time.Minute, windows, 64*1024, rate)
+	capacity := int(p.capacity())
+	if capacity < 1000 {
+		t.Fatalf("capacity %d too small for a meaningful test", capacity)
+	}
+
+	// fill every sub-window to capacity
+	now := time.Now().Add(time.Hour)
+	for w := 0; w <= windows; w++ {
+		advance(p, now.Add(time.Duration(w)*p.window))
+		for i := 0; i < capacity; i++ {
+			p.Add("added:"+strconv.Itoa(w)+":"+strconv.Itoa(i), nil, time.Time{})
+		}
+	}
+	now = now.Add(windows * p.window)
+
+	const probes = 50000
+	positives := 0
+	for i := 0; i < probes; i++ {
+		if _, found := p.Get("absent:"+strconv.Itoa(i), now); found {
+			positives++
+		}
+	}
+	measured := float64(positives) / probes
+
+	// each live filter is at the target rate, so a key is wrongly found
+	// with probability 1-(1-rate)^filters; allow for sampling error
+	bound := 1 - math.Pow(1-rate, windows+1)
+	if measured > 1.25*bound {
+		t.Fatalf("false positive rate %.4f exceeds %.4f at capacity %d", measured, 1.25*bound, capacity)
+	}
+	if gauge := p.metrics.Snapshot()[METRIC_PROBABILISTIC_FP_RATE].(float64); gauge > 1.25*bound {
+		t.Fatalf("estimated false positive rate %.4f exceeds %.4f", gauge, 1.25*bound)
+	}
+}
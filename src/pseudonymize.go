@@ -0,0 +1,80 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+)
+
+var (
+	maskIPv4 = net.CIDRMask(24, 32)
+	maskIPv6 = net.CIDRMask(48, 128)
+)
+
+// hashValue returns the hex HMAC-SHA256 of a value, truncated to `length`
+// characters if non-zero
+func hashValue(secret []byte, value interface{}, length int) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(keyString(value)))
+	sum := hex.EncodeToString(mac.Sum(nil))
+	if length > 0 && length < len(sum) {
+		return sum[:length]
+	}
+	return sum
+}
+
+// maskIP truncates an IPv4 address to its /24, or an IPv6 address to its
+// /48
+func maskIP(value interface{}) (string, bool) {
+	str, isScalar := scalarString(value)
+	if !isScalar {
+		return "", false
+	}
+	ip := net.ParseIP(str)
+	if ip == nil {
+		return "", false
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(maskIPv4).String(), true
+	}
+	return ip.Mask(maskIPv6).String(), true
+}
+
+// pseudonymize hashes, masks and redacts fields as configured. It runs
+// after matching and dedup key generation, which see the real values, and
+// before any value leaves the host.
+func (pi *PInstance) pseudonymize(record StringifiedRecordType) {
+
+	conf := pi.Config
+
+	for _, field := range conf.HashFields {
+		if value, exists := lookupField(record, field); exists && value != nil {
+			replaceField(record, field, hashValue([]byte(conf.HashSecret), value, conf.HashLength))
+		}
+	}
+
+	for _, field := range conf.MaskFields {
+		value, exists := lookupField(record, field)
+		if !exists || value == nil {
+			continue
+		}
+		if masked, isIP := maskIP(value); isIP {
+			replaceField(record, field, masked)
+		} else {
+			// never pass on a value we were asked to mask
+			pi.Log.Debug.Printf("Removing field which is not an IP address: %s\n", field)
+			deleteField(record, field)
+		}
+	}
+
+	for _, field := range conf.RedactFields {
+		value, exists := lookupField(record, field)
+		if !exists {
+			continue
+		}
+		if str, isString := value.(string); isString {
+			replaceField(record, field, conf.RedactRegexp.ReplaceAllString(str, conf.RedactReplacement))
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"reflect"
+	"regexp"
+	"testing"
+)
+
+func TestHashValue(t *testing.T) {
+	secret := []byte("secret")
+	full := hashValue(secret, "value", 0)
+	if len(full) != 64 {
+		t.Fatalf("hash %q, want 64 hex characters", full)
+	}
+	for _, test := range []struct {
+		length int
+		want   string
+	}{
+		{0, full},
+		{1, full[:1]},
+		{16, full[:16]},
+		{64, full},
+		{100, full},
+		{-1, full},
+	} {
+		if hashed := hashValue(secret, "value", test.length); hashed != test.want {
+			t.Errorf("length %d: %q, want %q", test.length, hashed, test.want)
+		}
+	}
+	if hashValue([]byte("other"), "value", 0) == full {
+		t.Fatal("hash does not depend on the secret")
+	}
+	if hashValue(secret, "other", 0) == full {
+		t.Fatal("hash does not depend on the value")
+	}
+	// values hash by their key form, so a number and its string agree
+	if hashValue(secret, int64(1), 0) != hashValue(secret, "1", 0) {
+		t.Fatal("1 and \"1\" hash differently")
+	}
+}
+
+func TestMaskIP(t *testing.T) {
+	for _, test := range []struct {
+		value interface{}
+		want  string
+		isIP  bool
+	}{
+		{"192.168.1.77", "192.168.1.0", true},
+		{"10.0.0.255", "10.0.0.0", true},
+		{"::ffff:10.1.2.3", "10.1.2.0", true},
+		{"2001:db8:abcd:1234::1", "2001:db8:abcd::", true},
+		{"2001:db8:abcd:ffff:ffff:ffff:ffff:ffff", "2001:db8:abcd::", true},
+		{"::1", "::", true},
+		{"10.1.2.3/24", "", false},
+		{"10.1.2", "", false},
+		{"host.example", "", false},
+		{"", "", false},
+		{int64(167772161), "", false},
+		{[]interface{}{"10.1.2.3"}, "", false},
+	} {
+		masked, isIP := maskIP(test.value)
+		if masked != test.want || isIP != test.isIP {
+			t.Errorf("%#v: masked %q, %v, want %q, %v", test.value, masked, isIP, test.want, test.isIP)
+		}
+	}
+}
+
+func TestPseudonymize(t *testing.T) {
+	conf := &Config{
+		HashFields:        []string{"user", "req.session", "n", "missing", "null"},
+		HashSecret:        "secret",
+		HashLength:        12,
+		MaskFields:        []string{"rip", "req.ip", "host", "empty"},
+		RedactFields:      []string{"msg", "req.body", "count"},
+		RedactRegexp:      regexp.MustCompile(`(token|password)=\S+`),
+		RedactReplacement: "$1=REDACTED",
+	}
+	record := StringifiedRecordType{
+		"user":  "alice",
+		"n":     int64(7),
+		"null":  nil,
+		"rip":   "192.168.1.77",
+		"host":  "db.internal",
+		"empty": nil,
+		"msg":   "login password=hunter2 ok token=abc",
+		"count": int64(3),
+		"req": map[string]interface{}{
+			"session": "s1",
+			"ip":      "2001:db8:abcd:1234::1",
+			"body":    "nothing secret",
+		},
+	}
+	pi := newTestPInstance(t, conf)
+	pi.pseudonymize(record)
+
+	secret := []byte("secret")
+	want := StringifiedRecordType{
+		"user":  hashValue(secret, "alice", 12),
+		"n":     hashValue(secret, int64(7), 12),
+		"null":  nil,
+		"rip":   "192.168.1.0",
+		"empty": nil,
+		"msg":   "login password=REDACTED ok token=REDACTED",
+		"count": int64(3),
+		"req": map[string]interface{}{
+			"session": hashValue(secret, "s1", 12),
+			"ip":      "2001:db8:abcd::",
+			"body":    "nothing secret",
+		},
+	}
+	// `host` is not an IP address, so is removed rather than passed on
+	if !reflect.DeepEqual(record, want) {
+		t.Fatalf("pseudonymized\n\t%v\nwant\n\t%v", record, want)
+	}
+}
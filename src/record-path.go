@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Record values are addressed by field name, by a dotted path such as
+// "kubernetes.pod_name", or by a JSON pointer such as "/kubernetes/pod_name"
+// (needed when names contain dots). Numeric segments index arrays. A top
+// level field whose name is the whole path is preferred to a nested one.
+
+var jsonPointerUnescaper = strings.NewReplacer("~1", "/", "~0", "~")
+
+func splitFieldPath(path string) []string {
+	if strings.HasPrefix(path, "/") {
+		segments := strings.Split(path[1:], "/")
+		for i, segment := range segments {
+			segments[i] = jsonPointerUnescaper.Replace(segment)
+		}
+		return segments
+	}
+	return strings.Split(path, ".")
+}
+
+func childValue(parent interface{}, segment string) (interface{}, bool) {
+	switch p := parent.(type) {
+	case map[string]interface{}:
+		value, exists := p[segment]
+		return value, exists
+	case StringifiedRecordType:
+		value, exists := p[segment]
+		return value, exists
+	case []interface{}:
+		i, err := strconv.Atoi(segment)
+		if err != nil || i < 0 || i >= len(p) {
+			return nil, false
+		}
+		return p[i], true
+	}
+	return nil, false
+}
+
+// lookupField returns the value at a path within a record
+func lookupField(record StringifiedRecordType, path string) (interface{}, bool) {
+	if value, exists := record[path]; exists {
+		return value, true
+	}
+	var value interface{} = record
+	for _, segment := range splitFieldPath(path) {
+		var exists bool
+		if value, exists = childValue(value, segment); !exists {
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+// deleteField removes the value at a path within a record, returning false
+// if there was none. Array elements cannot be removed.
+func deleteField(record StringifiedRecordType, path string) bool {
+	if _, exists := record[path]; exists {
+		delete(record, path)
+		return true
+	}
+	segments := splitFieldPath(path)
+	var parent interface{} = record
+	for _, segment := range segments[:len(segments)-1] {
+		var exists bool
+		if parent, exists = childValue(parent, segment); !exists {
+			return false
+		}
+	}
+	last := segments[len(segments)-1]
+	switch p := parent.(type) {
+	case map[string]interface{}:
+		_, exists := p[last]
+		delete(p, last)
+		return exists
+	case StringifiedRecordType:
+		_, exists := p[last]
+		delete(p, last)
+		return exists
+	}
+	return false
+}
+
+// setFieldPath sets the value at a path within a record, creating objects
+// along the way as needed. It fails if the path runs into a value which is
+// not an object.
+func setFieldPath(record StringifiedRecordType, segments []string, value interface{}) bool {
+	parent := map[string]interface{}(record)
+	for _, segment := range segments[:len(segments)-1] {
+		child, exists := parent[segment]
+		if !exists {
+			child = make(map[string]interface{})
+			parent[segment] = child
+		}
+		object, isObject := child.(map[string]interface{})
+		if !isObject {
+			return false
+		}
+		parent = object
+	}
+	parent[segments[len(segments)-1]] = value
+	return true
+}
+
+// setField sets the value at a path within a record
+func setField(record StringifiedRecordType, path string, value interface{}) bool {
+	return setFieldPath(record, splitFieldPath(path), value)
+}
+
+// replaceField replaces the value at a path within a record, preferring a
+// top level field whose name is the whole path as lookupField does
+func replaceField(record StringifiedRecordType, path string, value interface{}) bool {
+	if _, exists := record[path]; exists {
+		record[path] = value
+		return true
+	}
+	return setField(record, path, value)
+}
+
+// copyValue deep copies the maps and arrays within a value, so that fields
+// can be removed from the copy
+func copyValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		copied := make(map[string]interface{}, len(v))
+		for k, item := range v {
+			copied[k] = copyValue(item)
+		}
+		return copied
+	case []interface{}:
+		copied := make([]interface{}, len(v))
+		for i, item := range v {
+			copied[i] = copyValue(item)
+		}
+		return copied
+	}
+	return value
+}
+
+func copyRecord(record StringifiedRecordType) StringifiedRecordType {
+	copied := make(StringifiedRecordType, len(record))
+	for k, v := range record {
+		copied[k] = copyValue(v)
+	}
+	return copied
+}
+
+// scalarString returns the string form of a string, number or boolean
+// record value, so that it can be matched against the match map
+func scalarString(value interface{}) (string, bool) {
+	switch v := value.(type) {
+	case string:
+		return v, true
+	case int64, uint64, int, float64, float32, bool:
+		return fmt.Sprint(v), true
+	}
+	return "", false
+}
+
+// keyString returns the form of a record value used in dedup keys: scalars
+// as themselves, and maps and arrays as (key sorted) JSON
+func keyString(value interface{}) string {
+	if str, isScalar := scalarString(value); isScalar {
+		return str
+	}
+	switch value.(type) {
+	case map[string]interface{}, []interface{}:
+		if asJson, err := json.Marshal(value); err == nil {
+			return string(asJson)
+		}
+	}
+	return fmt.Sprint(value)
+}
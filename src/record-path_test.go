@@ -0,0 +1,149 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func testRecord() StringifiedRecordType {
+	return StringifiedRecordType{
+		"a.b": "top",
+		"a": map[string]interface{}{
+			"b": "nested",
+			"c": map[string]interface{}{"d": int64(1)},
+			"e": []interface{}{"x", map[string]interface{}{"f": "y"}},
+		},
+		"k/8s": map[string]interface{}{"~pod": "p"},
+		"s":    "str",
+	}
+}
+
+func TestLookupField(t *testing.T) {
+	record := testRecord()
+	for _, test := range []struct {
+		path   string
+		want   interface{}
+		exists bool
+	}{
+		// a top level field named by the whole path comes first
+		{"a.b", "top", true},
+		{"/a/b", "nested", true},
+		{"a.c.d", int64(1), true},
+		{"a.e.0", "x", true},
+		{"a.e.1.f", "y", true},
+		{"/a/e/1/f", "y", true},
+		{"a.e.2", nil, false},
+		{"a.e.-1", nil, false},
+		{"a.e.x", nil, false},
+		{"/k~18s/~0pod", "p", true},
+		{"k/8s", map[string]interface{}{"~pod": "p"}, true},
+		{"s.length", nil, false},
+		{"a.missing", nil, false},
+		{"missing", nil, false},
+	} {
+		value, exists := lookupField(record, test.path)
+		if exists != test.exists || !reflect.DeepEqual(value, test.want) {
+			t.Errorf("%s: got %#v, %v, want %#v, %v", test.path, value, exists, test.want, test.exists)
+		}
+	}
+}
+
+func TestDeleteAndSetField(t *testing.T) {
+	for _, test := range []struct {
+		path    string
+		deleted bool
+		check   string
+	}{
+		{"a.b", true, "/a/b"},
+		{"/a/b", true, "a.b"},
+		{"a.c.d", true, "a.b"},
+		{"/k~18s/~0pod", true, "a.b"},
+		// array elements and missing paths cannot be deleted
+		{"a.e.0", false, "a.e.0"},
+		{"a.x.y", false, "a.b"},
+		{"s.t", false, "s"},
+	} {
+		record := testRecord()
+		if deleted := deleteField(record, test.path); deleted != test.deleted {
+			t.Errorf("delete %s: %v, want %v", test.path, deleted, test.deleted)
+		}
+		if _, exists := lookupField(record, test.check); !exists {
+			t.Errorf("delete %s: removed %s too", test.path, test.check)
+		}
+		if test.deleted {
+			if value, exists := lookupField(record, test.path); exists && test.path != "a.b" {
+				t.Errorf("delete %s: still %v", test.path, value)
+			}
+		}
+	}
+
+	record := testRecord()
+	for _, test := range []struct {
+		path string
+		set  bool
+	}{
+		{"new", true},
+		{"x.y.z", true},
+		{"/a/c/new", true},
+		{"a.c.d", true},
+		// through a value which is not an object
+		{"s.t", false},
+		{"a.e.0", false},
+	} {
+		if set := setField(record, test.path, "v"); set != test.set {
+			t.Errorf("set %s: %v, want %v", test.path, set, test.set)
+		}
+		if value, _ := lookupField(record, test.path); test.set && value != "v" {
+			t.Errorf("set %s: reads back %v", test.path, value)
+		}
+	}
+	if record["s"] != "str" || record["a.b"] != "top" {
+		t.Fatalf("failed sets changed the record: %v", record)
+	}
+
+	// replacing prefers the top level field, as lookups do
+	record = testRecord()
+	replaceField(record, "a.b", "replaced")
+	if record["a.b"] != "replaced" || record["a"].(map[string]interface{})["b"] != "nested" {
+		t.Fatalf("replaced %v", record)
+	}
+	replaceField(record, "a.c.d", int64(2))
+	if value, _ := lookupField(record, "a.c.d"); value != int64(2) {
+		t.Fatalf("replaced nested %v", value)
+	}
+}
+
+func TestCopyRecord(t *testing.T) {
+	record := testRecord()
+	copied := copyRecord(record)
+	deleteField(copied, "a.c.d")
+	copied["a"].(map[string]interface{})["e"].([]interface{})[0] = "changed"
+	if !reflect.DeepEqual(record, testRecord()) {
+		t.Fatalf("changing a copy changed the record: %v", record)
+	}
+}
+
+func TestKeyString(t *testing.T) {
+	for _, test := range []struct {
+		value  interface{}
+		want   string
+		scalar bool
+	}{
+		{"s", "s", true},
+		{int64(-1), "-1", true},
+		{uint64(18446744073709551615), "18446744073709551615", true},
+		{1.5, "1.5", true},
+		{float32(0.25), "0.25", true},
+		{true, "true", true},
+		{nil, "<nil>", false},
+		{map[string]interface{}{"b": 1, "a": []interface{}{"x"}}, `{"a":["x"],"b":1}`, false},
+		{[]interface{}{int64(1), "2"}, `[1,"2"]`, false},
+	} {
+		if str, scalar := scalarString(test.value); scalar != test.scalar || (scalar && str != test.want) {
+			t.Errorf("%#v: scalar %q, %v", test.value, str, scalar)
+		}
+		if str := keyString(test.value); str != test.want {
+			t.Errorf("%#v: key string %q, want %q", test.value, str, test.want)
+		}
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// how long to use local-only deduplication after the backend fails
+	redisRetryInterval = 30 * time.Second
+
+	// redisClaimValueScript sets KEYS[1] to ARGV[1] for ARGV[2] seconds,
+	// unless it already holds ARGV[1], atomically
+	redisClaimValueScript = `if redis.call('GET', KEYS[1]) == ARGV[1] then return 0 end ` +
+		`redis.call('SET', KEYS[1], ARGV[1], 'EX', ARGV[2]) return 1`
+)
+
+type (
+	// RedisStore shares deduplication state between Fluent Bit instances via
+	// a Redis protocol server, while keeping a local ExpiringCache in front
+	// of it so that repeats of known keys never leave the process. If
+	// `keySecret` is non-nil (even if empty), keys are sent as HMACs with
+	// it, as they hold raw record values.
+	RedisStore struct {
+		*ExpiringCache
+		client     *RespClient
+		prefix     string
+		keySecret  []byte
+		log        *SimpleLogger
+		metrics    *Metrics
+		retryAfter time.Time
+	}
+)
+
+func newRedisStore(
+	local *ExpiringCache,
+	client *RespClient,
+	prefix string,
+	keySecret []byte,
+	log *SimpleLogger,
+	metrics *Metrics,
+) *RedisStore {
+	return &RedisStore{
+		ExpiringCache: local,
+		client:        client,
+		prefix:        prefix,
+		keySecret:     keySecret,
+		log:           log,
+		metrics:       metrics,
+	}
+}
+
+// sharedKey returns the backend key for a dedup key
+func (r *RedisStore) sharedKey(key string) string {
+	if r.keySecret == nil {
+		return r.prefix + key
+	}
+	return r.prefix + hashValue(r.keySecret, key, 0)
+}
+
+// Claim sets every key with `SET key 1 NX EX ttl` in one pipeline. A key is
+// claimed if it did not already exist. Claims with a value use a script
+// instead, so that the key is compared and set at once. If the backend is
+// unreachable every key is claimed, i.e. deduplication falls back to the
+// local cache alone.
+func (r *RedisStore) Claim(claims []DedupClaim) []bool {
+	claimed := make([]bool, len(claims))
+	for i := range claimed {
+		claimed[i] = true
+	}
+	if len(claims) == 0 || time.Now().Before(r.retryAfter) {
+		return claimed
+	}
+
+	commands := make([][]string, len(claims))
+	for i, claim := range claims {
+		ttl := int64((claim.TTL + time.Second - 1) / time.Second)
+		if ttl < 1 {
+			ttl = 1
+		}
+		if len(claim.Value) > 0 {
+			commands[i] = []string{
+				"EVAL",
+				redisClaimValueScript,
+				"1",
+				r.sharedKey(claim.Key),
+				claim.Value,
+				strconv.FormatInt(ttl, 10),
+			}
+			continue
+		}
+		commands[i] = []string{
+			"SET",
+			r.sharedKey(claim.Key),
+			"1",
+			"NX",
+			"EX",
+			strconv.FormatInt(ttl, 10),
+		}
+	}
+
+	replies, err := r.client.Pipeline(commands)
+	if err != nil {
+		r.retryAfter = time.Now().Add(redisRetryInterval)
+		r.metrics.Inc(METRIC_SHARED_ERROR)
+		r.log.Error.Printf(
+			"Shared deduplication backend failed, using local-only deduplication for %s: %v\n",
+			redisRetryInterval,
+			err,
+		)
+		return claimed
+	}
+
+	for i, reply := range replies {
+		switch v := reply.(type) {
+		case nil:
+			claimed[i] = false
+			r.metrics.Inc(METRIC_SHARED_HIT)
+		case int64:
+			if v == 0 {
+				claimed[i] = false
+				r.metrics.Inc(METRIC_SHARED_HIT)
+			}
+		case RespError:
+			r.metrics.Inc(METRIC_SHARED_ERROR)
+			r.log.Error.Printf("Shared deduplication backend error: key=%s, error=%v\n", claims[i].Key, v)
+		}
+	}
+	return claimed
+}
+
+// PeekShared returns when a key expires in the backend, if it is held there
+// (by any instance). A key without expiry has a zero time.
+func (r *RedisStore) PeekShared(key string, now time.Time) (time.Time, bool, error) {
+	replies, err := r.client.Pipeline([][]string{{"PTTL", r.sharedKey(key)}})
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	switch v := replies[0].(type) {
+	case RespError:
+		return time.Time{}, false, v
+	case int64:
+		if v == -2 {
+			return time.Time{}, false, nil
+		}
+		if v == -1 {
+			return time.Time{}, true, nil
+		}
+		return now.Add(time.Duration(v) * time.Millisecond), true, nil
+	}
+	return time.Time{}, false, fmt.Errorf("Unexpected PTTL reply: %v", replies[0])
+}
+
+// Remove deletes a key locally and from the backend
+func (r *RedisStore) Remove(key string) bool {
+	removed := r.ExpiringCache.Remove(key)
+	replies, err := r.client.Pipeline([][]string{{"DEL", r.sharedKey(key)}})
+	if err != nil {
+		r.log.Error.Printf("Shared deduplication backend failed to remove key: key=%s, error=%v\n", key, err)
+		return removed
+	}
+	if n, ok := replies[0].(int64); ok && n > 0 {
+		removed = true
+	}
+	return removed
+}
+
+// RemovePrefix deletes matching keys locally, and uses SCAN to find and
+// delete matching keys in the backend. Hashed keys cannot be matched, so
+// then only the matching keys held locally are deleted from the backend,
+// unless every key is.
+func (r *RedisStore) RemovePrefix(prefix string) int {
+	local := r.ExpiringCache.removePrefix(prefix)
+	var remote int
+	var err error
+	if r.keySecret == nil || len(prefix) == 0 {
+		remote, err = r.removeRemotePrefix(redisGlobEscaper.Replace(r.prefix+prefix) + "*")
+	} else {
+		remote, err = r.removeRemoteKeys(local)
+	}
+	if err != nil {
+		r.log.Error.Printf("Shared deduplication backend failed to remove keys: prefix=%s, error=%v\n", prefix, err)
+	}
+	if remote > len(local) {
+		return remote
+	}
+	return len(local)
+}
+
+func (r *RedisStore) removeRemoteKeys(keys []string) (int, error) {
+	if len(keys) == 0 {
+		return 0, nil
+	}
+	del := []string{"DEL"}
+	for _, key := range keys {
+		del = append(del, r.sharedKey(key))
+	}
+	replies, err := r.client.Pipeline([][]string{del})
+	if err != nil {
+		return 0, err
+	}
+	n, _ := replies[0].(int64)
+	return int(n), nil
+}
+
+var redisGlobEscaper = strings.NewReplacer(`\`, `\\`, "*", `\*`, "?", `\?`, "[", `\[`, "]", `\]`)
+
+func (r *RedisStore) removeRemotePrefix(pattern string) (int, error) {
+	removed := 0
+	cursor := "0"
+	for {
+		replies, err := r.client.Pipeline([][]string{{"SCAN", cursor, "MATCH", pattern, "COUNT", "1000"}})
+		if err != nil {
+			return removed, err
+		}
+		scan, ok := replies[0].([]interface{})
+		if !ok || len(scan) != 2 {
+			return removed, fmt.Errorf("Unexpected SCAN reply: %v", replies[0])
+		}
+		cursor, _ = scan[0].(string)
+		if keys, ok := scan[1].([]interface{}); ok && len(keys) > 0 {
+			del := []string{"DEL"}
+			for _, key := range keys {
+				if k, ok := key.(string); ok {
+					del = append(del, k)
+				}
+			}
+			replies, err := r.client.Pipeline([][]string{del})
+			if err != nil {
+				return removed, err
+			}
+			if n, ok := replies[0].(int64); ok {
+				removed += int(n)
+			}
+		}
+		if cursor == "0" || len(cursor) == 0 {
+			return removed, nil
+		}
+	}
+}
@@ -0,0 +1,453 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// respServer is an in-process server speaking enough of RESP2 for the
+// commands RedisStore uses. SCAN returns at most two keys per page, so that
+// cursors are exercised; like Redis, it still returns every key which exists
+// throughout a scan when keys are deleted part way.
+type respServer struct {
+	t        *testing.T
+	listener net.Listener
+	lock     sync.Mutex
+	keys     map[string]string
+	expires  map[string]time.Time
+	seen     []string
+	commands [][]string
+	conns    []net.Conn
+}
+
+func newRespServer(t *testing.T) *respServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &respServer{
+		t:        t,
+		listener: listener,
+		keys:     make(map[string]string),
+		expires:  make(map[string]time.Time),
+	}
+	go s.serve()
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *respServer) Address() string {
+	return s.listener.Addr().String()
+}
+
+func (s *respServer) Close() {
+	s.listener.Close()
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, conn := range s.conns {
+		conn.Close()
+	}
+}
+
+func (s *respServer) Commands() [][]string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([][]string{}, s.commands...)
+}
+
+func (s *respServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.lock.Lock()
+		s.conns = append(s.conns, conn)
+		s.lock.Unlock()
+		go s.handle(conn)
+	}
+}
+
+func (s *respServer) handle(conn net.Conn) {
+	reader := bufio.NewReader(conn)
+	for {
+		request, err := readRespReply(reader)
+		if err != nil {
+			return
+		}
+		items, _ := request.([]interface{})
+		command := make([]string, len(items))
+		for i, item := range items {
+			command[i], _ = item.(string)
+		}
+		if _, err := conn.Write([]byte(s.execute(command))); err != nil {
+			return
+		}
+	}
+}
+
+func (s *respServer) liveLocked(key string) (string, bool) {
+	value, exists := s.keys[key]
+	if exists && !s.expires[key].IsZero() && !time.Now().Before(s.expires[key]) {
+		delete(s.keys, key)
+		delete(s.expires, key)
+		return "", false
+	}
+	return value, exists
+}
+
+func (s *respServer) setLocked(key, value, seconds string) {
+	if _, exists := s.keys[key]; !exists {
+		s.seen = append(s.seen, key)
+		sort.Strings(s.seen)
+	}
+	s.keys[key] = value
+	n, _ := strconv.Atoi(seconds)
+	s.expires[key] = time.Now().Add(time.Duration(n) * time.Second)
+}
+
+func (s *respServer) execute(command []string) string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.commands = append(s.commands, command)
+	switch strings.ToUpper(command[0]) {
+	case "SET":
+		// SET key value NX EX seconds
+		if _, exists := s.liveLocked(command[1]); exists {
+			return "$-1\r\n"
+		}
+		s.setLocked(command[1], command[2], command[5])
+		return "+OK\r\n"
+	case "EVAL":
+		// redisClaimValueScript: EVAL script 1 key value seconds
+		if value, exists := s.liveLocked(command[3]); exists && value == command[4] {
+			return ":0\r\n"
+		}
+		s.setLocked(command[3], command[4], command[5])
+		return ":1\r\n"
+	case "GET":
+		if value, exists := s.liveLocked(command[1]); exists {
+			return fmt.Sprintf("$%d\r\n%s\r\n", len(value), value)
+		}
+		return "$-1\r\n"
+	case "PTTL":
+		if _, exists := s.liveLocked(command[1]); !exists {
+			return ":-2\r\n"
+		}
+		return fmt.Sprintf(":%d\r\n", time.Until(s.expires[command[1]])/time.Millisecond)
+	case "DEL":
+		n := 0
+		for _, key := range command[1:] {
+			if _, exists := s.liveLocked(key); exists {
+				delete(s.keys, key)
+				delete(s.expires, key)
+				n++
+			}
+		}
+		return fmt.Sprintf(":%d\r\n", n)
+	case "SCAN":
+		// SCAN cursor MATCH pattern COUNT n
+		cursor, _ := strconv.Atoi(command[1])
+		page := []string{}
+		next := 0
+		for i := cursor; i < len(s.seen); i++ {
+			if len(page) == 2 {
+				next = i
+				break
+			}
+			if _, exists := s.liveLocked(s.seen[i]); !exists {
+				continue
+			}
+			if matched, _ := path.Match(command[3], s.seen[i]); matched {
+				page = append(page, s.seen[i])
+			}
+		}
+		var reply strings.Builder
+		nextCursor := strconv.Itoa(next)
+		fmt.Fprintf(&reply, "*2\r\n$%d\r\n%s\r\n*%d\r\n", len(nextCursor), nextCursor, len(page))
+		for _, key := range page {
+			fmt.Fprintf(&reply, "$%d\r\n%s\r\n", len(key), key)
+		}
+		return reply.String()
+	}
+	return "-ERR unknown command\r\n"
+}
+
+func newTestRedisStore(t *testing.T, address string) *RedisStore {
+	return newTestHashingRedisStore(t, address, nil)
+}
+
+func newTestHashingRedisStore(t *testing.T, address string, keySecret []byte) *RedisStore {
+	local, err := newExpiringCache(100, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newRedisStore(
+		local,
+		newRespClient(address, "", 0, 500*time.Millisecond),
+		"test:",
+		keySecret,
+		Logger("error", ""),
+		newMetrics(),
+	)
+}
+
+func TestRedisStoreClaimPipelined(t *testing.T) {
+	server := newRespServer(t)
+	store := newTestRedisStore(t, server.Address())
+
+	claimed := store.Claim([]DedupClaim{
+		{Key: "a", TTL: time.Minute},
+		{Key: "b", TTL: 1500 * time.Millisecond},
+		{Key: "a", TTL: time.Minute},
+	})
+	if !claimed[0] || !claimed[1] || claimed[2] {
+		t.Fatalf("claimed %v, want [true true false]", claimed)
+	}
+
+	commands := server.Commands()
+	if len(commands) != 3 {
+		t.Fatalf("sent %d commands, want 3", len(commands))
+	}
+	want := []string{"SET", "test:b", "1", "NX", "EX", "2"}
+	if strings.Join(commands[1], " ") != strings.Join(want, " ") {
+		t.Fatalf("sent %v, want %v (TTL rounded up)", commands[1], want)
+	}
+
+	// a second instance sees the first instance's claims
+	other := newTestRedisStore(t, server.Address())
+	if claimed := other.Claim([]DedupClaim{{Key: "b", TTL: time.Minute}}); claimed[0] {
+		t.Fatal("second instance claimed a held key")
+	}
+}
+
+func TestRedisStoreClaimValue(t *testing.T) {
+	server := newRespServer(t)
+	store := newTestRedisStore(t, server.Address())
+
+	// on_change: a, b, then a again must each be claimed; a repeat must not
+	for i, step := range []struct {
+		value string
+		want  bool
+	}{
+		{"hash-a", true},
+		{"hash-b", true},
+		{"hash-a", true},
+		{"hash-a", false},
+	} {
+		claimed := store.Claim([]DedupClaim{{Key: "k", Value: step.value, TTL: time.Minute}})
+		if claimed[0] != step.want {
+			t.Fatalf("step %d: claimed %v for %s, want %v", i, claimed[0], step.value, step.want)
+		}
+	}
+}
+
+func TestDeduplicatorOnChangeSharedRevert(t *testing.T) {
+	server := newRespServer(t)
+	d, err := newDeduplicator(
+		DEDUP_MODE_ON_CHANGE,
+		func(onRemoved RemovalCallback) (DedupStore, error) {
+			return newTestRedisStore(t, server.Address()), nil
+		},
+		nil,
+		nil,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	for i, value := range []string{"a", "b", "a"} {
+		candidate := &DedupCandidate{Key: "k", Record: StringifiedRecordType{"v": value}, Timestamp: now, Seen: now, TTL: time.Hour}
+		if decision, _ := d.Check(candidate, now); decision == DedupDuplicate {
+			t.Fatalf("record %d (%s) was a local duplicate", i, value)
+		}
+		claimed := d.Claim([]*DedupCandidate{candidate}, now)
+		if !claimed[0] {
+			t.Fatalf("record %d (%s) was not claimed", i, value)
+		}
+	}
+}
+
+func TestRedisStoreRemovePrefix(t *testing.T) {
+	server := newRespServer(t)
+	store := newTestRedisStore(t, server.Address())
+	claims := []DedupClaim{}
+	for _, key := range []string{"x:1", "x:2", "x:3", "x*4", "y:1"} {
+		claims = append(claims, DedupClaim{Key: key, TTL: time.Minute})
+		store.Add(key, &DedupEntry{}, time.Now().Add(time.Minute))
+	}
+	store.Claim(claims)
+
+	if n := store.RemovePrefix("x:"); n != 3 {
+		t.Fatalf("removed %d keys, want 3", n)
+	}
+	scans := 0
+	for _, command := range server.Commands() {
+		if command[0] == "SCAN" {
+			scans++
+			if command[3] != `test:x:*` {
+				t.Fatalf("scanned for %q", command[3])
+			}
+		}
+	}
+	if scans < 2 {
+		t.Fatalf("scanned %d pages, want at least 2", scans)
+	}
+	for key, want := range map[string]bool{"test:x:1": false, "test:x:3": false, "test:x*4": true, "test:y:1": true} {
+		if _, exists := server.keys[key]; exists != want {
+			t.Fatalf("key %s exists=%v, want %v", key, exists, want)
+		}
+	}
+	if store.ExpiringCache.Len() != 2 {
+		t.Fatalf("local cache has %d keys, want 2", store.ExpiringCache.Len())
+	}
+
+	// a glob character in the prefix is matched literally
+	if n := store.RemovePrefix("x*"); n != 1 {
+		t.Fatalf("removed %d keys for a literal `*`, want 1", n)
+	}
+}
+
+func TestRedisStoreHashedKeys(t *testing.T) {
+	server := newRespServer(t)
+	store := newTestHashingRedisStore(t, server.Address(), []byte("secret"))
+	raw := []string{"10.1.2.3:device-1", "10.1.2.3:device-2", "10.9.9.9:device-3"}
+	for _, key := range raw {
+		store.Add(key, &DedupEntry{}, time.Now().Add(time.Minute))
+		store.Claim([]DedupClaim{{Key: key, TTL: time.Minute}})
+		store.Claim([]DedupClaim{{Key: key, Value: "v", TTL: time.Minute}})
+		store.PeekShared(key, time.Now())
+	}
+	store.Remove(raw[2])
+
+	// no raw value reaches the backend, in any command
+	for _, command := range server.Commands() {
+		for _, arg := range command {
+			if strings.Contains(arg, "10.") || strings.Contains(arg, "device") {
+				t.Fatalf("raw key sent in %v", command)
+			}
+		}
+	}
+	hashed := "test:" + hashValue([]byte("secret"), raw[0], 0)
+	if _, exists := server.keys[hashed]; !exists {
+		t.Fatalf("key %s not held", hashed)
+	}
+
+	// another instance with the same secret shares the keys
+	other := newTestHashingRedisStore(t, server.Address(), []byte("secret"))
+	if claimed := other.Claim([]DedupClaim{{Key: raw[0], TTL: time.Minute}}); claimed[0] {
+		t.Fatal("second instance claimed a held key")
+	}
+
+	// a prefix removes the matching keys this instance holds
+	if n := store.RemovePrefix("10.1.2.3:"); n != 2 {
+		t.Fatalf("removed %d keys, want 2", n)
+	}
+	if len(server.keys) != 0 {
+		t.Fatalf("backend still holds %d keys", len(server.keys))
+	}
+
+	// and an empty prefix every key
+	other.Claim([]DedupClaim{{Key: raw[0], TTL: time.Minute}, {Key: raw[1], TTL: time.Minute}})
+	if n := store.RemovePrefix(""); n != 2 {
+		t.Fatalf("removed %d keys, want 2", n)
+	}
+}
+
+func TestRedisStorePeekShared(t *testing.T) {
+	server := newRespServer(t)
+	store := newTestRedisStore(t, server.Address())
+	store.Claim([]DedupClaim{{Key: "held", TTL: time.Minute}})
+	now := time.Now()
+	if expires, found, err := store.PeekShared("held", now); err != nil || !found || expires.Sub(now) < 50*time.Second {
+		t.Fatalf("got %v, %v, %v for a held key", expires, found, err)
+	}
+	if _, found, err := store.PeekShared("missing", now); err != nil || found {
+		t.Fatalf("got %v, %v for a missing key", found, err)
+	}
+}
+
+func TestRedisStoreFallback(t *testing.T) {
+	server := newRespServer(t)
+	store := newTestRedisStore(t, server.Address())
+	store.Claim([]DedupClaim{{Key: "a", TTL: time.Minute}})
+	server.Close()
+
+	// with the backend down, every key is claimed (local-only)
+	claimed := store.Claim([]DedupClaim{{Key: "a", TTL: time.Minute}, {Key: "b", TTL: time.Minute}})
+	if !claimed[0] || !claimed[1] {
+		t.Fatalf("claimed %v with the backend down, want all", claimed)
+	}
+	if store.metrics.Snapshot()[METRIC_SHARED_ERROR] != uint64(1) {
+		t.Fatalf("metrics %v, want one shared error", store.metrics.Snapshot())
+	}
+	if until := time.Until(store.retryAfter); until < 29*time.Second || until > redisRetryInterval {
+		t.Fatalf("retrying in %s, want %s", until, redisRetryInterval)
+	}
+
+	// within the retry interval, the backend is not contacted at all
+	replacement := newRespServer(t)
+	store.client = newRespClient(replacement.Address(), "", 0, 500*time.Millisecond)
+	store.Claim([]DedupClaim{{Key: "c", TTL: time.Minute}})
+	if n := len(replacement.Commands()); n != 0 {
+		t.Fatalf("sent %d commands during the retry interval", n)
+	}
+
+	// after it, shared deduplication resumes
+	store.retryAfter = time.Now().Add(-time.Second)
+	store.Claim([]DedupClaim{{Key: "c", TTL: time.Minute}})
+	if claimed := store.Claim([]DedupClaim{{Key: "c", TTL: time.Minute}}); claimed[0] {
+		t.Fatal("key claimed twice after the backend recovered")
+	}
+}
+
+func TestDeduplicatorSummarizeSharedWindow(t *testing.T) {
+	server := newRespServer(t)
+	now := time.Now()
+	summaries := map[string]int{}
+	newInstance := func(name string) *Deduplicator {
+		d, err := newDeduplicator(
+			DEDUP_MODE_SUMMARIZE,
+			func(onRemoved RemovalCallback) (DedupStore, error) {
+				store := newTestRedisStore(t, server.Address())
+				store.ExpiringCache.onRemoved = onRemoved
+				return store, nil
+			},
+			nil,
+			func(entry *DedupEntry) {
+				if !entry.Suppressed {
+					summaries[name]++
+				}
+			},
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+
+	// both instances open a window for the same key; only one may claim it
+	for _, name := range []string{"first", "second"} {
+		d := newInstance(name)
+		candidate := &DedupCandidate{Key: "k", Record: StringifiedRecordType{"v": 1}, Timestamp: now, Seen: now, TTL: time.Hour}
+		if decision, _ := d.Check(candidate, now); decision != DedupHold {
+			t.Fatalf("%s: decision %s, want hold", name, decision)
+		}
+		candidate.Hold = true
+		if claimed := d.Claim([]*DedupCandidate{candidate}, now); !claimed[0] {
+			d.Suppress("k", now)
+		}
+		d.Flush()
+	}
+	if summaries["first"] != 1 || summaries["second"] != 0 {
+		t.Fatalf("summaries %v, want only the first instance's", summaries)
+	}
+}
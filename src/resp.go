@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type (
+	// RespClient is a minimal client for servers speaking the Redis
+	// serialization protocol (RESP2), supporting pipelined commands only
+	RespClient struct {
+		lock     sync.Mutex
+		address  string
+		password string
+		db       uint64
+		timeout  time.Duration
+		conn     net.Conn
+		reader   *bufio.Reader
+	}
+
+	RespError string
+)
+
+func (e RespError) Error() string {
+	return string(e)
+}
+
+func newRespClient(address string, password string, db uint64, timeout time.Duration) *RespClient {
+	return &RespClient{
+		address:  address,
+		password: password,
+		db:       db,
+		timeout:  timeout,
+	}
+}
+
+func (c *RespClient) connectLocked() error {
+	conn, err := net.DialTimeout("tcp", c.address, c.timeout)
+	if err != nil {
+		return err
+	}
+	c.conn = conn
+	c.reader = bufio.NewReader(conn)
+
+	setup := [][]string{}
+	if len(c.password) > 0 {
+		setup = append(setup, []string{"AUTH", c.password})
+	}
+	if c.db > 0 {
+		setup = append(setup, []string{"SELECT", strconv.FormatUint(c.db, 10)})
+	}
+	if len(setup) > 0 {
+		replies, err := c.pipelineLocked(setup)
+		if err != nil {
+			return err
+		}
+		for _, reply := range replies {
+			if replyErr, isErr := reply.(RespError); isErr {
+				c.closeLocked()
+				return replyErr
+			}
+		}
+	}
+	return nil
+}
+
+func (c *RespClient) closeLocked() {
+	if c.conn != nil {
+		c.conn.Close()
+	}
+	c.conn = nil
+	c.reader = nil
+}
+
+func (c *RespClient) Close() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.closeLocked()
+}
+
+// Pipeline sends every command before reading any reply. Replies are
+// returned in command order, with server errors as RespError values. A
+// non-nil error means the connection failed, and it will be re-established
+// on the next call.
+func (c *RespClient) Pipeline(commands [][]string) ([]interface{}, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.conn == nil {
+		if err := c.connectLocked(); err != nil {
+			c.closeLocked()
+			return nil, err
+		}
+	}
+	replies, err := c.pipelineLocked(commands)
+	if err != nil {
+		c.closeLocked()
+	}
+	return replies, err
+}
+
+func (c *RespClient) pipelineLocked(commands [][]string) ([]interface{}, error) {
+	if c.timeout > 0 {
+		c.conn.SetDeadline(time.Now().Add(c.timeout))
+	}
+	writer := bufio.NewWriter(c.conn)
+	for _, command := range commands {
+		fmt.Fprintf(writer, "*%d\r\n", len(command))
+		for _, arg := range command {
+			fmt.Fprintf(writer, "$%d\r\n%s\r\n", len(arg), arg)
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		return nil, err
+	}
+	replies := make([]interface{}, len(commands))
+	for i := range commands {
+		reply, err := readRespReply(c.reader)
+		if err != nil {
+			return nil, err
+		}
+		replies[i] = reply
+	}
+	return replies, nil
+}
+
+func readRespLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return "", fmt.Errorf("Malformed RESP line: %q", line)
+	}
+	return line[:len(line)-2], nil
+}
+
+// readRespReply returns a string, int64, RespError, []interface{} or nil
+func readRespReply(r *bufio.Reader) (interface{}, error) {
+	line, err := readRespLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 {
+		return nil, fmt.Errorf("Empty RESP reply")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return RespError(line[1:]), nil
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		size, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if size < 0 {
+			return nil, nil
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:size]), nil
+	case '*':
+		size, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if size < 0 {
+			return nil, nil
+		}
+		elements := make([]interface{}, size)
+		for i := range elements {
+			if elements[i], err = readRespReply(r); err != nil {
+				return nil, err
+			}
+		}
+		return elements, nil
+	}
+	return nil, fmt.Errorf("Unknown RESP reply type: %q", line)
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"bufio"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadRespReply(t *testing.T) {
+	for _, test := range []struct {
+		raw  string
+		want interface{}
+	}{
+		{"+OK\r\n", "OK"},
+		{"-ERR wrong\r\n", RespError("ERR wrong")},
+		{":42\r\n", int64(42)},
+		{":-2\r\n", int64(-2)},
+		{"$5\r\nhe\r\no\r\n", "he\r\no"},
+		{"$0\r\n\r\n", ""},
+		{"$-1\r\n", nil},
+		{"*-1\r\n", nil},
+		{"*2\r\n$1\r\n0\r\n*1\r\n$3\r\nkey\r\n", []interface{}{"0", []interface{}{"key"}}},
+	} {
+		got, err := readRespReply(bufio.NewReader(strings.NewReader(test.raw)))
+		if err != nil {
+			t.Fatalf("%q: %v", test.raw, err)
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Fatalf("%q: got %#v, want %#v", test.raw, got, test.want)
+		}
+	}
+
+	for _, raw := range []string{"", "+OK\n", "?what\r\n", "$5\r\nab\r\n", ":x\r\n"} {
+		if _, err := readRespReply(bufio.NewReader(strings.NewReader(raw))); err == nil {
+			t.Fatalf("%q: no error", raw)
+		}
+	}
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// TEMPLATE_MATCHED_VALUE refers to the record value which matched
+	TEMPLATE_MATCHED_VALUE = "_value"
+)
+
+type (
+	// templatePart is literal text, a regex capture group, or a reference
+	// to a record field, optionally passed through a function
+	templatePart struct {
+		literal  string
+		group    string
+		function string
+		field    string
+	}
+
+	// fieldTemplate is a string value with `{field}` or `{function(field)}`
+	// references, e.g. "ip:{rip}" or "{lowercase(host)}", and in rules with
+	// a regex, `$1` or `${name}` capture groups. "{{", "}}" and "$$" are
+	// literal.
+	fieldTemplate []templatePart
+
+	// templateScope is what the values of one rule may refer to. Values of
+	// rules in the original format are never templates, so have no scope.
+	templateScope struct {
+		// groups are the capture group numbers and names of the rule's own
+		// regexes. `$` is only special in rules which have any.
+		groups map[string]bool
+	}
+
+	templateContext struct {
+		record  StringifiedRecordType
+		matched string
+		capture *matchCapture
+		now     time.Time
+	}
+)
+
+var templateFunctions = map[string]func(value string, ctx *templateContext) string{
+	"lowercase": func(value string, _ *templateContext) string {
+		return strings.ToLower(value)
+	},
+	"uppercase": func(value string, _ *templateContext) string {
+		return strings.ToUpper(value)
+	},
+	"hash": func(value string, _ *templateContext) string {
+		sum := sha256.Sum256([]byte(value))
+		return hex.EncodeToString(sum[:])
+	},
+	"now": func(_ string, ctx *templateContext) string {
+		return ctx.now.UTC().Format(time.RFC3339)
+	},
+}
+
+var templateReference = regexp.MustCompile(`^(?:([a-z]+)\(([^(){}]*)\)|([^(){}]+))$`)
+
+// templateGroupName is the name in a `$name` capture group reference, as
+// read by regexp.Expand
+var templateGroupName = regexp.MustCompile(`^[A-Za-z0-9_]+`)
+
+// addGroups allows references to the capture groups of a regex
+func (s *templateScope) addGroups(re *regexp.Regexp) {
+	if s.groups == nil {
+		s.groups = make(map[string]bool)
+	}
+	for i, name := range re.SubexpNames() {
+		s.groups[strconv.Itoa(i)] = true
+		if len(name) > 0 {
+			s.groups[name] = true
+		}
+	}
+}
+
+// group parses the capture group reference at the start of `value`, which
+// begins with "$", returning its name and length
+func (s *templateScope) group(value string) (string, int, error) {
+	name, length := "", 0
+	if strings.HasPrefix(value, "${") {
+		end := strings.IndexByte(value, '}')
+		if end < 0 {
+			return "", 0, fmt.Errorf("Unmatched `${`")
+		}
+		name, length = value[2:end], end+1
+	} else {
+		name = templateGroupName.FindString(value[1:])
+		length = 1 + len(name)
+	}
+	if len(name) == 0 {
+		return "", 0, fmt.Errorf("Lone `$`, use `$$` for a literal `$`")
+	}
+	if !s.groups[name] {
+		return "", 0, fmt.Errorf("Unknown capture group `%s`, use `$$` for a literal `$`", value[:length])
+	}
+	return name, length, nil
+}
+
+// compileTemplate parses a string value, returning the string itself if it
+// has no references
+func compileTemplate(value string, scope *templateScope) (interface{}, error) {
+	var template fieldTemplate
+	var literal strings.Builder
+	references := 0
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		switch {
+		case (c == '{' || c == '}') && i+1 < len(value) && value[i+1] == c:
+			literal.WriteByte(c)
+			i++
+		case c == '$' && len(scope.groups) > 0 && i+1 < len(value) && value[i+1] == c:
+			literal.WriteByte(c)
+			i++
+		case c == '$' && len(scope.groups) > 0:
+			group, length, err := scope.group(value[i:])
+			if err != nil {
+				return nil, fmt.Errorf("%v in template: %s", err, value)
+			}
+			if literal.Len() > 0 {
+				template = append(template, templatePart{literal: literal.String()})
+				literal.Reset()
+			}
+			template = append(template, templatePart{group: group})
+			references++
+			i += length - 1
+		case c == '}':
+			return nil, fmt.Errorf("Unmatched `}` in template: %s", value)
+		case c == '{':
+			end := strings.IndexByte(value[i:], '}')
+			if end < 0 {
+				return nil, fmt.Errorf("Unmatched `{` in template: %s", value)
+			}
+			match := templateReference.FindStringSubmatch(strings.TrimSpace(value[i+1 : i+end]))
+			if match == nil {
+				return nil, fmt.Errorf("Invalid reference `%s` in template: %s", value[i:i+end+1], value)
+			}
+			part := templatePart{function: match[1], field: strings.TrimSpace(match[2])}
+			if len(match[3]) > 0 {
+				part.field = strings.TrimSpace(match[3])
+			}
+			if _, exists := templateFunctions[part.function]; len(part.function) > 0 && !exists {
+				return nil, fmt.Errorf("Unknown function `%s` in template: %s", part.function, value)
+			}
+			if literal.Len() > 0 {
+				template = append(template, templatePart{literal: literal.String()})
+				literal.Reset()
+			}
+			template = append(template, part)
+			references++
+			i += end
+		default:
+			literal.WriteByte(c)
+		}
+	}
+	if references == 0 {
+		return literal.String(), nil
+	}
+	if literal.Len() > 0 {
+		template = append(template, templatePart{literal: literal.String()})
+	}
+	return template, nil
+}
+
+// compileValue compiles the templates within an added field value, which
+// may be a string, number, boolean, or nested array or object. Strings are
+// only templates within a scope.
+func compileValue(value interface{}, scope *templateScope) (interface{}, error) {
+	switch v := value.(type) {
+	case string:
+		if scope == nil {
+			return v, nil
+		}
+		return compileTemplate(v, scope)
+	case time.Time:
+		// an unquoted YAML date or timestamp
+		return timeValueString(v), nil
+	case map[string]interface{}:
+		compiled := make(map[string]interface{}, len(v))
+		for k, item := range v {
+			c, err := compileValue(item, scope)
+			if err != nil {
+				return nil, err
+			}
+			compiled[k] = c
+		}
+		return compiled, nil
+	case []interface{}:
+		compiled := make([]interface{}, len(v))
+		for i, item := range v {
+			c, err := compileValue(item, scope)
+			if err != nil {
+				return nil, err
+			}
+			compiled[i] = c
+		}
+		return compiled, nil
+	case json.Number, bool, nil, int, int64, uint64, float64:
+		return v, nil
+	}
+	return nil, fmt.Errorf("Unsupported value: %#v", value)
+}
+
+func (ctx *templateContext) lookup(field string) (interface{}, bool) {
+	if field == TEMPLATE_MATCHED_VALUE {
+		return ctx.matched, true
+	}
+	return lookupField(ctx.record, field)
+}
+
+// timeValueString gives a time as it would be written in YAML: a date
+// alone if it has no time of day
+func timeValueString(t time.Time) string {
+	if t.Equal(time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)) {
+		return t.Format("2006-01-02")
+	}
+	return t.Format(time.RFC3339Nano)
+}
+
+// group returns a capture group of the regex which matched, or "" if none
+// did
+func (ctx *templateContext) group(name string) string {
+	if ctx.capture == nil || ctx.capture.submatches == nil {
+		return ""
+	}
+	return string(ctx.capture.re.ExpandString(nil, "${"+name+"}", ctx.capture.value, ctx.capture.submatches))
+}
+
+// render fills in a template. A template which is a single plain
+// reference keeps the type of the field it refers to.
+func (t fieldTemplate) render(ctx *templateContext) interface{} {
+	if len(t) == 1 && len(t[0].field) > 0 && len(t[0].function) == 0 {
+		value, _ := ctx.lookup(t[0].field)
+		return value
+	}
+	var str strings.Builder
+	for _, part := range t {
+		if len(part.group) > 0 {
+			str.WriteString(ctx.group(part.group))
+			continue
+		}
+		if len(part.field) == 0 && len(part.function) == 0 {
+			str.WriteString(part.literal)
+			continue
+		}
+		var value string
+		if raw, exists := ctx.lookup(part.field); exists && raw != nil {
+			value = keyString(raw)
+		}
+		if len(part.function) > 0 {
+			value = templateFunctions[part.function](value, ctx)
+		}
+		str.WriteString(value)
+	}
+	return str.String()
+}
+
+// renderValue produces the value to add to a record from a compiled value
+func renderValue(value interface{}, ctx *templateContext) interface{} {
+	switch v := value.(type) {
+	case fieldTemplate:
+		return v.render(ctx)
+	case map[string]interface{}:
+		rendered := make(map[string]interface{}, len(v))
+		for k, item := range v {
+			rendered[k] = renderValue(item, ctx)
+		}
+		return rendered
+	case []interface{}:
+		rendered := make([]interface{}, len(v))
+		for i, item := range v {
+			rendered[i] = renderValue(item, ctx)
+		}
+		return rendered
+	}
+	return value
+}
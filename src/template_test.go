@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func renderMatchMap(t *testing.T, format string, raw string, record StringifiedRecordType) map[string]interface{} {
+	matchMap, err := parseMatchMap([]byte(raw), &MatchMapFormat{Format: format})
+	if err != nil {
+		t.Fatalf("%s: %v", raw, err)
+	}
+	_, fields, ok := matchRecordToMatchMap(record, matchMap)
+	if !ok {
+		t.Fatalf("%s: no match for %v", raw, record)
+	}
+	return fields
+}
+
+func TestTemplateRender(t *testing.T) {
+	record := StringifiedRecordType{"rip": "10.1.2.3", "host": "Web-01", "app_id": "com.acme.shop", "port": json.Number("443")}
+	for _, test := range []struct {
+		rule string
+		want interface{}
+	}{
+		{`"field":"rip", "exact":"10.1.2.3", "add":{"v":"ip:{rip}"}`, "ip:10.1.2.3"},
+		{`"field":"rip", "exact":"10.1.2.3", "add":{"v":"{port}"}`, json.Number("443")},
+		{`"field":"rip", "exact":"10.1.2.3", "add":{"v":"{_value}/{lowercase(host)}"}`, "10.1.2.3/web-01"},
+		{`"field":"rip", "exact":"10.1.2.3", "add":{"v":"{{literal}} {missing}."}`, "{literal} ."},
+		{`"field":"rip", "exact":"10.1.2.3", "add":{"v":{"n":7, "ok":true, "list":["{host}"]}}`,
+			map[string]interface{}{"n": json.Number("7"), "ok": true, "list": []interface{}{"Web-01"}}},
+		// `$` is only special in a rule with its own regex
+		{`"field":"rip", "exact":"10.1.2.3", "add":{"v":"costs $5, $$"}`, "costs $5, $$"},
+		{`"field":"app_id", "regex":"^com\\.([a-z]+)\\.", "add":{"v":"$1:{host}"}`, "acme:Web-01"},
+		{`"field":"app_id", "regex":"^com\\.(?P<org>[a-z]+)\\.", "add":{"v":"${org}s costs $$5"}`, "acmes costs $5"},
+		{`"field":"app_id", "regex":"^com\\.([a-z]+)\\.", "add":{"v":"${1}x $0"}`, "acmex com.acme."},
+		{`"all":[{"field":"rip", "cidr":"10.0.0.0/8"}, {"field":"app_id", "regex":"\\.([a-z]+)$"}], "add":{"v":"$1"}`, "shop"},
+		// a regex under `not` never captures, so gives no groups
+		{`"all":[{"field":"rip", "exists":true}, {"not":{"field":"app_id", "regex":"^(a)"}}], "add":{"v":"$1"}`, "$1"},
+	} {
+		raw := `{"rules":[{` + test.rule + `}]}`
+		if got := renderMatchMap(t, MATCH_MAP_FORMAT_JSON, raw, record)["v"]; !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %#v, want %#v", test.rule, got, test.want)
+		}
+	}
+}
+
+func TestTemplateRejected(t *testing.T) {
+	for _, test := range []struct {
+		rule string
+		want string
+	}{
+		{`"field":"rip", "exact":"a", "add":{"v":"{host"}`, "Unmatched `{`"},
+		{`"field":"rip", "exact":"a", "add":{"v":"host}"}`, "Unmatched `}`"},
+		{`"field":"rip", "exact":"a", "add":{"v":"{upper(host)}"}`, "Unknown function `upper`"},
+		{`"field":"rip", "exact":"a", "add":{"v":"{a(b}"}`, "Invalid reference"},
+		{`"field":"app_id", "regex":"^(a)", "add":{"v":"$2"}`, "Unknown capture group `$2`"},
+		{`"field":"app_id", "regex":"^(a)", "add":{"v":"costs $5.00"}`, "Unknown capture group `$5`"},
+		{`"field":"app_id", "regex":"^(a)", "add":{"v":"${name}"}`, "Unknown capture group `${name}`"},
+		{`"field":"app_id", "regex":"^(a)", "add":{"v":"total $"}`, "Lone `$`"},
+		{`"any":[{"field":"rip", "exists":true}, {"field":"app_id", "regex":"^(a)"}], "add":{"v":"$2"}`, "Unknown capture group `$2`"},
+	} {
+		raw := `{"rules":[{` + test.rule + `}]}`
+		_, err := parseMatchMap([]byte(raw), &MatchMapFormat{Format: MATCH_MAP_FORMAT_JSON})
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%s: got error %v, want %q", test.rule, err, test.want)
+		}
+	}
+}
+
+func TestTemplateLegacyLiteral(t *testing.T) {
+	record := StringifiedRecordType{"rip": "10.1.2.3"}
+	for _, test := range []struct {
+		format string
+		raw    string
+	}{
+		{MATCH_MAP_FORMAT_JSON, `{"rip":{"10.1.2.3":{"v":"uses {braces} and $1"}}}`},
+		{MATCH_MAP_FORMAT_YAML, "rip:\n  10.1.2.3:\n    v: uses {braces} and $1\n"},
+		{MATCH_MAP_FORMAT_CSV, "rip,v\n10.1.2.3,uses {braces} and $1\n"},
+	} {
+		fields := renderMatchMap(t, test.format, test.raw, record)
+		if got := fields["v"]; got != "uses {braces} and $1" {
+			t.Errorf("%s: got %#v", test.format, got)
+		}
+	}
+}
+
+func TestTemplateYamlDates(t *testing.T) {
+	record := StringifiedRecordType{"rip": "10.1.2.3"}
+	want := map[string]interface{}{"since": "2024-01-02", "at": "2024-01-02T03:04:05Z"}
+	for _, raw := range []string{
+		"rip:\n  10.1.2.3:\n    since: 2024-01-02\n    at: 2024-01-02T03:04:05Z\n",
+		"rules:\n  - field: rip\n    exact: 10.1.2.3\n    add:\n      since: 2024-01-02\n      at: 2024-01-02T03:04:05Z\n",
+	} {
+		if got := renderMatchMap(t, MATCH_MAP_FORMAT_YAML, raw, record); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %#v, want %#v", raw, got, want)
+		}
+	}
+}
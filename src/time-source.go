@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	TIME_SOURCE_RFC3339  = "rfc3339"
+	TIME_SOURCE_EPOCH_S  = "epoch_s"
+	TIME_SOURCE_EPOCH_MS = "epoch_ms"
+	TIME_SOURCE_EPOCH_NS = "epoch_ns"
+)
+
+// strftimeLayouts converts strftime specifiers to Go time layouts, for
+// parsing. Fractional seconds follow `%S`, e.g. "%S.%L".
+var strftimeLayouts = map[byte]string{
+	'a': "Mon",
+	'A': "Monday",
+	'b': "Jan",
+	'B': "January",
+	'd': "02",
+	'e': "_2",
+	'F': "2006-01-02",
+	'f': "000000",
+	'h': "Jan",
+	'H': "15",
+	'I': "03",
+	'L': "000",
+	'm': "01",
+	'M': "04",
+	'N': "000000000",
+	'p': "PM",
+	'S': "05",
+	'T': "15:04:05",
+	'y': "06",
+	'Y': "2006",
+	'z': "-0700",
+	'Z': "MST",
+	'%': "%",
+}
+
+// strftimeLayout converts a strftime pattern to a Go time layout
+func strftimeLayout(pattern string) (string, error) {
+	var layout strings.Builder
+	for i := 0; i < len(pattern); i++ {
+		if pattern[i] != '%' {
+			layout.WriteByte(pattern[i])
+			continue
+		}
+		if i+1 == len(pattern) {
+			return "", fmt.Errorf("Trailing `%%` in: %s", pattern)
+		}
+		i++
+		specifier, exists := strftimeLayouts[pattern[i]]
+		if !exists {
+			return "", fmt.Errorf("Unsupported specifier `%%%c` in: %s", pattern[i], pattern)
+		}
+		layout.WriteString(specifier)
+	}
+	return layout.String(), nil
+}
+
+// timeSourceLayout validates `time_source_format`, returning the Go layout
+// for a strftime pattern
+func timeSourceLayout(format string) (string, error) {
+	switch format {
+	case TIME_SOURCE_RFC3339:
+		return time.RFC3339Nano, nil
+	case TIME_SOURCE_EPOCH_S, TIME_SOURCE_EPOCH_MS, TIME_SOURCE_EPOCH_NS:
+		return "", nil
+	}
+	if !strings.Contains(format, "%") {
+		return "", fmt.Errorf("Expected `%s`, `%s`, `%s`, `%s` or a strftime pattern", TIME_SOURCE_RFC3339, TIME_SOURCE_EPOCH_S, TIME_SOURCE_EPOCH_MS, TIME_SOURCE_EPOCH_NS)
+	}
+	return strftimeLayout(format)
+}
+
+// parseTimeSource reads an event time from a record value. Epoch times may
+// be numbers or strings; times without a zone are taken as UTC.
+func parseTimeSource(value interface{}, format string, layout string) (time.Time, error) {
+	str, isScalar := scalarString(value)
+	if !isScalar {
+		return time.Time{}, fmt.Errorf("Not a time: %v", value)
+	}
+	str = strings.TrimSpace(str)
+
+	var perSecond int64
+	switch format {
+	case TIME_SOURCE_EPOCH_S:
+		perSecond = 1
+	case TIME_SOURCE_EPOCH_MS:
+		perSecond = int64(time.Second / time.Millisecond)
+	case TIME_SOURCE_EPOCH_NS:
+		perSecond = int64(time.Second)
+	default:
+		return time.Parse(layout, str)
+	}
+	unit := int64(time.Second) / perSecond
+
+	// integers are kept exact, as float64 cannot hold epoch nanoseconds, and
+	// split into seconds so that none overflow
+	if i, err := strconv.ParseInt(str, 10, 64); err == nil {
+		return time.Unix(i/perSecond, i%perSecond*unit), nil
+	}
+	f, err := strconv.ParseFloat(str, 64)
+	if err != nil || math.IsNaN(f) || math.IsInf(f, 0) || math.Abs(f) >= math.MaxInt64 {
+		return time.Time{}, fmt.Errorf("Not an epoch time: %s", str)
+	}
+	whole, fraction := math.Modf(f)
+	units := int64(whole)
+	return time.Unix(units/perSecond, units%perSecond*unit+int64(fraction*float64(unit))), nil
+}
+
+// eventTime returns the time from `time_source_key`, falling back to the
+// Fluent Bit timestamp if it is not set, missing or unparseable
+func (pi *PInstance) eventTime(record StringifiedRecordType, flbTime time.Time, recordIndex int) time.Time {
+	conf := pi.Config
+	if len(conf.TimeSourceKey) == 0 {
+		return flbTime
+	}
+	value, exists := lookupField(record, conf.TimeSourceKey)
+	if !exists {
+		pi.Metrics.Inc(METRIC_TIME_SOURCE_FALLBACK)
+		pi.Log.Debug.Printf("Missing `time_source_key`, using Fluent Bit timestamp: recordIndex=%d\n", recordIndex)
+		return flbTime
+	}
+	t, err := parseTimeSource(value, conf.TimeSourceFormat, conf.TimeSourceLayout)
+	if err != nil {
+		pi.Metrics.Inc(METRIC_TIME_SOURCE_FALLBACK)
+		pi.Log.Debug.Printf("Invalid `time_source_key`, using Fluent Bit timestamp: recordIndex=%d, error=%v\n", recordIndex, err)
+		return flbTime
+	}
+	return t
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseTimeSource(t *testing.T) {
+	at := time.Date(2024, 3, 1, 9, 5, 7, 0, time.UTC)
+	for _, test := range []struct {
+		format string
+		value  interface{}
+		want   time.Time
+		err    string
+	}{
+		{TIME_SOURCE_RFC3339, "2024-03-01T09:05:07Z", at, ``},
+		{TIME_SOURCE_RFC3339, "2024-03-01T17:05:07.5+08:00", at.Add(500 * time.Millisecond), ``},
+		{TIME_SOURCE_RFC3339, " 2024-03-01T09:05:07Z ", at, ``},
+		{TIME_SOURCE_RFC3339, "2024-03-01 09:05:07", time.Time{}, `cannot parse`},
+		{TIME_SOURCE_EPOCH_S, int64(1709283907), at, ``},
+		{TIME_SOURCE_EPOCH_S, "1709283907", at, ``},
+		{TIME_SOURCE_EPOCH_S, 1709283907.25, at.Add(250 * time.Millisecond), ``},
+		{TIME_SOURCE_EPOCH_S, uint64(1709283907), at, ``},
+		{TIME_SOURCE_EPOCH_S, int64(-1), time.Unix(-1, 0), ``},
+		{TIME_SOURCE_EPOCH_S, -1.5, time.Unix(-2, 500000000), ``},
+		{TIME_SOURCE_EPOCH_MS, int64(1709283907123), at.Add(123 * time.Millisecond), ``},
+		{TIME_SOURCE_EPOCH_MS, "1709283907123.5", at.Add(123500 * time.Microsecond), ``},
+		{TIME_SOURCE_EPOCH_MS, int64(-1500), time.Unix(-2, 500000000), ``},
+		{TIME_SOURCE_EPOCH_NS, int64(1709283907000000001), at.Add(1), ``},
+		{TIME_SOURCE_EPOCH_NS, "1709283907000000001", at.Add(1), ``},
+		// seconds which would overflow as nanoseconds
+		{TIME_SOURCE_EPOCH_S, int64(1709283907123), time.Unix(1709283907123, 0), ``},
+		{TIME_SOURCE_EPOCH_S, 1e12, time.Unix(1e12, 0), ``},
+		{TIME_SOURCE_EPOCH_S, 1e19, time.Time{}, `Not an epoch time`},
+		{TIME_SOURCE_EPOCH_S, "NaN", time.Time{}, `Not an epoch time`},
+		{TIME_SOURCE_EPOCH_S, "+Inf", time.Time{}, `Not an epoch time`},
+		{TIME_SOURCE_EPOCH_S, "soon", time.Time{}, `Not an epoch time`},
+		{TIME_SOURCE_EPOCH_S, true, time.Time{}, `Not an epoch time`},
+		{TIME_SOURCE_EPOCH_S, map[string]interface{}{"s": 1}, time.Time{}, `Not a time`},
+		{TIME_SOURCE_EPOCH_S, nil, time.Time{}, `Not a time`},
+		{"%Y-%m-%d %H:%M:%S", "2024-03-01 09:05:07", at, ``},
+		{"%Y-%m-%d %H:%M:%S.%L", "2024-03-01 09:05:07.123", at.Add(123 * time.Millisecond), ``},
+		{"%Y-%m-%d %H:%M:%S.%f", "2024-03-01 09:05:07.000123", at.Add(123 * time.Microsecond), ``},
+		{"%Y-%m-%d %H:%M:%S.%N", "2024-03-01 09:05:07.000000123", at.Add(123), ``},
+		{"%d/%b/%Y:%H:%M:%S %z", "01/Mar/2024:17:05:07 +0800", at, ``},
+		{"%a, %e %B %y %I:%M:%S %p", "Fri,  1 March 24 09:05:07 AM", at, ``},
+		{"%F %T", "2024-03-01 09:05:07", at, ``},
+		{"%h %d %H:%M:%S %Y %%", "Mar 01 09:05:07 2024 %", at, ``},
+		{"%Y-%m-%d", "2024-03-01 09:05", time.Time{}, `extra text`},
+	} {
+		layout, err := timeSourceLayout(test.format)
+		if err != nil {
+			t.Fatalf("%s: %v", test.format, err)
+		}
+		parsed, err := parseTimeSource(test.value, test.format, layout)
+		if len(test.err) > 0 {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s %#v: got %v, %v, want error %q", test.format, test.value, parsed, err, test.err)
+			}
+			continue
+		}
+		if err != nil || !parsed.Equal(test.want) {
+			t.Errorf("%s %#v: got %v, %v, want %v", test.format, test.value, parsed, err, test.want)
+		}
+	}
+}
+
+func TestTimeSourceLayout(t *testing.T) {
+	for format, want := range map[string]string{
+		"epoch":         "Expected `rfc3339`, `epoch_s`, `epoch_ms`, `epoch_ns` or a strftime pattern",
+		"%Y-%m-%d %":    "Trailing `%` in: %Y-%m-%d %",
+		"%Y-%j":         "Unsupported specifier `%j` in: %Y-%j",
+		"%s":            "Unsupported specifier `%s`",
+		"%Y%m%dT%H%M%S": "",
+	} {
+		_, err := timeSourceLayout(format)
+		if len(want) == 0 && err != nil || len(want) > 0 && (err == nil || !strings.Contains(err.Error(), want)) {
+			t.Errorf("%s: got error %v, want %q", format, err, want)
+		}
+	}
+}
+
+func TestEventTime(t *testing.T) {
+	flbTime := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	pi := newTestPInstance(t, &Config{TimeSourceKey: "log.ts", TimeSourceFormat: TIME_SOURCE_EPOCH_MS})
+	for _, test := range []struct {
+		record StringifiedRecordType
+		want   time.Time
+	}{
+		{StringifiedRecordType{"log": map[string]interface{}{"ts": int64(1000)}}, time.Unix(1, 0)},
+		{StringifiedRecordType{"log.ts": "2000"}, time.Unix(2, 0)},
+		// missing or unparseable times fall back to the Fluent Bit timestamp
+		{StringifiedRecordType{"log": map[string]interface{}{}}, flbTime},
+		{StringifiedRecordType{"log": map[string]interface{}{"ts": "soon"}}, flbTime},
+	} {
+		if got := pi.eventTime(test.record, flbTime, 1); !got.Equal(test.want) {
+			t.Errorf("%v: event time %v, want %v", test.record, got, test.want)
+		}
+	}
+	if fallbacks := pi.Metrics.Snapshot()[METRIC_TIME_SOURCE_FALLBACK]; fallbacks != uint64(2) {
+		t.Fatalf("%v fallbacks, want 2", fallbacks)
+	}
+
+	// without `time_source_key`, the Fluent Bit timestamp is the event time
+	pi = newTestPInstance(t, &Config{})
+	if got := pi.eventTime(StringifiedRecordType{"ts": int64(1)}, flbTime, 1); !got.Equal(flbTime) {
+		t.Fatalf("event time %v", got)
+	}
+}
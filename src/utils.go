@@ -1,10 +1,12 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	output "github.com/fluent/fluent-bit-go/output"
 	strftime "github.com/lestrrat-go/strftime"
-	"io/ioutil"
 	"net/url"
 	"strconv"
 	"strings"
@@ -20,6 +22,11 @@ type (
 		String *string
 		Int64  *int64
 	}
+
+	KeyValue struct {
+		Key   string
+		Value string
+	}
 )
 
 func parseInteger(s string, d uint64) uint64 {
@@ -30,6 +37,13 @@ func parseInteger(s string, d uint64) uint64 {
 	}
 }
 
+func parseFloat(s string, d float64) float64 {
+	if parsedNumber, err := strconv.ParseFloat(s, 64); err == nil {
+		return parsedNumber
+	}
+	return d
+}
+
 func parseBool(s string, d bool) bool {
 	if parsedToBool, err := strconv.ParseBool(s); err == nil {
 		return parsedToBool
@@ -44,8 +58,124 @@ func meaningfulUrl(str string) bool {
 
 func csvAppend(s string, l *[]string) {
 	for _, v := range strings.Split(s, ",") {
-		*l = append(*l, strings.TrimSpace(v))
+		if v = strings.TrimSpace(v); len(v) > 0 {
+			*l = append(*l, v)
+		}
+	}
+}
+
+// kvCsvPairs parses "k1:v1,k2:v2" in order, splitting each item at its
+// first ":". Keys and values may be double quoted, as in CSV, to hold ","
+// or ":", as in `date:"%d %b, %Y"`; within quotes `""` is a literal quote.
+func kvCsvPairs(s string) ([]KeyValue, error) {
+	items, err := splitUnquoted(s, ',', -1)
+	if err != nil {
+		return nil, err
+	}
+	pairs := make([]KeyValue, 0, len(items))
+	for _, item := range items {
+		if item = strings.TrimSpace(item); len(item) == 0 {
+			continue
+		}
+		parts, _ := splitUnquoted(item, ':', 2)
+		if len(parts) != 2 || len(unquote(strings.TrimSpace(parts[0]))) == 0 {
+			return nil, fmt.Errorf("Expected `key:value`, got: %s", item)
+		}
+		pairs = append(pairs, KeyValue{
+			Key:   unquote(strings.TrimSpace(parts[0])),
+			Value: unquote(strings.TrimSpace(parts[1])),
+		})
+	}
+	return pairs, nil
+}
+
+// splitUnquoted splits `s` at each `sep` outside double quotes, into at
+// most `n` parts unless `n` is negative. Quotes are kept.
+func splitUnquoted(s string, sep byte, n int) ([]string, error) {
+	parts := []string{}
+	quoted := false
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '"':
+			quoted = !quoted
+		case s[i] == sep && !quoted && (n < 0 || len(parts) < n-1):
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	if quoted {
+		return nil, fmt.Errorf("Unterminated quote: %s", s)
+	}
+	return append(parts, s[start:]), nil
+}
+
+// unquote removes the double quotes from a value split by splitUnquoted,
+// keeping `""` within quotes as a literal quote
+func unquote(s string) string {
+	if strings.IndexByte(s, '"') < 0 {
+		return s
+	}
+	var str strings.Builder
+	quoted := false
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] != '"':
+			str.WriteByte(s[i])
+		case quoted && i+1 < len(s) && s[i+1] == '"':
+			str.WriteByte('"')
+			i++
+		default:
+			quoted = !quoted
+		}
+	}
+	return str.String()
+}
+
+// kvCsvParse parses "k1:v1,k2:v2" as a map
+func kvCsvParse(s string) (map[string]string, error) {
+	pairs, err := kvCsvPairs(s)
+	if err != nil {
+		return nil, err
+	}
+	kv := make(map[string]string, len(pairs))
+	for _, pair := range pairs {
+		kv[pair.Key] = pair.Value
 	}
+	return kv, nil
+}
+
+// timeSpecifications extend strftime with `%L` milliseconds, `%f`
+// microseconds, `%N` nanoseconds, `%s` epoch seconds and `%Q` epoch
+// milliseconds
+var timeSpecifications = []strftime.Option{
+	strftime.WithMilliseconds('L'),
+	strftime.WithSpecification('f', fractionalSeconds(6)),
+	strftime.WithSpecification('N', fractionalSeconds(9)),
+	strftime.WithUnixSeconds('s'),
+	strftime.WithSpecification('Q', strftime.AppendFunc(func(b []byte, t time.Time) []byte {
+		return strconv.AppendInt(b, t.UnixNano()/int64(time.Millisecond), 10)
+	})),
+}
+
+// fractionalSeconds appends the zero padded fraction of a second to
+// `digits` places
+func fractionalSeconds(digits int) strftime.Appender {
+	divisor := 1
+	for i := digits; i < 9; i++ {
+		divisor *= 10
+	}
+	return strftime.AppendFunc(func(b []byte, t time.Time) []byte {
+		fraction := strconv.Itoa(t.Nanosecond() / divisor)
+		for i := len(fraction); i < digits; i++ {
+			b = append(b, '0')
+		}
+		return append(b, fraction...)
+	})
+}
+
+func newTimeFormatter(pattern string) (*strftime.Strftime, error) {
+	return strftime.New(pattern, timeSpecifications...)
 }
 
 func formattedTime(tf *strftime.Strftime, t time.Time) StringInt64 {
@@ -63,67 +193,114 @@ func formattedTime(tf *strftime.Strftime, t time.Time) StringInt64 {
 	}
 }
 
-// TODO/Future: MMF should be optional
-func matchRecordToMatchMap(stringifiedRecord StringifiedRecordType, matchMap MatchMapType) (bool, *map[string]string, *map[string]string, error) {
-	WILDCARD := "*"
-	matched := make(map[string]string)
-	for mmKey, mmChild := range matchMap {
-		if _, keyExists := stringifiedRecord[mmKey]; keyExists {
-			for mmChildKey, mmChildValuesMap := range mmChild {
-				if strings.HasSuffix(mmChildKey, WILDCARD) {
-					prefixToMatch := strings.Split(mmChildKey, WILDCARD)[0]
-					if strings.HasPrefix(stringifiedRecord[mmKey].(string), prefixToMatch) {
-						matched[mmKey] = prefixToMatch + WILDCARD
-						return true, &matched, &mmChildValuesMap, nil
-					}
-				} else {
-					if stringifiedRecord[mmKey].(string) == mmChildKey {
-						matched[mmKey] = mmChildKey
-						return true, &matched, &mmChildValuesMap, nil
-					}
-				}
-			}
+// convertFluentBitRecord converts a decoded msgpack record to JSON
+// compatible Go values, keeping numbers, booleans, maps and arrays
+func convertFluentBitRecord(record map[interface{}]interface{}) (StringifiedRecordType, error) {
+	converted := make(StringifiedRecordType, len(record))
+	for k, v := range record {
+		key, err := convertFluentBitKey(k)
+		if err != nil {
+			return nil, err
+		}
+		if converted[key], err = convertFluentBitValue(v); err != nil {
+			return nil, err
 		}
 	}
-	return false, nil, nil, nil
+	return converted, nil
 }
 
-// TODO/Future: reloading / config from URL
-func loadMatchMapFile(filename string, target interface{}) error {
-	raw, err := ioutil.ReadFile(filename)
-	if err != nil {
-		return err
+func convertFluentBitKey(k interface{}) (string, error) {
+	switch key := k.(type) {
+	case string:
+		return key, nil
+	case []byte:
+		return string(key), nil
+	case int64, uint64, float64, float32, bool:
+		return fmt.Sprint(key), nil
 	}
-	if err := json.Unmarshal(raw, target); err != nil {
-		return err
-	}
-	return nil
+	return "", fmt.Errorf("Unable to convert key: %#v", k)
 }
 
-func stringifyFluentBitRecord(record map[interface{}]interface{}) (StringifiedRecordType, error) {
-	stringified := make(StringifiedRecordType)
-	for k, v := range record {
-		if kStr, kOk := k.(string); kOk {
-			if vStr, vOk := v.([]byte); vOk {
-				stringified[kStr] = string(vStr)
-			} else {
-				return nil, fmt.Errorf("Unable to stringify value: %#v", v)
+func convertFluentBitValue(v interface{}) (interface{}, error) {
+	switch value := v.(type) {
+	case []byte:
+		return string(value), nil
+	case string, int64, uint64, float64, float32, bool, nil:
+		return value, nil
+	case output.FLBTime:
+		return value.Time.Format(time.RFC3339Nano), nil
+	case map[interface{}]interface{}:
+		converted := make(map[string]interface{}, len(value))
+		for k, item := range value {
+			key, err := convertFluentBitKey(k)
+			if err != nil {
+				return nil, err
+			}
+			if converted[key], err = convertFluentBitValue(item); err != nil {
+				return nil, err
+			}
+		}
+		return converted, nil
+	case []interface{}:
+		converted := make([]interface{}, len(value))
+		for i, item := range value {
+			var err error
+			if converted[i], err = convertFluentBitValue(item); err != nil {
+				return nil, err
 			}
-
-		} else {
-			return nil, fmt.Errorf("Unable to stringify key: %#v", k)
 		}
+		return converted, nil
 	}
-	return stringified, nil
+	return nil, fmt.Errorf("Unable to convert value: %#v", v)
 }
 
-func generateDeduplicationKeyFromRecordValues(ddFields []string, record StringifiedRecordType) string {
+var dedupKeyEscaper = strings.NewReplacer(`\`, `\\`, ":", `\:`, "@", `\@`)
+
+// generateDeduplicationKeyFromRecordValues joins the values of `ddFields`
+// (field names or paths) with ":", escaping any ":" (and "@") within values
+// so that distinct values cannot produce the same key. A missing field is an
+// error, unless a placeholder is given to stand in for it.
+func generateDeduplicationKeyFromRecordValues(ddFields []string, record StringifiedRecordType, placeholder *string) (string, error) {
 	var str strings.Builder
 	for i, v := range ddFields {
-		str.WriteString(record[v].(string))
+		value, exists := lookupField(record, v)
+		if !exists || value == nil {
+			if placeholder == nil {
+				return "", fmt.Errorf("Missing deduplication key field: %s", v)
+			}
+			str.WriteString(dedupKeyEscaper.Replace(*placeholder))
+		} else {
+			str.WriteString(dedupKeyEscaper.Replace(keyString(value)))
+		}
 		if i+1 < len(ddFields) {
 			str.WriteString(":")
 		}
 	}
-	return str.String()
+	return str.String(), nil
+}
+
+// hashRecord returns a stable digest of a record's content. JSON is used as
+// the canonical form, as encoding/json sorts map keys. Records which cannot
+// be marshaled (e.g. containing NaN) are an error, rather than all sharing
+// one digest.
+func hashRecord(record StringifiedRecordType) (string, error) {
+	canonical, err := json.Marshal(record)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(canonical)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// generateDeduplicationKeyFromRecordContent keys a record by a digest of its
+// whole content, less any fields (or paths) which should not distinguish
+// duplicates
+func generateDeduplicationKeyFromRecordContent(record StringifiedRecordType, ignoreFields ...[]string) (string, error) {
+	filtered := copyRecord(record)
+	for _, fields := range ignoreFields {
+		for _, f := range fields {
+			deleteField(filtered, f)
+		}
+	}
+	return hashRecord(filtered)
 }
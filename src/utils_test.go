@@ -0,0 +1,190 @@
+package main
+
+import (
+	output "github.com/fluent/fluent-bit-go/output"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDeduplicationKeyFromRecordValues(t *testing.T) {
+	placeholder := "-"
+	record := StringifiedRecordType{
+		"id":    "a:b",
+		"at":    "x@y",
+		"slash": `c\`,
+		"empty": "",
+		"null":  nil,
+		"n":     int64(7),
+		"obj":   map[string]interface{}{"k": "v"},
+	}
+	for _, test := range []struct {
+		fields      []string
+		placeholder *string
+		want        string
+	}{
+		{[]string{"n"}, nil, `7`},
+		{[]string{"n", "empty"}, nil, `7:`},
+		// ":", "@" and "\" in values are escaped
+		{[]string{"id"}, nil, `a\:b`},
+		{[]string{"at", "slash", "n"}, nil, `x\@y:c\\:7`},
+		{[]string{"obj.k", "obj"}, nil, `v:{"k"\:"v"}`},
+		// a missing (or null) field is an error without a placeholder, which
+		// is skipped or passed by `dedup_missing_key`
+		{[]string{"n", "missing"}, nil, ``},
+		{[]string{"null"}, nil, ``},
+		{[]string{"n", "missing", "null"}, &placeholder, `7:-:-`},
+	} {
+		key, err := generateDeduplicationKeyFromRecordValues(test.fields, record, test.placeholder)
+		if len(test.want) == 0 {
+			if err == nil {
+				t.Errorf("%v: key %q, want an error", test.fields, key)
+			}
+		} else if err != nil || key != test.want {
+			t.Errorf("%v: key %q, %v, want %q", test.fields, key, err, test.want)
+		}
+	}
+
+	// values which differ only in their separators give distinct keys
+	distinct := map[string][]string{}
+	for _, values := range [][]string{{"a:b", "c"}, {"a", "b:c"}, {`a\`, "b"}, {`a\:b`, ""}} {
+		key, _ := generateDeduplicationKeyFromRecordValues(
+			[]string{"1", "2"},
+			StringifiedRecordType{"1": values[0], "2": values[1]},
+			nil,
+		)
+		if other, exists := distinct[key]; exists {
+			t.Fatalf("%q and %q share the key %q", values, other, key)
+		}
+		distinct[key] = values
+	}
+}
+
+func TestConvertFluentBitRecord(t *testing.T) {
+	at := time.Date(2024, 3, 1, 10, 0, 0, 123456789, time.UTC)
+	converted, err := convertFluentBitRecord(map[interface{}]interface{}{
+		"bytes":  []byte("text"),
+		int64(1): "int key",
+		true:     "bool key",
+		"types": map[interface{}]interface{}{
+			"i": int64(-1),
+			"u": uint64(1),
+			"f": 1.5,
+			"g": float32(0.5),
+			"b": true,
+			"n": nil,
+			"s": "s",
+		},
+		"nested": map[interface{}]interface{}{
+			"list": []interface{}{[]byte("a"), map[interface{}]interface{}{"deep": []byte("b")}},
+		},
+		"time": output.FLBTime{Time: at},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := StringifiedRecordType{
+		"bytes": "text",
+		"1":     "int key",
+		"true":  "bool key",
+		"types": map[string]interface{}{
+			"i": int64(-1),
+			"u": uint64(1),
+			"f": 1.5,
+			"g": float32(0.5),
+			"b": true,
+			"n": nil,
+			"s": "s",
+		},
+		"nested": map[string]interface{}{
+			"list": []interface{}{"a", map[string]interface{}{"deep": "b"}},
+		},
+		"time": "2024-03-01T10:00:00.123456789Z",
+	}
+	if !reflect.DeepEqual(converted, want) {
+		t.Fatalf("converted\n\t%#v\nwant\n\t%#v", converted, want)
+	}
+
+	for _, record := range []map[interface{}]interface{}{
+		{"c": complex(1, 1)},
+		{"m": map[interface{}]interface{}{"c": struct{}{}}},
+		{"l": []interface{}{[]int{1}}},
+		{[2]string{"k"}: "composite key"},
+		{"m": map[interface{}]interface{}{nil: 1}},
+	} {
+		if converted, err := convertFluentBitRecord(record); err == nil {
+			t.Errorf("%#v converted to %#v", record, converted)
+		}
+	}
+}
+
+func TestKvCsvPairs(t *testing.T) {
+	for _, test := range []struct {
+		s    string
+		want []KeyValue
+		err  string
+	}{
+		{``, []KeyValue{}, ``},
+		{`a:b`, []KeyValue{{"a", "b"}}, ``},
+		{` a : b , c:d ,, `, []KeyValue{{"a", "b"}, {"c", "d"}}, ``},
+		// the first ":" splits, so values may hold more
+		{`time:%H:%M:%S,ms:%Q`, []KeyValue{{"time", "%H:%M:%S"}, {"ms", "%Q"}}, ``},
+		{`a:`, []KeyValue{{"a", ""}}, ``},
+		// quoted commas and colons
+		{`date:"%d %b, %Y",b:c`, []KeyValue{{"date", "%d %b, %Y"}, {"b", "c"}}, ``},
+		{`"a:b":c`, []KeyValue{{"a:b", "c"}}, ``},
+		{`"a,b":"c,d"`, []KeyValue{{"a,b", "c,d"}}, ``},
+		{`a:" padded "`, []KeyValue{{"a", " padded "}}, ``},
+		{`a:"say ""hi""",b:""`, []KeyValue{{"a", `say "hi"`}, {"b", ""}}, ``},
+		{`a:x"y,z"`, []KeyValue{{"a", "xy,z"}}, ``},
+		{`a`, nil, "Expected `key:value`, got: a"},
+		{`:b`, nil, "Expected `key:value`, got: :b"},
+		{`"":b`, nil, "Expected `key:value`"},
+		{`a:"b,c`, nil, "Unterminated quote"},
+	} {
+		pairs, err := kvCsvPairs(test.s)
+		if len(test.err) > 0 {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: got %v, %v, want error %q", test.s, pairs, err, test.err)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(pairs, test.want) {
+			t.Errorf("%s: got %q, %v, want %q", test.s, pairs, err, test.want)
+		}
+	}
+}
+
+func TestTimeFormatter(t *testing.T) {
+	at := time.Date(2024, 3, 1, 9, 5, 7, 8009005, time.UTC)
+	for _, test := range []struct {
+		pattern string
+		t       time.Time
+		want    string
+		integer bool
+	}{
+		{"%Y-%m-%dT%H:%M:%S", at, "2024-03-01T09:05:07", false},
+		{"%Y-%m-%dT%H:%M:%S.%LZ", at, "2024-03-01T09:05:07.008Z", false},
+		{"%S.%f", at, "07.008009", false},
+		{"%S.%N", at, "07.008009005", false},
+		{"%s", at, "1709283907", true},
+		{"%Q", at, "1709283907008", true},
+		{"%s.%L", at, "1709283907.008", false},
+		// fractions are zero padded, and truncated rather than rounded
+		{"%L|%f|%N", time.Date(2024, 3, 1, 0, 0, 0, 5, time.UTC), "000|000000|000000005", false},
+		{"%L|%f|%N", time.Date(2024, 3, 1, 0, 0, 0, 999999999, time.UTC), "999|999999|999999999", false},
+		{"%Q", time.Unix(-1, 500000000), "-500", true},
+		{"%Y%m%d", at, "20240301", true},
+		{"%%s", at, "%s", false},
+	} {
+		formatter, err := newTimeFormatter(test.pattern)
+		if err != nil {
+			t.Fatalf("%s: %v", test.pattern, err)
+		}
+		formatted := formattedTime(formatter, test.t)
+		if *formatted.String != test.want || (formatted.Int64 != nil) != test.integer {
+			t.Errorf("%s: got %q (integer %v), want %q (integer %v)", test.pattern, *formatted.String, formatted.Int64 != nil, test.want, test.integer)
+		}
+	}
+}